@@ -0,0 +1,282 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/spf13/cobra"
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/vishvananda/netns"
+	"github.com/coreos/mantle/network"
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/local"
+)
+
+var (
+	cmdSSH = &cobra.Command{
+		Run:   runSSH,
+		Use:   "ssh <machine> [command]",
+		Short: "SSH to a machine spawned by kola spawn",
+		Long: `SSH to a machine of the cluster spawned by kola spawn, given by
+index or ID, and run a shell or the command.`,
+	}
+
+	cmdLs = &cobra.Command{
+		Run:   runLs,
+		Use:   "ls",
+		Short: "List the machines spawned by kola spawn",
+	}
+
+	cmdDestroy = &cobra.Command{
+		Run:   runDestroy,
+		Use:   "destroy",
+		Short: "Destroy the cluster spawned by kola spawn",
+	}
+
+	spawnStatePath string
+)
+
+// destroyTimeout is how long kola destroy waits for the cluster to be
+// destroyed.
+const destroyTimeout = 2 * time.Minute
+
+func init() {
+	for _, cmd := range []*cobra.Command{cmdSSH, cmdLs, cmdDestroy} {
+		stateFlag(cmd)
+		root.AddCommand(cmd)
+	}
+}
+
+func stateFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&spawnStatePath, "state", filepath.Join(os.TempDir(), "kola-spawn.json"), "state file of the cluster spawned by kola spawn")
+}
+
+// spawnState describes the cluster spawned by kola spawn, for other kola
+// commands to attach to it.
+type spawnState struct {
+	// PID is the process of kola spawn, which keeps the cluster
+	// running.
+	PID      int
+	Platform string
+
+	// SSHAgent and Namespace are the socket of the SSH agent and the
+	// network namespace to reach the machines in, see
+	// platform.AttachableCluster.
+	SSHAgent  string
+	Namespace string `json:",omitempty"`
+
+	Machines []spawnMachine
+}
+
+type spawnMachine struct {
+	ID        string
+	IP        string
+	PrivateIP string
+	IPs       []string
+}
+
+func writeSpawnState(cluster platform.Cluster) error {
+	ac, ok := cluster.(platform.AttachableCluster)
+	if !ok {
+		return fmt.Errorf("cannot attach to %s clusters", kolaPlatform)
+	}
+
+	st := spawnState{
+		PID:       os.Getpid(),
+		Platform:  kolaPlatform,
+		SSHAgent:  ac.SSHAgentSocket(),
+		Namespace: ac.NetNSPath(),
+	}
+	for _, m := range cluster.Machines() {
+		st.Machines = append(st.Machines, spawnMachine{
+			ID:        m.ID(),
+			IP:        m.IP(),
+			PrivateIP: m.PrivateIP(),
+			IPs:       m.IPs(),
+		})
+	}
+
+	b, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write atomically, kola ls may be reading it.
+	tmp := spawnStatePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, spawnStatePath)
+}
+
+func readSpawnState() (*spawnState, error) {
+	b, err := ioutil.ReadFile(spawnStatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var st spawnState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("%s: %v", spawnStatePath, err)
+	}
+	return &st, nil
+}
+
+// running reports whether the process keeping the cluster is alive.
+func (st *spawnState) running() bool {
+	return syscall.Kill(st.PID, 0) == nil
+}
+
+// machine finds a machine by index or ID.
+func (st *spawnState) machine(name string) (*spawnMachine, error) {
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(st.Machines) {
+		return &st.Machines[i], nil
+	}
+	for i := range st.Machines {
+		if st.Machines[i].ID == name {
+			return &st.Machines[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no machine %q, see kola ls", name)
+}
+
+// attachedState reads the state of a running cluster.
+func attachedState() *spawnState {
+	st, err := readSpawnState()
+	if os.IsNotExist(err) {
+		die("No cluster, see kola spawn")
+	} else if err != nil {
+		die("Reading state failed: %v", err)
+	}
+	if !st.running() {
+		die("The cluster is gone with process %d, remove it with kola destroy", st.PID)
+	}
+	return st
+}
+
+func runSSH(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		die("Usage: kola ssh <machine> [command]")
+	}
+
+	st := attachedState()
+	m, err := st.machine(args[0])
+	if err != nil {
+		die("%v", err)
+	}
+
+	var dialer network.Dialer = network.NewRetryDialer()
+	if st.Namespace != "" {
+		ns, err := netns.GetFromPath(st.Namespace)
+		if err != nil {
+			die("Opening network namespace failed: %v", err)
+		}
+		defer ns.Close()
+		dialer = local.NewNsDialer(ns)
+	}
+
+	agent, err := network.AttachSSHAgent(st.SSHAgent, dialer)
+	if err != nil {
+		die("Attaching to SSH agent failed: %v", err)
+	}
+	defer agent.Close()
+
+	client, err := agent.NewClient(m.IP)
+	if err != nil {
+		die("SSH client failed: %v", err)
+	}
+	defer client.Close()
+
+	if len(args) == 1 {
+		if err := platform.Shell(client); err != nil {
+			die("Shell failed: %v", err)
+		}
+		return
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		die("SSH session failed: %v", err)
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	if err := session.Run(strings.Join(args[1:], " ")); err != nil {
+		die("%v", err)
+	}
+}
+
+func runLs(cmd *cobra.Command, args []string) {
+	listSpawned()
+}
+
+func listSpawned() {
+	st, err := readSpawnState()
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		die("Reading state failed: %v", err)
+	}
+
+	status := "running"
+	if !st.running() {
+		status = "gone"
+	}
+	fmt.Printf("%s cluster of process %d (%s)\n\n", st.Platform, st.PID, status)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(w, "#\tID\tIP\tPrivate IP\tAll IPs")
+	for i, m := range st.Machines {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%v\n", i, m.ID, m.IP, m.PrivateIP, m.IPs)
+	}
+	w.Flush()
+}
+
+func runDestroy(cmd *cobra.Command, args []string) {
+	st, err := readSpawnState()
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		die("Reading state failed: %v", err)
+	}
+
+	if st.running() {
+		if err := syscall.Kill(st.PID, syscall.SIGTERM); err != nil {
+			die("Stopping process %d failed: %v", st.PID, err)
+		}
+
+		// the process destroys the cluster and removes the state.
+		deadline := time.Now().Add(destroyTimeout)
+		for st.running() {
+			if time.Now().After(deadline) {
+				die("Process %d did not exit in %v", st.PID, destroyTimeout)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+
+	os.Remove(spawnStatePath)
+}
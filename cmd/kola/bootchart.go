@@ -57,6 +57,10 @@ func runBootchart(cmd *cobra.Command, args []string) {
 		cluster, err = platform.NewGCECluster(kola.GCEOptions)
 	} else if kolaPlatform == "aws" {
 		cluster, err = platform.NewAWSCluster(kola.AWSOptions)
+	} else if kolaPlatform == "external" {
+		cluster, err = platform.NewExternalCluster(kola.ExternalOptions)
+	} else if kolaPlatform == "nspawn" {
+		cluster, err = platform.NewNspawnCluster(kola.NspawnOptions)
 	} else {
 		fmt.Fprintf(os.Stderr, "Invalid platform: %v", kolaPlatform)
 	}
@@ -15,7 +15,10 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/coreos/mantle/kola"
+	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/sdk"
 )
 
@@ -28,10 +31,34 @@ func init() {
 	bv := root.PersistentFlags().BoolVar
 
 	// general options
-	sv(&kolaPlatform, "platform", "qemu", "VM platform: qemu, gce, aws")
+	sv(&kolaPlatform, "platform", "qemu", "VM platform: qemu, gce, aws, external, nspawn")
 	root.PersistentFlags().IntVar(&kola.TestParallelism, "parallel", 1, "number of tests to run in parallel")
 
+	// qemu specific options
 	sv(&kola.QEMUOptions.DiskImage, "qemu-image", sdk.BuildRoot()+"/images/amd64-usr/latest/coreos_production_image.bin", "path to CoreOS disk image")
+	sv(&kola.QEMUOptions.Arch, "qemu-arch", "amd64", "architecture of the QEMU image: amd64, arm64")
+	sv(&kola.QEMUOptions.Binary, "qemu-binary", "", "QEMU binary (default depends on --qemu-arch)")
+	sv(&kola.QEMUOptions.Machine, "qemu-machine", "", "QEMU machine type (default depends on --qemu-arch)")
+	sv(&kola.QEMUOptions.Firmware, "qemu-firmware", "", "QEMU firmware image (default depends on --qemu-arch)")
+	bv(&kola.QEMUOptions.EFI, "qemu-efi", false, "boot QEMU machines with UEFI firmware")
+	bv(&kola.QEMUOptions.SecureBoot, "qemu-secure-boot", false, "boot QEMU machines with UEFI Secure Boot enabled")
+	sv(&kola.QEMUOptions.EFICode, "qemu-efi-code", "", "UEFI firmware image (default depends on --qemu-arch)")
+	sv(&kola.QEMUOptions.EFIVars, "qemu-efi-vars", "", "template of the UEFI variable store (default depends on --qemu-arch)")
+	bv(&kola.QEMUOptions.Overlay, "qemu-overlay", false, "use qcow2 overlays of the QEMU disk images instead of copies")
+	sv(&kola.QEMUOptions.PreserveDir, "qemu-preserve-dir", "", "directory to keep the qcow2 overlays and consoles of failed tests in")
+	bv(&kola.QEMUOptions.PXE, "qemu-pxe", false, "boot QEMU machines diskless with iPXE")
+	bv(&kola.QEMUOptions.IPv6Only, "qemu-ipv6-only", false, "give QEMU machines IPv6 addresses only")
+	sv(&kola.QEMUOptions.PXEKernel, "qemu-pxe-kernel", "", "kernel booted with PXE (default coreos_production_pxe.vmlinuz next to --qemu-image)")
+	sv(&kola.QEMUOptions.PXEInitrd, "qemu-pxe-initrd", "", "initramfs booted with PXE (default coreos_production_pxe_image.cpio.gz next to --qemu-image)")
+	sv(&kola.QEMUOptions.FileServerDir, "qemu-file-server-dir", "", "directory served to QEMU machines by the cluster's file server")
+	root.PersistentFlags().StringSliceVar(&kola.QEMUOptions.RegistryImages, "qemu-registry-image", nil, "docker save tarballs served by the cluster's Docker registry")
+	sv(&kola.QEMUOptions.Accel, "qemu-accel", "", "QEMU accelerator: kvm, tcg (default kvm if available)")
+	root.PersistentFlags().IntVar(&kola.QEMUOptions.CPUs, "qemu-cpus", 2, "number of CPUs of QEMU machines")
+	root.PersistentFlags().IntVar(&kola.QEMUOptions.Memory, "qemu-memory", 1024, "memory of QEMU machines in MiB")
+	root.PersistentFlags().Var((*diskFlag)(&kola.QEMUOptions.Disks), "qemu-disk", "additional disk of QEMU machines, a size or image path optionally followed by ',if=virtio|scsi|nvme' (repeatable)")
+	root.PersistentFlags().StringSliceVar(&kola.QEMUOptions.Networks, "qemu-network", []string{"br0"}, "bridges to attach the NICs of QEMU machines to")
+	root.PersistentFlags().Var((*argsFlag)(&kola.QEMUOptions.ExtraArgs), "qemu-args", "extra QEMU arguments, split on whitespace")
+	sv(&kola.QEMUOptions.UplinkRange, "qemu-uplink-range", "100.64.0.0/10", "IPv4 network the host side of NAT uplinks of QEMU clusters is addressed from")
 
 	// gce specific options
 	sv(&kola.GCEOptions.Image, "gce-image", "latest", "GCE image")
@@ -43,10 +70,54 @@ func init() {
 	sv(&kola.GCEOptions.Network, "gce-network", "default", "GCE network")
 	bv(&kola.GCEOptions.ServiceAuth, "gce-service-auth", false, "for non-interactive auth when running within GCE")
 
+	// external specific options
+	sv(&kola.ExternalOptions.HostsFile, "external-hosts", "", "JSON file listing the pre-existing hosts to run on")
+
+	// nspawn specific options
+	sv(&kola.NspawnOptions.DiskImage, "nspawn-image", sdk.BuildRoot()+"/images/amd64-usr/latest/coreos_production_image.bin", "path to the CoreOS disk image whose USR and ROOT partitions are booted in systemd-nspawn")
+
 	// aws specific options
-	// CoreOS-alpha-845.0.0 on us-west-1
-	sv(&kola.AWSOptions.AMI, "aws-ami", "ami-55438011", "AWS AMI ID")
+	sv(&kola.AWSOptions.AMI, "aws-ami", "alpha", "AWS AMI ID, or alpha, beta or stable for the latest CoreOS AMI of the channel")
 	sv(&kola.AWSOptions.KeyName, "aws-key", "", "AWS SSH key name")
-	sv(&kola.AWSOptions.InstanceType, "aws-type", "t1.micro", "AWS instance type")
+	sv(&kola.AWSOptions.InstanceType, "aws-type", "t2.micro", "AWS instance type")
 	sv(&kola.AWSOptions.SecurityGroup, "aws-sg", "kola", "AWS security group name")
+	bv(&kola.AWSOptions.EphemeralNetwork, "aws-ephemeral-network", false, "create a VPC, security group and key pair for each cluster instead of using --aws-sg and --aws-key")
+	sv(&kola.AWSOptions.Region, "aws-region", "", "AWS region (default $AWS_REGION)")
+	sv(&kola.AWSOptions.Endpoint, "aws-endpoint", "", "EC2 API endpoint (default that of the region)")
+}
+
+// diskFlag collects the disks given by repeated --qemu-disk flags.
+type diskFlag []platform.QEMUDisk
+
+func (f *diskFlag) String() string {
+	return ""
+}
+
+func (f *diskFlag) Set(spec string) error {
+	disk, err := platform.ParseQEMUDisk(spec)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, disk)
+	return nil
+}
+
+func (f *diskFlag) Type() string {
+	return "disk"
+}
+
+// argsFlag splits --qemu-args into separate arguments.
+type argsFlag []string
+
+func (f *argsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *argsFlag) Set(args string) error {
+	*f = append(*f, strings.Fields(args)...)
+	return nil
+}
+
+func (f *argsFlag) Type() string {
+	return "args"
 }
@@ -18,6 +18,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/spf13/cobra"
 	"github.com/coreos/mantle/kola"
@@ -29,17 +33,31 @@ var (
 		Run:   runSpawn,
 		Use:   "spawn",
 		Short: "spawn a CoreOS instance",
+		Long: `Spawn CoreOS instances.
+
+The cluster is described in a state file while it runs, for kola ssh, ls
+and destroy. With --detach it persists in the background until kola
+destroy.`,
 	}
 
 	spawnUserData string
 	spawnShell    bool
 	spawnRemove   bool
+	spawnCount    int
+	spawnDetach   bool
 )
 
+// spawnDetachedEnv is set for the background process of kola spawn
+// --detach, which keeps the cluster running.
+const spawnDetachedEnv = "KOLA_SPAWN_DETACHED"
+
 func init() {
-	cmdSpawn.Flags().StringVarP(&spawnUserData, "userdata", "u", "", "userdata to pass to the instance")
-	cmdSpawn.Flags().BoolVarP(&spawnShell, "shell", "s", false, "spawn a shell in the instance before exiting")
-	cmdSpawn.Flags().BoolVarP(&spawnRemove, "remove", "r", true, "remove instance after shell exits")
+	cmdSpawn.Flags().StringVarP(&spawnUserData, "userdata", "u", "", "userdata to pass to the instances")
+	cmdSpawn.Flags().BoolVarP(&spawnShell, "shell", "s", false, "spawn a shell in the first instance before exiting")
+	cmdSpawn.Flags().BoolVarP(&spawnRemove, "remove", "r", true, "remove instances after shell exits")
+	cmdSpawn.Flags().IntVarP(&spawnCount, "count", "n", 1, "number of instances to spawn")
+	cmdSpawn.Flags().BoolVar(&spawnDetach, "detach", false, "keep the cluster running in the background until kola destroy")
+	stateFlag(cmdSpawn)
 	root.AddCommand(cmdSpawn)
 }
 
@@ -55,6 +73,29 @@ func runSpawn(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	detached := os.Getenv(spawnDetachedEnv) != ""
+	if spawnDetach && !detached {
+		if err := detachSpawn(); err != nil {
+			die("Spawning detached cluster failed: %v", err)
+		}
+		listSpawned()
+		return
+	}
+
+	// a detached spawn reports failures through the pipe to its parent.
+	var parent *os.File
+	if detached {
+		parent = os.NewFile(3, "parent")
+		die = func(format string, args ...interface{}) {
+			fmt.Fprintf(parent, format, args...)
+			os.Exit(1)
+		}
+	}
+
+	if st, err := readSpawnState(); err == nil && st.running() {
+		die("A cluster spawned by process %d is running, see kola ls", st.PID)
+	}
+
 	switch kolaPlatform {
 	case "qemu":
 		cluster, err = platform.NewQemuCluster(kola.QEMUOptions)
@@ -62,6 +103,12 @@ func runSpawn(cmd *cobra.Command, args []string) {
 		cluster, err = platform.NewGCECluster(kola.GCEOptions)
 	case "aws":
 		cluster, err = platform.NewAWSCluster(kola.AWSOptions)
+	case "external":
+		opts := kola.ExternalOptions
+		opts.Reserve = spawnCount
+		cluster, err = platform.NewExternalCluster(opts)
+	case "nspawn":
+		cluster, err = platform.NewNspawnCluster(kola.NspawnOptions)
 	default:
 		err = fmt.Errorf("invalid platform %q", kolaPlatform)
 	}
@@ -70,23 +117,94 @@ func runSpawn(cmd *cobra.Command, args []string) {
 		die("Cluster failed: %v", err)
 	}
 
-	mach, err := cluster.NewMachine(string(userdata))
-	if err != nil {
-		die("Spawning instance failed: %v", err)
+	for i := 0; i < spawnCount; i++ {
+		if _, err := cluster.NewMachine(string(userdata)); err != nil {
+			cluster.Destroy()
+			die("Spawning instance failed: %v", err)
+		}
+	}
+
+	if err := writeSpawnState(cluster); err != nil {
+		cluster.Destroy()
+		die("Writing state failed: %v", err)
+	}
+	defer os.Remove(spawnStatePath)
+
+	if detached {
+		parent.Close()
+
+		// wait for kola destroy
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+
+		if err := cluster.Destroy(); err != nil {
+			fmt.Fprintf(os.Stderr, "Destroying cluster failed: %v\n", err)
+		}
+		return
 	}
 
 	if spawnRemove {
-		defer mach.Destroy()
+		defer cluster.Destroy()
 	}
 
 	if spawnShell {
-		if err := platform.Manhole(mach); err != nil {
+		if err := platform.Manhole(cluster.Machines()[0]); err != nil {
 			die("Manhole failed: %v", err)
 		}
 	}
 }
 
-func die(format string, args ...interface{}) {
+// detachSpawn runs kola spawn again in the background, logging next to
+// the state file, and waits for its cluster to be up.
+func detachSpawn() error {
+	log, err := os.Create(spawnStatePath + ".log")
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	self, err := filepath.EvalSymlinks("/proc/self/exe")
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), spawnDetachedEnv+"=1")
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	// the pipe is closed once the cluster is up, after an error
+	// message if it failed.
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(msg) > 0 {
+		return fmt.Errorf("%s", msg)
+	}
+
+	if st, err := readSpawnState(); err != nil || st.PID != cmd.Process.Pid {
+		return fmt.Errorf("no cluster, see %s", log.Name())
+	}
+	return nil
+}
+
+var die = func(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
 	os.Exit(1)
 }
@@ -17,9 +17,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"syscall"
 
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/spf13/cobra"
 	"github.com/coreos/mantle/cli"
+	"github.com/coreos/mantle/kola/native"
 	"github.com/coreos/mantle/kola/register"
 
 	// Register any tests that we may wish to execute in kolet.
@@ -37,13 +39,35 @@ var (
 		Short: "Run native tests a group at a time",
 		Run:   Run,
 	}
+
+	cmdAgent = &cobra.Command{
+		Use:   "agent",
+		Short: "Serve native function calls from kola over stdin and stdout",
+		Run:   Agent,
+	}
 )
 
 func main() {
 	root.AddCommand(cmdRun)
+	root.AddCommand(cmdAgent)
 	cli.Execute(root)
 }
 
+// lookup finds the native function funcname of test testname.
+func lookup(testname, funcname string) (func() error, error) {
+	// find test with matching name
+	test, ok := register.Tests[testname]
+	if !ok {
+		return nil, fmt.Errorf("test group %q not found", testname)
+	}
+	// find native function in test
+	f, ok := test.NativeFuncs[funcname]
+	if !ok {
+		return nil, fmt.Errorf("native function %q not found", funcname)
+	}
+	return f, nil
+}
+
 // test runner
 func Run(cmd *cobra.Command, args []string) {
 	if len(args) != 2 {
@@ -52,21 +76,55 @@ func Run(cmd *cobra.Command, args []string) {
 	}
 	testname, funcname := args[0], args[1]
 
-	// find test with matching name
-	test, ok := register.Tests[testname]
-	if !ok {
-		fmt.Fprintf(os.Stderr, "kolet: test group %q not found\n", testname)
+	f, err := lookup(testname, funcname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kolet: %v\n", err)
 		os.Exit(1)
 	}
-	// find native function in test
-	f, ok := test.NativeFuncs[funcname]
-	if !ok {
-		fmt.Fprintf(os.Stderr, "kolet: native function %q not found\n", funcname)
+	err = f()
+	if serr, ok := err.(*native.SkipError); ok {
+		fmt.Fprintf(os.Stderr, "kolet: on native test %v: %v\n", funcname, serr)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "kolet: on native test %v: %v", funcname, err)
 		os.Exit(1)
 	}
-	err := f()
+}
+
+// agent main loop
+func Agent(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "kolet: No args accepted\n")
+		os.Exit(2)
+	}
+
+	// Keep the real stdout for the protocol and redirect stdout and
+	// stderr, including those of child processes, into a pipe that is
+	// forwarded to kola as log output.
+	protoFd, err := syscall.Dup(syscall.Stdout)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "kolet: on native test %v: %v", funcname, err)
+		fmt.Fprintf(os.Stderr, "kolet: dup stdout: %v\n", err)
+		os.Exit(1)
+	}
+	syscall.CloseOnExec(protoFd)
+	proto := os.NewFile(uintptr(protoFd), "kolet-protocol")
+
+	logr, logw, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kolet: pipe: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, fd := range []int{syscall.Stdout, syscall.Stderr} {
+		// Dup3 rather than Dup2, the latter is missing on arm64.
+		if err := syscall.Dup3(int(logw.Fd()), fd, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "kolet: redirecting output: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	s := native.NewServer(proto, logr, logw, lookup)
+	if err := s.Serve(os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "kolet: agent: %v\n", err)
 		os.Exit(1)
 	}
 }
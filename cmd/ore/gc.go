@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/spf13/cobra"
+	"github.com/coreos/mantle/Godeps/_workspace/src/google.golang.org/api/compute/v1"
+	"github.com/coreos/mantle/auth"
+	"github.com/coreos/mantle/platform"
+)
+
+var (
+	cmdGC = &cobra.Command{
+		Use:   "gc -hours=<hours>",
+		Short: "delete leaked kola instances on GCE",
+		Long: `Delete the instances kola created in any zone of the project more than
+-hours ago, and the disks as old named with -basename left without their
+instance.`,
+		Run: runGC,
+	}
+
+	gcHours int
+)
+
+func init() {
+	cmdGC.Flags().IntVar(&gcHours, "hours", 5, "minimum age of the deleted instances in hours")
+	root.AddCommand(cmdGC)
+}
+
+func runGC(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Unrecognized args in ore gc cmd: %v\n", args)
+		os.Exit(2)
+	}
+
+	// avoid deleting the disks of other tools with short prefixes
+	if len(opts.BaseName) < 2 {
+		fmt.Fprintf(os.Stderr, "Please specify a prefix of length 2 or greater with -basename\n")
+		os.Exit(1)
+	}
+
+	client, err := auth.GoogleClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Authentication failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	api, err := compute.New(client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Api Client creation failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	deleted, err := platform.GCEGarbageCollect(api, opts.Project, opts.BaseName+"-", time.Duration(gcHours)*time.Hour)
+	for _, d := range deleted {
+		fmt.Printf("%v scheduled for deletion\n", d)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed collecting garbage: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -18,11 +18,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/coreos/mantle/kola/harness"
 	"github.com/coreos/mantle/kola/register"
 	"github.com/coreos/mantle/platform"
 
@@ -44,13 +46,21 @@ import (
 var (
 	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola")
 
-	QEMUOptions platform.QEMUOptions
-	GCEOptions  platform.GCEOptions
-	AWSOptions  platform.AWSOptions
+	QEMUOptions     platform.QEMUOptions
+	GCEOptions      platform.GCEOptions
+	AWSOptions      platform.AWSOptions
+	ExternalOptions platform.ExternalOptions
+	NspawnOptions   platform.NspawnOptions
 
 	TestParallelism int
 
 	testOptions = make(map[string]string, 0)
+
+	// platformCapabilities lists the capabilities tests need to run
+	// on platforms that do not provide full machines.
+	platformCapabilities = map[string][]string{
+		"nspawn": {register.CapContainer},
+	}
 )
 
 // Registers any options that need visibility inside a Test. Panics if
@@ -70,20 +80,19 @@ func RegisterTestOption(name, option string) {
 type NativeRunner func(funcName string, m platform.Machine) error
 
 type Result struct {
-	Test     *register.Test
-	Result   error
-	Duration time.Duration
+	Test *register.Test
+	T    *harness.T
 }
 
 func testRunner(platform string, done <-chan struct{}, tests chan *register.Test, results chan *Result) {
 	for test := range tests {
 		plog.Noticef("=== RUN %s on %s", test.Name, platform)
-		start := time.Now()
-		err := RunTest(test, platform)
-		duration := time.Since(start)
+		t := harness.Run(test.Name, func(h *harness.T) {
+			runTest(h, test, platform)
+		})
 
 		select {
-		case results <- &Result{test, err, duration}:
+		case results <- &Result{test, t}:
 		case <-done:
 			return
 		}
@@ -112,6 +121,12 @@ func filterTests(tests map[string]*register.Test, pattern, platform string) (map
 			}
 		}
 		if !allowed {
+			plog.Noticef("%s is not supported on %s, only on %s", t.Name, platform, strings.Join(t.Platforms, ", "))
+			continue
+		}
+
+		if missing := missingCapabilities(t, platform); len(missing) > 0 {
+			plog.Noticef("%s is not supported on %s, it lacks capabilities %s", t.Name, platform, strings.Join(missing, ", "))
 			continue
 		}
 
@@ -121,9 +136,28 @@ func filterTests(tests map[string]*register.Test, pattern, platform string) (map
 	return r, nil
 }
 
+// missingCapabilities returns the capabilities platform needs that t is
+// not tagged with.
+func missingCapabilities(t *register.Test, platform string) []string {
+	var missing []string
+	for _, c := range platformCapabilities[platform] {
+		found := false
+		for _, tc := range t.Capabilities {
+			if tc == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
 // test runner and kola entry point
 func RunTests(pattern, pltfrm string) error {
-	var passed, failed int
+	var passed, failed, skipped int
 	var wg sync.WaitGroup
 
 	tests, err := filterTests(register.Tests, pattern, pltfrm)
@@ -161,46 +195,88 @@ func RunTests(pattern, pltfrm string) error {
 	}()
 
 	for r := range resc {
-		t := r.Test
-		err := r.Result
-		seconds := r.Duration.Seconds()
-		if err != nil {
-			plog.Errorf("--- FAIL: %s on %s (%.3fs)", t.Name, pltfrm, seconds)
-			plog.Errorf("        %v", err)
+		report(r.T, pltfrm, "")
+		switch {
+		case r.T.Failed():
 			failed++
-		} else {
-			plog.Noticef("--- PASS: %s on %s (%.3fs)", t.Name, pltfrm, seconds)
+		case r.T.Skipped():
+			skipped++
+		default:
 			passed++
 		}
 	}
 
-	plog.Noticef("%d passed %d failed out of %d total", passed, failed, passed+failed)
+	plog.Noticef("%d passed %d failed %d skipped out of %d total", passed, failed, skipped, passed+failed+skipped)
 	if failed > 0 {
 		return fmt.Errorf("%d tests failed", failed)
 	}
 	return nil
 }
 
-// create a cluster and run test
+// report logs the outcome and output of t and its subtests.
+func report(t *harness.T, pltfrm, indent string) {
+	status, logf, outf := "PASS", plog.Noticef, plog.Infof
+	switch {
+	case t.Failed():
+		status, logf, outf = "FAIL", plog.Errorf, plog.Errorf
+	case t.Skipped():
+		status, outf = "SKIP", plog.Noticef
+	}
+
+	logf("%s--- %s: %s on %s (%.3fs)", indent, status, t.Name(), pltfrm, t.Duration().Seconds())
+	for _, line := range t.Output() {
+		outf("%s        %s", indent, line)
+	}
+	for _, sub := range t.Subtests() {
+		report(sub, pltfrm, indent+"    ")
+	}
+}
+
+// RunTest creates a cluster, runs test t on it and reports the outcome.
 func RunTest(t *register.Test, pltfrm string) error {
+	h := harness.Run(t.Name, func(h *harness.T) {
+		runTest(h, t, pltfrm)
+	})
+
+	report(h, pltfrm, "")
+	if h.Failed() {
+		return fmt.Errorf("%s failed", t.Name)
+	}
+	return nil
+}
+
+// create a cluster and run test
+func runTest(h *harness.T, t *register.Test, pltfrm string) {
 	var err error
 	var cluster platform.Cluster
 
 	switch pltfrm {
 	case "qemu":
-		cluster, err = platform.NewQemuCluster(QEMUOptions)
+		opts := QEMUOptions
+		opts.Topology = t.Topology
+		cluster, err = platform.NewQemuCluster(opts)
 	case "gce":
 		cluster, err = platform.NewGCECluster(GCEOptions)
 	case "aws":
 		cluster, err = platform.NewAWSCluster(AWSOptions)
+	case "external":
+		opts := ExternalOptions
+		opts.Reserve = t.ClusterSize
+		cluster, err = platform.NewExternalCluster(opts)
+		h.Log("external hosts are not reset between tests, the result may depend on the tests run before")
+	case "nspawn":
+		cluster, err = platform.NewNspawnCluster(NspawnOptions)
 	default:
 		err = fmt.Errorf("invalid platform %q", pltfrm)
 	}
 
 	if err != nil {
-		return fmt.Errorf("Cluster failed: %v", err)
+		h.Fatalf("Cluster failed: %v", err)
 	}
 	defer func() {
+		if k, ok := cluster.(platform.DiskKeeper); ok && h.Failed() {
+			k.KeepDisks()
+		}
 		if err := cluster.Destroy(); err != nil {
 			plog.Errorf("cluster.Destroy(): %v", err)
 		}
@@ -208,16 +284,7 @@ func RunTest(t *register.Test, pltfrm string) error {
 
 	url, err := cluster.GetDiscoveryURL(t.ClusterSize)
 	if err != nil {
-		return fmt.Errorf("Failed to create discovery endpoint: %v", err)
-	}
-
-	cfgs := makeConfigs(url, t.UserData, t.ClusterSize)
-
-	if t.ClusterSize > 0 {
-		_, err := platform.NewMachines(cluster, cfgs)
-		if err != nil {
-			return fmt.Errorf("Cluster failed starting machines: %v", err)
-		}
+		h.Fatalf("Failed to create discovery endpoint: %v", err)
 	}
 
 	// pass along all registered native functions
@@ -225,6 +292,7 @@ func RunTest(t *register.Test, pltfrm string) error {
 	for k := range t.NativeFuncs {
 		names = append(names, k)
 	}
+	sort.Strings(names)
 
 	// prevent unsafe access if tests ever become parallel and access
 	tempTestOptions := make(map[string]string, 0)
@@ -233,58 +301,117 @@ func RunTest(t *register.Test, pltfrm string) error {
 	}
 
 	// Cluster -> TestCluster
-	tcluster := platform.TestCluster{
-		Name:        t.Name,
-		NativeFuncs: names,
-		Options:     tempTestOptions,
-		Cluster:     cluster,
+	tcluster := platform.NewTestCluster(h, cluster, t.Name, names, tempTestOptions)
+	tcluster.Discovery = url
+	tcluster.ClusterSize = t.ClusterSize
+	tcluster.MachineOptions = t.QEMUMachine
+	defer tcluster.Close()
+
+	if t.ClusterSize > 0 {
+		userdatas := make([]string, t.ClusterSize)
+		for i := range userdatas {
+			userdatas[i] = t.UserData
+		}
+
+		_, err := platform.NewMachines(tcluster, userdatas)
+		if uerr, ok := err.(*platform.UnsupportedError); ok {
+			h.Skip(uerr)
+		}
+		if err != nil {
+			h.Fatalf("Cluster failed starting machines: %v", err)
+		}
 	}
 
 	// drop kolet binary on machines
 	if t.NativeFuncs != nil {
 		err = scpKolet(tcluster)
 		if err != nil {
-			return fmt.Errorf("dropping kolet binary: %v", err)
+			h.Fatalf("dropping kolet binary: %v", err)
 		}
 	}
 
-	// run test
-	err = t.Run(tcluster)
-
 	// give some time for the remote journal to be flushed so it can be read
 	// before we run the deferred machine destruction
+	defer func() {
+		if h.Failed() {
+			time.Sleep(10 * time.Second)
+		}
+	}()
+
+	// run test
+	if err := t.Run(tcluster); err != nil {
+		h.Error(err)
+	}
+}
+
+// scpKolet searches for a kolet binary matching the architecture of each
+// machine and copies it to the machine.
+func scpKolet(t platform.TestCluster) error {
+	for _, m := range t.Machines() {
+		arch, err := machineArch(m)
+		if err != nil {
+			return err
+		}
+
+		kolet, err := findKolet(arch)
+		if err != nil {
+			return err
+		}
+
+		if err := installKolet(m, kolet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// machineArch returns the GOARCH of the remote machine m.
+func machineArch(m platform.Machine) (string, error) {
+	out, err := m.SSH("uname -m")
 	if err != nil {
-		time.Sleep(10 * time.Second)
+		return "", fmt.Errorf("determining architecture of %s: %v", m.ID(), err)
 	}
 
-	return err
+	switch uname := string(out); uname {
+	case "x86_64":
+		return "amd64", nil
+	case "aarch64":
+		return "arm64", nil
+	case "ppc64le":
+		return "ppc64le", nil
+	default:
+		return "", fmt.Errorf("machine %s has unsupported architecture %q", m.ID(), uname)
+	}
 }
 
-// scpKolet searches for a kolet binary and copies it to the machine.
-func scpKolet(t platform.TestCluster) error {
-	// TODO: determine the GOARCH for the remote machine
-	mArch := "amd64"
-	for _, d := range []string{
-		".",
-		filepath.Dir(os.Args[0]),
-		filepath.Join("/usr/lib/kola", mArch),
-	} {
+// findKolet looks for a kolet built for arch. A kolet next to kola or in
+// the working directory is only used if it was built for the same
+// architecture as kola itself, cross-compiled binaries are expected in a
+// subdirectory named after their architecture.
+func findKolet(arch string) (string, error) {
+	var dirs []string
+	if arch == runtime.GOARCH {
+		dirs = append(dirs, ".", filepath.Dir(os.Args[0]))
+	}
+	dirs = append(dirs,
+		filepath.Join(filepath.Dir(os.Args[0]), arch),
+		filepath.Join("/usr/lib/kola", arch))
+
+	for _, d := range dirs {
 		kolet := filepath.Join(d, "kolet")
 		if _, err := os.Stat(kolet); err == nil {
-			return t.DropFile(kolet)
+			return kolet, nil
 		}
 	}
-	return fmt.Errorf("Unable to locate kolet binary for %s", mArch)
+	return "", fmt.Errorf("Unable to locate kolet binary for %s, searched %s", arch, strings.Join(dirs, ", "))
 }
 
-// replaces $discovery with discover url in etcd cloud config and
-// replaces $name with a unique name
-func makeConfigs(url, cfg string, csize int) []string {
-	cfg = strings.Replace(cfg, "$discovery", url, -1)
-
-	var cfgs []string
-	for i := 0; i < csize; i++ {
-		cfgs = append(cfgs, strings.Replace(cfg, "$name", "instance"+strconv.Itoa(i), -1))
+func installKolet(m platform.Machine, kolet string) error {
+	in, err := os.Open(kolet)
+	if err != nil {
+		return err
 	}
-	return cfgs
+	defer in.Close()
+
+	return platform.InstallFile(in, m, "kolet")
 }
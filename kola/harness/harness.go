@@ -0,0 +1,212 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package harness provides the handle kola tests use to log, fail, skip
+// and run subtests, modeled after the standard testing package.
+package harness
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/pkg/capnslog"
+)
+
+var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/harness")
+
+// T records the progress and output of a single test or subtest. Output
+// is kept per T so tests running in parallel can be reported separately.
+type T struct {
+	name string
+
+	mu       sync.Mutex // protects everything below
+	output   []string
+	failed   bool
+	skipped  bool
+	duration time.Duration
+	subtests []*T
+}
+
+// Run runs f as the test name in a new goroutine and returns once f has
+// returned or called FailNow or SkipNow.
+func Run(name string, f func(t *T)) *T {
+	t := &T{name: name}
+	t.run(f)
+	return t
+}
+
+func (t *T) run(f func(t *T)) {
+	done := make(chan struct{})
+	start := time.Now()
+
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				buf := make([]byte, 16<<10)
+				buf = buf[:runtime.Stack(buf, false)]
+				t.Errorf("panic: %v\n%s", r, buf)
+			}
+		}()
+		f(t)
+	}()
+
+	<-done
+
+	t.mu.Lock()
+	t.duration = time.Since(start)
+	t.mu.Unlock()
+}
+
+// Run runs f as a subtest of t called name. It reports whether f
+// succeeded. A failed subtest marks t as failed as well.
+func (t *T) Run(name string, f func(t *T)) bool {
+	sub := &T{name: t.name + "/" + name}
+
+	t.mu.Lock()
+	t.subtests = append(t.subtests, sub)
+	t.mu.Unlock()
+
+	plog.Noticef("=== RUN %s", sub.name)
+	sub.run(f)
+
+	if sub.Failed() {
+		t.Fail()
+		return false
+	}
+	return true
+}
+
+// Name returns the full name of the test, including its parents.
+func (t *T) Name() string {
+	return t.name
+}
+
+func (t *T) log(s string) {
+	s = strings.TrimSuffix(s, "\n")
+	plog.Debugf("%s: %s", t.name, s)
+
+	t.mu.Lock()
+	t.output = append(t.output, strings.Split(s, "\n")...)
+	t.mu.Unlock()
+}
+
+// Log formats its arguments like fmt.Sprintln and records them in the
+// test's output.
+func (t *T) Log(args ...interface{}) {
+	t.log(fmt.Sprintln(args...))
+}
+
+// Logf formats its arguments like fmt.Sprintf and records them in the
+// test's output.
+func (t *T) Logf(format string, args ...interface{}) {
+	t.log(fmt.Sprintf(format, args...))
+}
+
+// Fail marks the test as failed but continues execution.
+func (t *T) Fail() {
+	t.mu.Lock()
+	t.failed = true
+	t.mu.Unlock()
+}
+
+// FailNow marks the test as failed and stops its execution. It must be
+// called from the goroutine running the test.
+func (t *T) FailNow() {
+	t.Fail()
+	runtime.Goexit()
+}
+
+// Error is equivalent to Log followed by Fail.
+func (t *T) Error(args ...interface{}) {
+	t.Log(args...)
+	t.Fail()
+}
+
+// Errorf is equivalent to Logf followed by Fail.
+func (t *T) Errorf(format string, args ...interface{}) {
+	t.Logf(format, args...)
+	t.Fail()
+}
+
+// Fatal is equivalent to Log followed by FailNow.
+func (t *T) Fatal(args ...interface{}) {
+	t.Log(args...)
+	t.FailNow()
+}
+
+// Fatalf is equivalent to Logf followed by FailNow.
+func (t *T) Fatalf(format string, args ...interface{}) {
+	t.Logf(format, args...)
+	t.FailNow()
+}
+
+// SkipNow marks the test as skipped and stops its execution. It must be
+// called from the goroutine running the test.
+func (t *T) SkipNow() {
+	t.mu.Lock()
+	t.skipped = true
+	t.mu.Unlock()
+	runtime.Goexit()
+}
+
+// Skip is equivalent to Log followed by SkipNow.
+func (t *T) Skip(args ...interface{}) {
+	t.Log(args...)
+	t.SkipNow()
+}
+
+// Skipf is equivalent to Logf followed by SkipNow.
+func (t *T) Skipf(format string, args ...interface{}) {
+	t.Logf(format, args...)
+	t.SkipNow()
+}
+
+// Failed reports whether the test has failed.
+func (t *T) Failed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failed
+}
+
+// Skipped reports whether the test was skipped.
+func (t *T) Skipped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.skipped
+}
+
+// Duration returns how long the test ran for.
+func (t *T) Duration() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.duration
+}
+
+// Output returns the lines logged by the test, not including subtests.
+func (t *T) Output() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.output...)
+}
+
+// Subtests returns the subtests started by t in the order they ran.
+func (t *T) Subtests() []*T {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*T(nil), t.subtests...)
+}
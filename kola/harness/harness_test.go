@@ -0,0 +1,92 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSubtests(t *testing.T) {
+	var reached []string
+
+	h := Run("top", func(h *T) {
+		h.Logf("starting")
+
+		h.Run("pass", func(h *T) {
+			h.Log("fine")
+		})
+		h.Run("error", func(h *T) {
+			h.Errorf("first")
+			h.Errorf("second")
+			reached = append(reached, "error")
+		})
+		h.Run("fatal", func(h *T) {
+			h.Fatalf("stop")
+			reached = append(reached, "fatal")
+		})
+		h.Run("skip", func(h *T) {
+			h.Skip("not today")
+			reached = append(reached, "skip")
+		})
+		h.Run("panic", func(h *T) {
+			panic("oops")
+		})
+
+		reached = append(reached, "top")
+	})
+
+	if !h.Failed() {
+		t.Errorf("top level test did not fail")
+	}
+	if !reflect.DeepEqual(reached, []string{"error", "top"}) {
+		t.Errorf("unexpected code reached: %v", reached)
+	}
+	if out := h.Output(); !reflect.DeepEqual(out, []string{"starting"}) {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	subs := h.Subtests()
+	want := []struct {
+		name    string
+		failed  bool
+		skipped bool
+		output  string
+	}{
+		{"top/pass", false, false, "fine"},
+		{"top/error", true, false, "first\nsecond"},
+		{"top/fatal", true, false, "stop"},
+		{"top/skip", false, true, "not today"},
+		{"top/panic", true, false, "panic: oops"},
+	}
+	if len(subs) != len(want) {
+		t.Fatalf("got %d subtests, want %d", len(subs), len(want))
+	}
+
+	for i, w := range want {
+		s := subs[i]
+		if s.Name() != w.name {
+			t.Errorf("subtest %d: got name %q, want %q", i, s.Name(), w.name)
+		}
+		if s.Failed() != w.failed || s.Skipped() != w.skipped {
+			t.Errorf("%s: got failed=%v skipped=%v, want failed=%v skipped=%v",
+				w.name, s.Failed(), s.Skipped(), w.failed, w.skipped)
+		}
+		if out := strings.Join(s.Output(), "\n"); !strings.HasPrefix(out, w.output) {
+			t.Errorf("%s: got output %q, want %q", w.name, out, w.output)
+		}
+	}
+}
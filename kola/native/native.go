@@ -0,0 +1,86 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package native
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// SkipError is returned by native functions that decide not to run.
+type SkipError struct {
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return "skipped: " + e.Reason
+}
+
+// Skipf returns a SkipError, reporting the calling native function as
+// skipped rather than failed.
+func Skipf(format string, a ...interface{}) error {
+	return &SkipError{fmt.Sprintf(format, a...)}
+}
+
+// call holds the state of the native function currently being run by the
+// agent. Functions are run one at a time.
+type call struct {
+	args  []string
+	files []File
+}
+
+var (
+	mu      sync.Mutex
+	current *call
+)
+
+func setCall(c *call) {
+	mu.Lock()
+	current = c
+	mu.Unlock()
+}
+
+// Args returns the arguments kola passed to the running native function.
+func Args() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return nil
+	}
+	return current.args
+}
+
+// Attach adds a file to the result of the running native function.
+func Attach(name string, data []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return
+	}
+	current.files = append(current.files, File{Name: name, Data: data})
+}
+
+// AttachFile reads the file at path and attaches it to the result of the
+// running native function.
+func AttachFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	Attach(filepath.Base(path), data)
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package native implements the protocol spoken between kola and kolet.
+//
+// kolet runs as a long-lived agent on a machine, reading Requests from its
+// stdin and writing Events to its stdout, both encoded as a stream of JSON
+// objects. Each Request invokes a single native function; the agent
+// answers with any number of log Events followed by exactly one Event
+// carrying the Result.
+package native
+
+import (
+	"fmt"
+	"time"
+)
+
+// Status is the outcome of a native function.
+type Status string
+
+const (
+	Pass Status = "pass"
+	Fail Status = "fail"
+	Skip Status = "skip"
+)
+
+// Request asks the agent to run the native function Func of test Test.
+type Request struct {
+	ID   int      `json:"id"`
+	Test string   `json:"test"`
+	Func string   `json:"func"`
+	Args []string `json:"args,omitempty"`
+}
+
+// Event is sent by the agent in response to a Request. Exactly one of Log
+// or Result is set.
+type Event struct {
+	ID     int     `json:"id"`
+	Log    string  `json:"log,omitempty"`
+	Result *Result `json:"result,omitempty"`
+}
+
+// File is a file attached to a Result by the native function.
+type File struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// Result describes the outcome of a single native function call.
+type Result struct {
+	Status Status `json:"status"`
+	// Message is the error returned by a failed function or the reason
+	// given by a skipped one.
+	Message  string        `json:"message,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Files    []File        `json:"files,omitempty"`
+
+	// Output is the log output of the function, collected by the
+	// client from the log Events of the call.
+	Output string `json:"-"`
+}
+
+// Err converts a failed Result to an error. Passed and skipped results
+// return nil.
+func (r *Result) Err() error {
+	if r.Status != Fail {
+		return nil
+	}
+	if r.Output != "" {
+		return fmt.Errorf("%s\n%s", r.Message, r.Output)
+	}
+	return fmt.Errorf("%s", r.Message)
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package native
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncMarker is written to the log stream after each call so the server
+// knows all output of the call has been forwarded before it sends the
+// result.
+const syncMarker = "\x00kolet-sync "
+
+// LookupFunc finds the native function fn of test.
+type LookupFunc func(test, fn string) (func() error, error)
+
+// Server runs native functions on behalf of kola.
+type Server struct {
+	lookup LookupFunc
+	logw   io.Writer
+	synced chan int
+
+	mu  sync.Mutex // protects enc and id
+	enc *json.Encoder
+	id  int
+}
+
+// NewServer creates a Server writing Events to out. Anything written to
+// logw, which must be the write end of the pipe logr reads from, is sent
+// to kola as log output of the call in progress. The agent normally
+// points its own stdout and stderr at logw.
+func NewServer(out io.Writer, logr io.Reader, logw io.Writer, lookup LookupFunc) *Server {
+	s := &Server{
+		lookup: lookup,
+		logw:   logw,
+		synced: make(chan int),
+		enc:    json.NewEncoder(out),
+	}
+	go s.forwardLogs(logr)
+	return s
+}
+
+// Serve reads Requests from in and runs them one at a time until in
+// reaches EOF.
+func (s *Server) Serve(in io.Reader) error {
+	dec := json.NewDecoder(in)
+	for {
+		var req Request
+		if err := dec.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.send(&Event{ID: req.ID, Result: s.call(&req)}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) call(req *Request) *Result {
+	s.mu.Lock()
+	s.id = req.ID
+	s.mu.Unlock()
+
+	c := &call{args: req.Args}
+	setCall(c)
+	start := time.Now()
+	err := s.run(req)
+	duration := time.Since(start)
+	setCall(nil)
+
+	// wait for the function's output to drain before reporting
+	fmt.Fprintf(s.logw, "%s%d\n", syncMarker, req.ID)
+	for id := range s.synced {
+		if id == req.ID {
+			break
+		}
+	}
+
+	res := &Result{
+		Status:   Pass,
+		Duration: duration,
+		Files:    c.files,
+	}
+	switch e := err.(type) {
+	case nil:
+	case *SkipError:
+		res.Status = Skip
+		res.Message = e.Reason
+	default:
+		res.Status = Fail
+		res.Message = err.Error()
+	}
+
+	return res
+}
+
+func (s *Server) run(req *Request) (err error) {
+	f, err := s.lookup(req.Test, req.Func)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	return f()
+}
+
+func (s *Server) send(ev *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(ev)
+}
+
+func (s *Server) log(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.Encode(&Event{ID: s.id, Log: line})
+}
+
+func (s *Server) forwardLogs(logr io.Reader) {
+	defer close(s.synced)
+
+	r := bufio.NewReader(logr)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(line, "\n")
+			// output lacking a final newline ends up in front
+			// of the marker.
+			marker := strings.Index(line, syncMarker)
+			if marker != 0 {
+				if marker > 0 {
+					s.log(line[:marker])
+				} else {
+					s.log(line)
+				}
+			}
+			if marker >= 0 {
+				if id, err := strconv.Atoi(line[marker+len(syncMarker):]); err == nil {
+					s.synced <- id
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	logr, logw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logr.Close()
+	defer logw.Close()
+
+	funcs := map[string]func() error{
+		"pass": func() error {
+			fmt.Fprintf(logw, "hello %v\n", Args())
+			fmt.Fprintf(logw, "no newline")
+			Attach("a.txt", []byte("data"))
+			return nil
+		},
+		"fail": func() error { return fmt.Errorf("boom") },
+		"skip": func() error { return Skipf("not %s", "today") },
+		"panic": func() error {
+			panic("oops")
+		},
+	}
+	lookup := func(test, fn string) (func() error, error) {
+		f, ok := funcs[fn]
+		if !ok {
+			return nil, fmt.Errorf("native function %q not found", fn)
+		}
+		return f, nil
+	}
+
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	s := NewServer(outw, logr, logw, lookup)
+	go func() {
+		s.Serve(inr)
+		outw.Close()
+	}()
+
+	enc := json.NewEncoder(inw)
+	dec := json.NewDecoder(outr)
+
+	tests := []struct {
+		fn     string
+		args   []string
+		status Status
+		msg    string
+		logs   []string
+		files  []File
+	}{
+		{"pass", []string{"x"}, Pass, "", []string{"hello [x]", "no newline"}, []File{{"a.txt", []byte("data")}}},
+		{"fail", nil, Fail, "boom", nil, nil},
+		{"skip", nil, Skip, "not today", nil, nil},
+		{"missing", nil, Fail, `native function "missing" not found`, nil, nil},
+		{"panic", nil, Fail, "", nil, nil},
+	}
+
+	for i, tt := range tests {
+		if err := enc.Encode(&Request{ID: i + 1, Func: tt.fn, Args: tt.args}); err != nil {
+			t.Fatal(err)
+		}
+
+		var logs []string
+		var res *Result
+		for res == nil {
+			var ev Event
+			if err := dec.Decode(&ev); err != nil {
+				t.Fatalf("%s: %v", tt.fn, err)
+			}
+			if ev.ID != i+1 {
+				t.Fatalf("%s: got event for call %d", tt.fn, ev.ID)
+			}
+			if ev.Result != nil {
+				res = ev.Result
+			} else {
+				logs = append(logs, ev.Log)
+			}
+		}
+
+		if res.Status != tt.status {
+			t.Errorf("%s: got status %q, want %q", tt.fn, res.Status, tt.status)
+		}
+		if tt.msg != "" && res.Message != tt.msg {
+			t.Errorf("%s: got message %q, want %q", tt.fn, res.Message, tt.msg)
+		}
+		if !reflect.DeepEqual(logs, tt.logs) {
+			t.Errorf("%s: got logs %q, want %q", tt.fn, logs, tt.logs)
+		}
+		if !reflect.DeepEqual(res.Files, tt.files) {
+			t.Errorf("%s: got files %v, want %v", tt.fn, res.Files, tt.files)
+		}
+	}
+
+	inw.Close()
+}
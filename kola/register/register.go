@@ -20,11 +20,28 @@ type Test struct {
 	Name        string // should be uppercase and unique
 	Run         func(platform.TestCluster) error
 	NativeFuncs map[string]func() error
-	UserData    string
+	UserData    string // rendered as a template, see platform.UserdataVars
 	ClusterSize int
 	Platforms   []string // whitelist of platforms to run test against -- defaults to all
+
+	// QEMUMachine is the hardware the test needs on QEMU, in addition
+	// to the defaults given on the command line.
+	QEMUMachine platform.QEMUMachineOptions
+
+	// Topology is the network topology of the test on QEMU.
+	Topology platform.Topology
+
+	// Capabilities tag the test as able to run on platforms that
+	// only provide part of a machine, see CapContainer. Such
+	// platforms skip tests without the capabilities they need.
+	Capabilities []string
 }
 
+// CapContainer tags tests that only exercise userspace, and so can run
+// in a container on the nspawn platform: no kernel, boot, disk or
+// hardware checks.
+const CapContainer = "container"
+
 // maps names to tests
 var Tests = map[string]*Test{}
 
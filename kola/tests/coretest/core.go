@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/coreos/mantle/kola/native"
 	"github.com/coreos/mantle/kola/register"
 
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/satori/go.uuid"
@@ -23,23 +24,42 @@ const (
 	UpdateEnginePubKeyV2 = "a76a22e6afcdfbc55dd2953aa950c7ec93b254774fca02d13ec52c59672e5982"
 )
 
+// userspaceFuncs are the checks of coreos.basic which also run in
+// containers, having no kernel, boot or disks of their own.
+var userspaceFuncs = map[string]func() error{
+	"CloudConfig":      TestCloudinitCloudConfig,
+	"Script":           TestCloudinitScript,
+	"PortSSH":          TestPortSsh,
+	"DbusPerms":        TestDbusPerms,
+	"Symlink":          TestSymlinkResolvConf,
+	"UpdateEngineKeys": TestInstalledUpdateEngineRsaKeys,
+	"Useradd":          TestUseradd,
+}
+
 func init() {
+	basicFuncs := map[string]func() error{
+		"ServicesActive": TestServicesActive,
+		"ReadOnly":       TestReadOnlyFs,
+		"RandomUUID":     TestFsRandomUUID,
+	}
+	for name, fn := range userspaceFuncs {
+		basicFuncs[name] = fn
+	}
+
 	register.Register(&register.Test{
 		Name:        "coreos.basic",
 		Run:         LocalTests,
 		ClusterSize: 1,
-		NativeFuncs: map[string]func() error{
-			"CloudConfig":      TestCloudinitCloudConfig,
-			"Script":           TestCloudinitScript,
-			"PortSSH":          TestPortSsh,
-			"DbusPerms":        TestDbusPerms,
-			"Symlink":          TestSymlinkResolvConf,
-			"UpdateEngineKeys": TestInstalledUpdateEngineRsaKeys,
-			"ServicesActive":   TestServicesActive,
-			"ReadOnly":         TestReadOnlyFs,
-			"RandomUUID":       TestFsRandomUUID,
-			"Useradd":          TestUseradd,
-		},
+		NativeFuncs: basicFuncs,
+	})
+	register.Register(&register.Test{
+		Name:         "coreos.basic.container",
+		Run:          LocalTests,
+		ClusterSize:  1,
+		Platforms:    []string{"nspawn"},
+		Capabilities: []string{register.CapContainer},
+		NativeFuncs:  userspaceFuncs,
+		UserData:     `#cloud-config`,
 	})
 	register.Register(&register.Test{
 		Name:        "coreos.cluster",
@@ -53,12 +73,12 @@ func init() {
 
 coreos:
   etcd2:
-    name: $name
-    discovery: $discovery
-    advertise-client-urls: http://$private_ipv4:2379
-    initial-advertise-peer-urls: http://$private_ipv4:2380
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
     listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
-    listen-peer-urls: http://$private_ipv4:2380,http://$private_ipv4:7001
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001
   fleet:
     etcd-request-timeout: 15 
   units:
@@ -81,6 +101,17 @@ coreos:
 			"NTPDate":      TestNTPDate,
 		},
 	})
+	// docker tests, pulling busybox from the cluster's registry.
+	register.Register(&register.Test{
+		Name:        "coreos.docker",
+		Run:         DockerTests,
+		ClusterSize: 1,
+		Platforms:   []string{"qemu"},
+		NativeFuncs: map[string]func() error{
+			"DockerPing": TestDockerPing,
+			"DockerEcho": TestDockerEcho,
+		},
+	})
 }
 
 func TestPortSsh() error {
@@ -115,11 +146,22 @@ func TestUpdateEngine() error {
 	// FIXME(marineam): Test DBus directly
 }
 
+// dockerArgs returns the image and the host to ping passed by
+// DockerTests, busybox and coreos.com from the internet by default.
+func dockerArgs() (image, host string) {
+	image, host = "busybox", "coreos.com"
+	if args := native.Args(); len(args) == 2 {
+		image, host = args[0], args[1]
+	}
+	return
+}
+
 func TestDockerEcho() error {
 	//t.Parallel()
+	image, _ := dockerArgs()
 	errc := make(chan error, 1)
 	go func() {
-		c := exec.Command("docker", "run", "busybox", "echo")
+		c := exec.Command("docker", "run", image, "echo")
 		err := c.Run()
 		errc <- err
 	}()
@@ -136,9 +178,10 @@ func TestDockerEcho() error {
 
 func TestDockerPing() error {
 	//t.Parallel()
+	image, host := dockerArgs()
 	errc := make(chan error, 1)
 	go func() {
-		c := exec.Command("docker", "run", "busybox", "ping", "-c4", "coreos.com")
+		c := exec.Command("docker", "run", image, "ping", "-c4", host)
 		err := c.Run()
 		errc <- err
 	}()
@@ -2,6 +2,8 @@ package coretest
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/pkg/capnslog"
@@ -12,16 +14,21 @@ import (
 
 var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/tests/coretest")
 
+// runNativeFuncs runs each native function of the test on the first
+// machine as a subtest, passing it args.
+func runNativeFuncs(c platform.TestCluster, args ...string) {
+	m := c.Machines()[0]
+	for _, name := range c.ListNativeFunctions() {
+		name := name
+		c.Run(name, func(c platform.TestCluster) error {
+			return c.RunNative(name, m, args...)
+		})
+	}
+}
+
 // run various native functions that only require a single machine
 func LocalTests(c platform.TestCluster) error {
-	tests := c.ListNativeFunctions()
-	for _, name := range tests {
-		plog.Noticef("running %v...", name)
-		err := c.RunNative(name, c.Machines()[0])
-		if err != nil {
-			return err
-		}
-	}
+	runNativeFuncs(c)
 	return nil
 }
 
@@ -60,27 +67,29 @@ func ClusterTests(c platform.TestCluster) error {
 		}
 	}
 
-	tests := c.ListNativeFunctions()
-	for _, name := range tests {
-		plog.Noticef("running %v...", name)
-		err := c.RunNative(name, c.Machines()[0])
-		if err != nil {
-			return err
-		}
-	}
+	runNativeFuncs(c)
 	return nil
+}
+
+// run the docker tests with busybox from the cluster's registry,
+// pinging the registry's host.
+func DockerTests(c platform.TestCluster) error {
+	m := c.Machines()[0]
+	image, err := c.RegistryImage(m, "docker", "busybox")
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(image[:strings.Index(image, "/")])
+	if err != nil {
+		return err
+	}
 
+	runNativeFuncs(c, image, host)
+	return nil
 }
 
 // run internet based tests
 func InternetTests(c platform.TestCluster) error {
-	tests := c.ListNativeFunctions()
-	for _, name := range tests {
-		plog.Noticef("running %v...", name)
-		err := c.RunNative(name, c.Machines()[0])
-		if err != nil {
-			return err
-		}
-	}
+	runNativeFuncs(c)
 	return nil
 }
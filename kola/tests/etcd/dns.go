@@ -0,0 +1,50 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"fmt"
+
+	"github.com/coreos/mantle/platform"
+)
+
+// DNSDiscovery checks that machines resolve each other's names, then
+// bootstraps etcd2 from SRV records.
+func DNSDiscovery(c platform.TestCluster) error {
+	dc, ok := c.Cluster.(platform.DNSCluster)
+	if !ok {
+		c.Skip("cluster does not serve DNS")
+	}
+
+	ms := c.Machines()
+	for _, m := range ms {
+		for i := range ms {
+			name := fmt.Sprintf("instance%d.br0.local", i)
+			if _, err := m.SSH("getent hosts " + name); err != nil {
+				return fmt.Errorf("%s cannot resolve %s: %v", m.ID(), name, err)
+			}
+		}
+	}
+
+	domain, err := dc.AddEtcdSRVRecords(ms)
+	if err != nil {
+		return err
+	}
+	if domain != "br0.local" {
+		return fmt.Errorf("unexpected etcd domain %q", domain)
+	}
+
+	return discovery(c, 2)
+}
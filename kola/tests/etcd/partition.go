@@ -0,0 +1,82 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/util"
+)
+
+// Partition isolates one member of a 3 member etcd2 cluster, checks that
+// the majority keeps accepting writes while the isolated member cannot
+// serve quorum reads, and that all members converge once healed.
+func Partition(c platform.TestCluster) error {
+	fi, ok := c.Cluster.(platform.FaultInjector)
+	if !ok {
+		c.Skip("cluster does not support network faults")
+	}
+
+	if err := discovery(c, 2); err != nil {
+		return err
+	}
+
+	ms := c.Machines()
+	if err := fi.Partition(ms[:1], ms[1:]); err != nil {
+		return fmt.Errorf("partitioning: %v", err)
+	}
+	defer fi.Heal()
+
+	majority := &subCluster{c.Cluster, ms[1:]}
+	var keyMap map[string]string
+	setKeys := func() error {
+		var err error
+		keyMap, err = SetKeys(majority, 5)
+		return err
+	}
+	if err := util.Retry(5, 5*time.Second, setKeys); err != nil {
+		return fmt.Errorf("majority failed to accept writes: %v", err)
+	}
+
+	minority := &subCluster{c.Cluster, ms[:1]}
+	if err := CheckKeys(minority, keyMap, true); err == nil {
+		return fmt.Errorf("isolated member served a quorum read")
+	}
+
+	if err := fi.Heal(); err != nil {
+		return fmt.Errorf("healing: %v", err)
+	}
+
+	checkKeys := func() error {
+		return CheckKeys(c, keyMap, true)
+	}
+	if err := util.Retry(10, 5*time.Second, checkKeys); err != nil {
+		return fmt.Errorf("cluster did not converge after healing: %v", err)
+	}
+
+	return nil
+}
+
+// subCluster is a Cluster limited to some of its machines.
+type subCluster struct {
+	platform.Cluster
+	machines []platform.Machine
+}
+
+func (s *subCluster) Machines() []platform.Machine {
+	return s.machines
+}
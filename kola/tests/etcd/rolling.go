@@ -47,7 +47,7 @@ func RollingUpgrade(cluster platform.TestCluster) error {
 	}
 
 	// drop in starting etcd binary
-	plog.Debug("adding files to cluster")
+	cluster.Log("adding files to cluster")
 	if err := cluster.DropFile(firstBin); err != nil {
 		return err
 	}
@@ -58,7 +58,7 @@ func RollingUpgrade(cluster platform.TestCluster) error {
 	}
 
 	// replace existing etcd2 binary with 2.0.12
-	plog.Info("replacing etcd with 2.0.12")
+	cluster.Log("replacing etcd with 2.0.12")
 	firstPath := filepath.Join(dropPath, filepath.Base(firstBin))
 	for _, m := range cluster.Machines() {
 		if err := replaceEtcd2Bin(m, firstPath); err != nil {
@@ -67,23 +67,23 @@ func RollingUpgrade(cluster platform.TestCluster) error {
 	}
 
 	// start 2.0 cluster
-	plog.Info("starting 2.0 cluster")
-	for _, m := range cluster.Machines() {
-		if err := startEtcd2(m); err != nil {
-			return err
-		}
-	}
-	for _, m := range cluster.Machines() {
-		if err := getClusterHealth(m, csize); err != nil {
-			return err
+	if !cluster.Run("start", func(c platform.TestCluster) error {
+		for _, m := range c.Machines() {
+			if err := startEtcd2(m); err != nil {
+				return err
+			}
 		}
-	}
-	if firstVersion != "" {
-		for _, m := range cluster.Machines() {
-			if err := checkEtcdVersion(cluster, m, firstVersion); err != nil {
+		for _, m := range c.Machines() {
+			if err := getClusterHealth(m, csize); err != nil {
 				return err
 			}
 		}
+		if firstVersion != "" {
+			checkEtcdVersions(c, firstVersion)
+		}
+		return nil
+	}) {
+		return fmt.Errorf("starting 2.0 cluster failed")
 	}
 
 	// set some values on all nodes
@@ -94,42 +94,47 @@ func RollingUpgrade(cluster platform.TestCluster) error {
 
 	// rolling replacement checking cluster health, and
 	// version after each replaced binary. Also test
-	plog.Info("rolling upgrade to 2.1")
+	cluster.Log("rolling upgrade to 2.1")
 	secondPath := filepath.Join(dropPath, filepath.Base(secondBin))
 	for i, m := range cluster.Machines() {
+		m := m
+		if !cluster.Run(fmt.Sprintf("upgrade-instance%d", i), func(c platform.TestCluster) error {
+			// check current value set
+			if err := CheckKeys(c, mapSet, true); err != nil {
+				return err
+			}
 
-		// check current value set
-		if err := CheckKeys(cluster, mapSet, true); err != nil {
-			return err
-		}
-
-		plog.Infof("stopping instance %v", i)
-		if err := stopEtcd2(m); err != nil {
-			return err
-		}
-		if err := replaceEtcd2Bin(m, secondPath); err != nil {
-			return err
-		}
-
-		// set some values while running down a node and update set
-		tempSet, err := SetKeys(cluster, settingSize)
-		if err != nil {
-			return err
-		}
-		mapCopy(mapSet, tempSet)
+			c.Logf("stopping instance %v", i)
+			if err := stopEtcd2(m); err != nil {
+				return err
+			}
+			if err := replaceEtcd2Bin(m, secondPath); err != nil {
+				return err
+			}
 
-		plog.Infof("starting instance %v with upgraded binary", i)
-		if err := startEtcd2(m); err != nil {
-			return err
-		}
+			// set some values while running down a node and update set
+			tempSet, err := SetKeys(c, settingSize)
+			if err != nil {
+				return err
+			}
+			mapCopy(mapSet, tempSet)
 
-		for _, m := range cluster.Machines() {
-			if err := getClusterHealth(m, csize); err != nil {
+			c.Logf("starting instance %v with upgraded binary", i)
+			if err := startEtcd2(m); err != nil {
 				return err
 			}
-		}
 
+			for _, m := range c.Machines() {
+				if err := getClusterHealth(m, csize); err != nil {
+					return err
+				}
+			}
+			return nil
+		}) {
+			return fmt.Errorf("rolling upgrade failed at instance %d", i)
+		}
 	}
+
 	// set some more values
 	tempSet, err := SetKeys(cluster, settingSize)
 	if err != nil {
@@ -138,22 +143,31 @@ func RollingUpgrade(cluster platform.TestCluster) error {
 	mapCopy(mapSet, tempSet)
 
 	// final check all values written correctly
-	if err := CheckKeys(cluster, mapSet, true); err != nil {
-		return err
-	}
+	cluster.Run("check-keys", func(c platform.TestCluster) error {
+		return CheckKeys(c, mapSet, true)
+	})
 
 	// check version is now 2.1
 	if secondVersion != "" {
-		for _, m := range cluster.Machines() {
-			if err := checkEtcdVersion(cluster, m, secondVersion); err != nil {
-				return err
-			}
-		}
+		cluster.Run("check-version", func(c platform.TestCluster) error {
+			checkEtcdVersions(c, secondVersion)
+			return nil
+		})
 	}
 
 	return nil
 }
 
+// checkEtcdVersions checks the etcd version of every machine, failing the
+// test for each one not running the expected version.
+func checkEtcdVersions(c platform.TestCluster, expected string) {
+	for i, m := range c.Machines() {
+		if err := checkEtcdVersion(c, m, expected); err != nil {
+			c.Errorf("instance %d: %v", i, err)
+		}
+	}
+}
+
 // copies m2 into m1 overwriting any overlapping keys
 func mapCopy(m1, m2 map[string]string) {
 	for k, v := range m2 {
@@ -38,10 +38,10 @@ func init() {
 		UserData: `#cloud-config
 coreos:
   etcd:
-    name: $name
-    discovery: $discovery
-    addr: $private_ipv4:2379
-    peer-addr: $private_ipv4:2380`,
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    addr: {{.PrivateIPv4}}:2379
+    peer-addr: {{.PrivateIPv4}}:2380`,
 	})
 
 	// test etcd discovery with 2.0 with new cloud config
@@ -49,19 +49,67 @@ coreos:
 		Run:         DiscoveryV2,
 		ClusterSize: 3,
 		Name:        "coreos.etcd2.discovery",
+		UserData:    etcd2Config,
+	})
+
+	// test etcd 2.0 DNS discovery with SRV records
+	register.Register(&register.Test{
+		Run:         DNSDiscovery,
+		ClusterSize: 3,
+		Name:        "coreos.etcd2.dns-discovery",
+		Platforms:   []string{"qemu"},
 		UserData: `#cloud-config
 
 coreos:
   etcd2:
-    name: $name
-    discovery: $discovery
-    advertise-client-urls: http://$private_ipv4:2379
-    initial-advertise-peer-urls: http://$private_ipv4:2380
+    name: {{.Name}}
+    discovery-srv: br0.local
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
     listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
-    listen-peer-urls: http://$private_ipv4:2380,http://$private_ipv4:7001`,
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001`,
+	})
+
+	// test etcd 2.0 DNS discovery with IPv6 only machines
+	register.Register(&register.Test{
+		Run:         DNSDiscovery,
+		ClusterSize: 3,
+		Name:        "coreos.etcd2.ipv6",
+		Platforms:   []string{"qemu"},
+		QEMUMachine: platform.QEMUMachineOptions{IPv6Only: true},
+		UserData: `#cloud-config
+
+coreos:
+  etcd2:
+    name: {{.Name}}
+    discovery-srv: br0.local
+    advertise-client-urls: http://[{{.PrivateIPv6}}]:2379
+    initial-advertise-peer-urls: http://[{{.PrivateIPv6}}]:2380
+    listen-client-urls: http://[::]:2379,http://[::]:4001
+    listen-peer-urls: http://[{{.PrivateIPv6}}]:2380,http://[{{.PrivateIPv6}}]:7001`,
+	})
+
+	// test that etcd 2.0 survives a network partition
+	register.Register(&register.Test{
+		Run:         Partition,
+		ClusterSize: 3,
+		Name:        "coreos.etcd2.partition",
+		Platforms:   []string{"qemu"},
+		UserData:    etcd2Config,
 	})
 }
 
+const etcd2Config = `#cloud-config
+
+coreos:
+  etcd2:
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
+    listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001`
+
 // run etcd on each cluster machine
 func startEtcd2(m platform.Machine) error {
 	etcdStart := "sudo systemctl start etcd2.service"
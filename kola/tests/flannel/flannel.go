@@ -19,10 +19,8 @@
 package flannel
 
 import (
-	"bytes"
 	"fmt"
 	"net"
-	"text/template"
 	"time"
 
 	"github.com/coreos/mantle/kola/register"
@@ -33,16 +31,19 @@ import (
 )
 
 var (
-	plog        = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/tests/flannel")
-	flannelConf = template.Must(template.New("flannel-userdata").Parse(`#cloud-config
+	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/tests/flannel")
+
+	// flannelConf is formatted with the flannel backend type, the
+	// result is the userdata template.
+	flannelConf = `#cloud-config
 coreos:
   etcd2:
-    name: $name
-    discovery: $discovery
-    advertise-client-urls: http://$private_ipv4:2379
-    initial-advertise-peer-urls: http://$private_ipv4:2380
+    name: {{.Name}}
+    discovery: {{.Discovery}}
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
     listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
-    listen-peer-urls: http://$private_ipv4:2380,http://$private_ipv4:7001
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001
   units:
     - name: etcd2.service
       command: start
@@ -51,38 +52,28 @@ coreos:
         - name: 50-network-config.conf
           content: |
             [Service]
-            ExecStartPre=/usr/bin/etcdctl set /coreos.com/network/config '{ "Network":"10.254.0.0/16", "Backend":{"Type": "{{.}}"} }'
+            ExecStartPre=/usr/bin/etcdctl set /coreos.com/network/config '{ "Network":"10.254.0.0/16", "Backend":{"Type": "%s"} }'
       command: start
     - name: docker.service
       command: start
-`))
+`
 )
 
 func init() {
-	udpConf := new(bytes.Buffer)
-	if err := flannelConf.Execute(udpConf, "udp"); err != nil {
-		panic(err)
-	}
-
 	register.Register(&register.Test{
 		Run:         udp,
 		ClusterSize: 3,
 		Name:        "coreos.flannel.udp",
 		Platforms:   []string{"aws", "gce"},
-		UserData:    udpConf.String(),
+		UserData:    fmt.Sprintf(flannelConf, "udp"),
 	})
 
-	vxlanConf := new(bytes.Buffer)
-	if err := flannelConf.Execute(vxlanConf, "vxlan"); err != nil {
-		panic(err)
-	}
-
 	register.Register(&register.Test{
 		Run:         vxlan,
 		ClusterSize: 3,
 		Name:        "coreos.flannel.vxlan",
 		Platforms:   []string{"aws", "gce"},
-		UserData:    vxlanConf.String(),
+		UserData:    fmt.Sprintf(flannelConf, "vxlan"),
 	})
 }
 
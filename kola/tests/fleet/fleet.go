@@ -34,10 +34,10 @@ var (
 	masterconf = config.CloudConfig{
 		CoreOS: config.CoreOS{
 			Etcd2: config.Etcd2{
-				AdvertiseClientURLs:      "http://$private_ipv4:2379",
-				InitialAdvertisePeerURLs: "http://$private_ipv4:2380",
+				AdvertiseClientURLs:      "http://{{.PrivateIPv4}}:2379",
+				InitialAdvertisePeerURLs: "http://{{.PrivateIPv4}}:2380",
 				ListenClientURLs:         "http://0.0.0.0:2379,http://0.0.0.0:4001",
-				ListenPeerURLs:           "http://$private_ipv4:2380,http://$private_ipv4:7001",
+				ListenPeerURLs:           "http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001",
 			},
 			Fleet: config.Fleet{
 				EtcdRequestTimeout: 15,
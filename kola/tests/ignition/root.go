@@ -27,7 +27,7 @@ func init() {
 		Name:        "coreos.ignition.btrfsroot",
 		Run:         btrfsRoot,
 		ClusterSize: 1,
-		Platforms:   []string{"aws"},
+		Platforms:   []string{"aws", "qemu"},
 		UserData: `{
 		               "ignitionVersion": 1,
 		               "storage": {
@@ -52,7 +52,7 @@ func init() {
 		Name:        "coreos.ignition.xfsroot",
 		Run:         xfsRoot,
 		ClusterSize: 1,
-		Platforms:   []string{"aws"},
+		Platforms:   []string{"aws", "qemu"},
 		UserData: `{
 		               "ignitionVersion": 1,
 		               "storage": {
@@ -30,29 +30,15 @@ var (
 
 func init() {
 	// Set the hostname
+	conf := platform.NewIgnitionConf()
+	conf.SetHostname("core1")
+
 	register.Register(&register.Test{
 		Name:        "coreos.ignition.sethostname",
 		Run:         setHostname,
 		ClusterSize: 1,
-		Platforms:   []string{"aws"},
-		UserData: `{
-		               "ignitionVersion": 1,
-		               "storage": {
-		                   "filesystems": [
-		                       {
-		                           "device": "/dev/disk/by-partlabel/ROOT",
-		                           "format": "ext4",
-		                           "files": [
-		                               {
-		                                   "path": "/etc/hostname",
-		                                   "mode": 420,
-		                                   "contents": "core1"
-		                               }
-		                           ]
-		                       }
-		                   ]
-		               }
-		           }`,
+		Platforms:   []string{"aws", "qemu"},
+		UserData:    conf.String(),
 	})
 }
 
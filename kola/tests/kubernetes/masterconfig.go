@@ -25,11 +25,11 @@ coreos:
   etcd2:
     name: master
     listen-client-urls: http://0.0.0.0:2379,http://0.0.0.0:4001
-    advertise-client-urls: http://$private_ipv4:2379,http://$private_ipv4:4001
+    advertise-client-urls: http://{{.PrivateIPv4}}:2379,http://{{.PrivateIPv4}}:4001
     initial-cluster-token: k8s_etcd
-    listen-peer-urls: http://$private_ipv4:2380,http://$private_ipv4:7001
-    initial-advertise-peer-urls: http://$private_ipv4:2380
-    initial-cluster: master=http://$private_ipv4:2380
+    listen-peer-urls: http://{{.PrivateIPv4}}:2380,http://{{.PrivateIPv4}}:7001
+    initial-advertise-peer-urls: http://{{.PrivateIPv4}}:2380
+    initial-cluster: master=http://{{.PrivateIPv4}}:2380
     initial-cluster-state: new
   fleet:
     metadata: "role=master"
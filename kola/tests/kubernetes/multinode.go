@@ -74,26 +74,25 @@ func MultiNodeSmoke(c platform.TestCluster) error {
 	}
 
 	// check that all nodes appear in kubectl
-	f := func() error {
-		if err = nodeCheck(master, nodes); err != nil {
-			return err
+	if !c.Run("nodes", func(c platform.TestCluster) error {
+		f := func() error {
+			return nodeCheck(master, nodes)
 		}
-		return nil
-	}
-	if err := util.Retry(10, 5*time.Second, f); err != nil {
-		return err
+		return util.Retry(10, 5*time.Second, f)
+	}) {
+		return fmt.Errorf("nodes did not join the cluster")
 	}
 
 	// start nginx pod and curl endpoint
-	if err = nginxCheck(master, nodes); err != nil {
-		return err
-	}
+	c.Run("nginx", func(c platform.TestCluster) error {
+		return nginxCheck(master, nodes)
+	})
 
 	// http://kubernetes.io/v1.0/docs/user-guide/secrets/ Also, ensures
 	// https://github.com/coreos/bugs/issues/447 does not re-occur.
-	if err = secretCheck(master, nodes); err != nil {
-		return err
-	}
+	c.Run("secrets", func(c platform.TestCluster) error {
+		return secretCheck(master, nodes)
+	})
 
 	return nil
 }
@@ -0,0 +1,88 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+)
+
+// efiGlobal is the GUID of the UEFI global variables.
+const efiGlobal = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+func init() {
+	register.Register(&register.Test{
+		Run:         EFIBoot,
+		ClusterSize: 1,
+		Name:        "linux.efi",
+		Platforms:   []string{"qemu"},
+		QEMUMachine: platform.QEMUMachineOptions{EFI: true},
+	})
+	register.Register(&register.Test{
+		Run:         SecureBoot,
+		ClusterSize: 1,
+		Name:        "linux.efi.secureboot",
+		Platforms:   []string{"qemu"},
+		QEMUMachine: platform.QEMUMachineOptions{SecureBoot: true},
+	})
+}
+
+// EFIBoot tests that the machine booted through UEFI firmware and the
+// firmware recorded the boot entry that was used.
+func EFIBoot(c platform.TestCluster) error {
+	m := c.Machines()[0]
+
+	if _, err := m.SSH("test -d /sys/firmware/efi"); err != nil {
+		return fmt.Errorf("/sys/firmware/efi missing, not booted with UEFI")
+	}
+
+	out, err := m.SSH("ls /sys/firmware/efi/efivars")
+	if err != nil {
+		return fmt.Errorf("listing EFI variables: %v", err)
+	}
+	for _, v := range []string{"BootCurrent", "BootOrder"} {
+		if !strings.Contains(string(out), v+"-"+efiGlobal) {
+			return fmt.Errorf("EFI variable %s missing:\n%s", v, out)
+		}
+	}
+
+	return nil
+}
+
+// SecureBoot tests that the machine booted through UEFI with Secure Boot
+// enforced.
+func SecureBoot(c platform.TestCluster) error {
+	if err := EFIBoot(c); err != nil {
+		return err
+	}
+
+	m := c.Machines()[0]
+
+	// the variable is 4 bytes of attributes followed by the value.
+	out, err := m.SSH("od -An -t u1 /sys/firmware/efi/efivars/SecureBoot-" + efiGlobal)
+	if err != nil {
+		return fmt.Errorf("reading SecureBoot variable: %v", err)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 5 || fields[4] != "1" {
+		return fmt.Errorf("Secure Boot not enabled: SecureBoot is %q", out)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         FileServer,
+		ClusterSize: 1,
+		Name:        "linux.fileserver",
+		Platforms:   []string{"qemu"},
+		UserData: `#cloud-config
+
+write_files:
+  - path: /etc/ssl/certs/kola-fileserver.pem
+    content: {{json .FileServerCA}}
+  - path: /etc/kola-fileserver
+    content: {{.FileServer}}`,
+	})
+}
+
+// Test that machines fetch files from the cluster's file server over
+// HTTP and, trusting its certificate, HTTPS.
+func FileServer(c platform.TestCluster) error {
+	fs, ok := c.Cluster.(platform.FileServerCluster)
+	if !ok {
+		c.Skip("cluster has no file server")
+	}
+
+	m := c.Machines()[0]
+	fs.AddFile("/hello", []byte("hello from kola"))
+
+	if _, err := m.SSH("sudo update-ca-certificates"); err != nil {
+		return fmt.Errorf("update-ca-certificates: %v", err)
+	}
+
+	// the userdata got the same server
+	base, err := m.SSH("cat /etc/kola-fileserver")
+	if err != nil {
+		return fmt.Errorf("reading templated URL: %v", err)
+	}
+
+	for _, tls := range []bool{false, true} {
+		url, err := fs.FileURL(m, "/hello", tls)
+		if err != nil {
+			return err
+		}
+		if !tls && url != string(base)+"/hello" {
+			return fmt.Errorf("userdata URL %s does not match %s", base, url)
+		}
+
+		out, err := m.SSH("curl -sSf " + url)
+		if err != nil {
+			return fmt.Errorf("fetching %s: %v", url, err)
+		}
+		if string(out) != "hello from kola" {
+			return fmt.Errorf("fetching %s: got %q", url, out)
+		}
+	}
+
+	return nil
+}
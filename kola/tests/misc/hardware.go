@@ -0,0 +1,77 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/util"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         Hardware,
+		ClusterSize: 1,
+		Name:        "linux.qemu.hardware",
+		Platforms:   []string{"qemu"},
+		QEMUMachine: platform.QEMUMachineOptions{
+			CPUs:   3,
+			Memory: 1536,
+			Disks: []platform.QEMUDisk{
+				{Size: 1 << 30, Interface: "virtio"},
+				{Size: 1 << 30, Interface: "scsi"},
+				{Size: 1 << 30, Interface: "nvme"},
+			},
+			Networks: []string{"br0", "br1"},
+		},
+	})
+}
+
+// Test that the machine has the CPUs, disks and NICs requested.
+func Hardware(c platform.TestCluster) error {
+	m := c.Machines()[0]
+
+	out, err := m.SSH("nproc")
+	if err != nil {
+		return fmt.Errorf("nproc: %v", err)
+	}
+	if string(out) != "3" {
+		return fmt.Errorf("expected 3 CPUs, got %s", out)
+	}
+
+	// the boot disk plus one disk of each interface
+	for _, disk := range []string{"vda", "vdb", "sda", "nvme0n1"} {
+		if _, err := m.SSH("test -b /dev/" + disk); err != nil {
+			return fmt.Errorf("disk %s missing", disk)
+		}
+	}
+
+	checker := func() error {
+		out, err := m.SSH("ip -4 -o addr show")
+		if err != nil {
+			return fmt.Errorf("ip: %v", err)
+		}
+		if !strings.Contains(string(out), "inet 10.1.0.") {
+			return fmt.Errorf("no address on br1 network:\n%s", out)
+		}
+		return nil
+	}
+
+	return util.Retry(10, 2*time.Second, checker)
+}
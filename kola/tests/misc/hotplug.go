@@ -0,0 +1,93 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/util"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         Hotplug,
+		ClusterSize: 1,
+		Name:        "linux.qemu.hotplug",
+		Platforms:   []string{"qemu"},
+	})
+}
+
+// Test that disks can be hotplugged and that the network recovers from
+// losing its link.
+func Hotplug(c platform.TestCluster) error {
+	m := c.Machines()[0]
+
+	hp, ok := m.(platform.Hotplugger)
+	if !ok {
+		c.Skip("machine does not support hotplug")
+	}
+	lc, ok := m.(platform.LinkController)
+	if !ok {
+		c.Skip("machine does not support link control")
+	}
+
+	c.Run("disk", func(c platform.TestCluster) error {
+		id, err := hp.AttachDisk(1 << 30)
+		if err != nil {
+			return fmt.Errorf("attaching disk: %v", err)
+		}
+
+		added := func() error {
+			_, err := m.SSH("test -b /dev/vdb")
+			return err
+		}
+		if err := util.Retry(10, time.Second, added); err != nil {
+			return fmt.Errorf("disk %s did not appear", id)
+		}
+
+		if err := hp.Detach(id); err != nil {
+			return fmt.Errorf("detaching disk: %v", err)
+		}
+
+		removed := func() error {
+			if _, err := m.SSH("test -b /dev/vdb"); err == nil {
+				return fmt.Errorf("disk %s still present", id)
+			}
+			return nil
+		}
+		return util.Retry(10, time.Second, removed)
+	})
+
+	c.Run("link", func(c platform.TestCluster) error {
+		if err := lc.SetLink("nic0", false); err != nil {
+			return fmt.Errorf("setting link down: %v", err)
+		}
+		time.Sleep(5 * time.Second)
+		if err := lc.SetLink("nic0", true); err != nil {
+			return fmt.Errorf("setting link up: %v", err)
+		}
+
+		reachable := func() error {
+			_, err := m.SSH("true")
+			return err
+		}
+		return util.Retry(10, 2*time.Second, reachable)
+	})
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         DualStack,
+		ClusterSize: 2,
+		Name:        "linux.network.ipv6.dualstack",
+		Platforms:   []string{"qemu"},
+	})
+	register.Register(&register.Test{
+		Run:         IPv6Only,
+		ClusterSize: 2,
+		Name:        "linux.network.ipv6.only",
+		Platforms:   []string{"qemu"},
+		QEMUMachine: platform.QEMUMachineOptions{IPv6Only: true},
+	})
+}
+
+// Test that dual-stack machines have all their addresses and reach each
+// other by name over IPv6.
+func DualStack(c platform.TestCluster) error {
+	return checkIPv6(c, false)
+}
+
+// Test that IPv6 only machines, which SSH reaches over IPv6, have no
+// IPv4 address and reach each other by name.
+func IPv6Only(c platform.TestCluster) error {
+	return checkIPv6(c, true)
+}
+
+func checkIPv6(c platform.TestCluster, only bool) error {
+	ms := c.Machines()
+
+	// the IPv6 addresses of the machines, which DNS must return.
+	want := make(map[string]bool)
+	for _, m := range ms {
+		out, err := m.SSH("ip -o addr show scope global")
+		if err != nil {
+			return fmt.Errorf("ip addr: %v", err)
+		}
+		addrs := string(out)
+
+		for _, ip := range m.IPs() {
+			if !strings.Contains(addrs, " "+ip+"/") {
+				return fmt.Errorf("%s lacks address %s:\n%s", m.ID(), ip, addrs)
+			}
+			if strings.Contains(ip, ":") {
+				want[ip] = true
+			}
+		}
+		if only && strings.Contains(addrs, " inet ") {
+			return fmt.Errorf("IPv6 only machine %s has IPv4 addresses:\n%s", m.ID(), addrs)
+		}
+	}
+
+	got := make(map[string]bool)
+	for _, m := range ms {
+		for i := range ms {
+			name := fmt.Sprintf("instance%d.br0.local", i)
+			out, err := m.SSH("getent ahostsv6 " + name)
+			if err != nil {
+				return fmt.Errorf("%s cannot resolve %s: %v", m.ID(), name, err)
+			}
+			for _, line := range strings.Split(string(out), "\n") {
+				if f := strings.Fields(line); len(f) > 0 {
+					got[f[0]] = true
+				}
+			}
+
+			if _, err := m.SSH("ping6 -c 3 -W 2 " + name); err != nil {
+				return fmt.Errorf("ping6 from %s to %s: %v", m.ID(), name, err)
+			}
+		}
+	}
+
+	for ip := range want {
+		if !got[ip] {
+			return fmt.Errorf("no machine resolved to %s", ip)
+		}
+	}
+
+	return nil
+}
@@ -23,39 +23,12 @@ import (
 	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/util"
 
-	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/coreos-cloudinit/config"
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/pkg/capnslog"
 )
 
 var (
 	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/tests/misc")
 
-	nfsserverconf = config.CloudConfig{
-		CoreOS: config.CoreOS{
-			Units: []config.Unit{
-				config.Unit{
-					Name:    "rpc-statd.service",
-					Command: "start",
-				},
-				config.Unit{
-					Name:    "rpc-mountd.service",
-					Command: "start",
-				},
-				config.Unit{
-					Name:    "nfsd.service",
-					Command: "start",
-				},
-			},
-		},
-		WriteFiles: []config.File{
-			config.File{
-				Content: "/tmp	*(ro,insecure,all_squash,no_subtree_check,fsid=0)",
-				Path: "/etc/exports",
-			},
-		},
-		Hostname: "nfs1",
-	}
-
 	mounttmpl = `[Unit]
 Description=NFS Client
 After=network-online.target
@@ -87,7 +60,14 @@ func init() {
 }
 
 func testNFS(c platform.TestCluster, nfsversion int) error {
-	m1, err := c.NewMachine(nfsserverconf.String())
+	c1 := platform.NewCloudConfigConf()
+	c1.AddSystemdUnit("rpc-statd.service", "", true)
+	c1.AddSystemdUnit("rpc-mountd.service", "", true)
+	c1.AddSystemdUnit("nfsd.service", "", true)
+	c1.AddFile("/etc/exports", "/tmp	*(ro,insecure,all_squash,no_subtree_check,fsid=0)", 0644)
+	c1.SetHostname("nfs1")
+
+	m1, err := c.NewMachine(c1.String())
 	if err != nil {
 		return fmt.Errorf("Cluster.NewMachine: %s", err)
 	}
@@ -104,18 +84,9 @@ func testNFS(c platform.TestCluster, nfsversion int) error {
 
 	plog.Infof("Test file %q created on server.", tmp)
 
-	c2 := config.CloudConfig{
-		CoreOS: config.CoreOS{
-			Units: []config.Unit{
-				config.Unit{
-					Name:    "mnt.mount",
-					Command: "start",
-					Content: fmt.Sprintf(mounttmpl, m1.PrivateIP(), nfsversion),
-				},
-			},
-		},
-		Hostname: "nfs2",
-	}
+	c2 := platform.NewCloudConfigConf()
+	c2.AddSystemdUnit("mnt.mount", fmt.Sprintf(mounttmpl, m1.PrivateIP(), nfsversion), true)
+	c2.SetHostname("nfs2")
 
 	m2, err := c.NewMachine(c2.String())
 	if err != nil {
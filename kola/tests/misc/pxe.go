@@ -0,0 +1,62 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         PXE,
+		ClusterSize: 1,
+		Name:        "linux.pxe",
+		Platforms:   []string{"qemu"},
+		QEMUMachine: platform.QEMUMachineOptions{
+			PXE:    true,
+			Memory: 2048,
+		},
+	})
+
+	register.Register(&register.Test{
+		Run:         PXE,
+		ClusterSize: 1,
+		Name:        "linux.pxe.cloudinit",
+		Platforms:   []string{"qemu"},
+		UserData:    "#cloud-config",
+		QEMUMachine: platform.QEMUMachineOptions{
+			PXE:    true,
+			Memory: 2048,
+		},
+	})
+}
+
+// Test that a machine booted with PXE comes up running from memory.
+func PXE(c platform.TestCluster) error {
+	m := c.Machines()[0]
+
+	out, err := m.SSH("findmnt --noheadings --output FSTYPE /")
+	if err != nil {
+		return fmt.Errorf("findmnt: %v", err)
+	}
+	if string(out) != "tmpfs" {
+		return fmt.Errorf("expected a tmpfs root, got %q", out)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         Reboot,
+		ClusterSize: 1,
+		Name:        "linux.reboot",
+	})
+}
+
+// Test that the machine reboots and that /var persists across reboots.
+func Reboot(c platform.TestCluster) error {
+	m := c.Machines()[0]
+
+	if _, err := m.SSH("echo persisted | sudo tee /var/kola-reboot"); err != nil {
+		return fmt.Errorf("writing file: %v", err)
+	}
+
+	if err := m.Reboot(); err != nil {
+		return fmt.Errorf("rebooting: %v", err)
+	}
+
+	out, err := m.SSH("cat /var/kola-reboot")
+	if err != nil {
+		return fmt.Errorf("reading file: %v", err)
+	}
+	if string(out) != "persisted" {
+		return fmt.Errorf("file did not persist, got %q", out)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/platform/local"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         Topology,
+		ClusterSize: 3,
+		Name:        "linux.network.topology",
+		Platforms:   []string{"qemu"},
+		Topology: platform.Topology{
+			Machines: [][]string{
+				{"br0", "br1"},
+				{"br1"},
+				{"br2"},
+			},
+			Topology: local.Topology{
+				Routed: []string{"br1", "br2"},
+			},
+		},
+	})
+}
+
+// Test that machines reach each other across routed segments and on
+// shared segments, but not across isolated segments.
+func Topology(c platform.TestCluster) error {
+	var ms [3]platform.Machine
+	for _, m := range c.Machines() {
+		out, err := m.SSH("hostname -I")
+		if err != nil {
+			return fmt.Errorf("hostname: %v", err)
+		}
+		// the cluster's machines are unordered, identify them by the
+		// segment of their first address.
+		var s, i int
+		if _, err := fmt.Sscanf(string(out), "10.%d.0.%d", &s, &i); err != nil {
+			return fmt.Errorf("unexpected addresses %q", out)
+		}
+		ms[s] = m
+	}
+
+	reachable := []struct {
+		from, to string
+		m        platform.Machine
+		ip       string
+		want     bool
+	}{
+		{"br1", "shared br1", ms[1], ms[0].PrivateIP(), true},
+		{"br1", "isolated br0", ms[1], ms[0].IP(), false},
+		{"br2", "routed br1", ms[2], ms[1].IP(), true},
+		{"br2", "isolated br0", ms[2], ms[0].IP(), false},
+	}
+
+	for _, r := range reachable {
+		_, err := r.m.SSH("ping -c 3 -W 2 " + r.ip)
+		if got := err == nil; got != r.want {
+			return fmt.Errorf("ping from %s to %s: got reachable=%v, want %v", r.from, r.to, got, r.want)
+		}
+	}
+
+	return nil
+}
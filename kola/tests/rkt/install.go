@@ -16,6 +16,7 @@ package rkt
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/coreos/mantle/kola/register"
 	"github.com/coreos/mantle/platform"
@@ -29,7 +30,8 @@ func init() {
 	})
 }
 
-// Test to make sure rkt install works.
+// Test to make sure rkt install works, and that rkt then fetches busybox
+// from the cluster's Docker registry, if it has one serving busybox.
 func Install(c platform.TestCluster) error {
 	mach, err := c.NewMachine("")
 	if err != nil {
@@ -43,5 +45,22 @@ func Install(c platform.TestCluster) error {
 		return fmt.Errorf("failed to run %q: %s: %s", cmd, err, output)
 	}
 
+	image, err := c.LocalImage(mach, "rkt", "busybox")
+	if err != nil {
+		return err
+	}
+	if image == "" {
+		return nil
+	}
+
+	cmd = "sudo rkt --insecure-options=image,http fetch docker://" + image
+	output, err = mach.SSH(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to run %q: %s: %s", cmd, err, output)
+	}
+	if !strings.Contains(string(output), "sha512-") {
+		return fmt.Errorf("%q printed no image ID: %q", cmd, output)
+	}
+
 	return nil
 }
@@ -23,26 +23,15 @@ import (
 	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/util"
 
-	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/coreos-cloudinit/config"
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/pkg/capnslog"
 )
 
 var (
 	plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "kola/tests/systemd")
-
-	gatewayconf = config.CloudConfig{
-		CoreOS: config.CoreOS{
-			Units: []config.Unit{
-				config.Unit{
-					Name:    "systemd-journal-gatewayd.socket",
-					Command: "start",
-				},
-			},
-		},
-		Hostname: "gateway",
-	}
 )
 
+const gatewayHostname = "gateway"
+
 func init() {
 	register.Register(&register.Test{
 		Run:         JournalRemote,
@@ -55,6 +44,10 @@ func init() {
 // a systemd-journal-gatewayd server.
 func JournalRemote(c platform.TestCluster) error {
 	// start gatewayd and log a message
+	gatewayconf := platform.NewCloudConfigConf()
+	gatewayconf.AddSystemdUnit("systemd-journal-gatewayd.socket", "", true)
+	gatewayconf.SetHostname(gatewayHostname)
+
 	gateway, err := c.NewMachine(gatewayconf.String())
 	if err != nil {
 		return fmt.Errorf("Cluster.NewMachine: %s", err)
@@ -84,7 +77,7 @@ func JournalRemote(c platform.TestCluster) error {
 
 	// find the message on the collector
 	journalReader := func() error {
-		cmd = fmt.Sprintf("sudo journalctl _HOSTNAME=%s -t core --file /var/log/journal/remote/remote-%s:19531.journal", gatewayconf.Hostname, gateway.PrivateIP())
+		cmd = fmt.Sprintf("sudo journalctl _HOSTNAME=%s -t core --file /var/log/journal/remote/remote-%s:19531.journal", gatewayHostname, gateway.PrivateIP())
 		out, err = collector.SSH(cmd)
 		if err != nil {
 			return fmt.Errorf("journalctl: %v: %v", out, err)
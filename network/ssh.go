@@ -47,6 +47,7 @@ type SSHAgent struct {
 	Socket   string
 	sockDir  string
 	listener *net.UnixListener
+	conn     net.Conn // to the agent of AttachSSHAgent
 }
 
 // NewSSHAgent constructs a new SSHAgent using dialer to create ssh
@@ -99,8 +100,30 @@ func NewSSHAgent(dialer Dialer) (*SSHAgent, error) {
 	return a, nil
 }
 
+// AttachSSHAgent connects to the agent listening on socket, e.g. one
+// created by NewSSHAgent in another process, using dialer to create ssh
+// connections.
+func AttachSSHAgent(socket string, dialer Dialer) (*SSHAgent, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSHAgent{
+		Agent:  agent.NewClient(conn),
+		Dialer: dialer,
+		User:   defaultUser,
+		Socket: socket,
+		conn:   conn,
+	}, nil
+}
+
 // Close closes the unix socket of the agent.
 func (a *SSHAgent) Close() error {
+	if a.conn != nil {
+		return a.conn.Close()
+	}
+
 	a.listener.Close()
 	return os.RemoveAll(a.sockDir)
 }
@@ -124,8 +147,13 @@ func ensurePortSuffix(host string, port int) string {
 // NewClient connects to the given host via SSH, the client will support
 // agent forwarding but it must also be enabled per-session.
 func (a *SSHAgent) NewClient(host string) (*ssh.Client, error) {
+	return a.NewUserClient(a.User, host)
+}
+
+// NewUserClient is like NewClient, logging in as user rather than User.
+func (a *SSHAgent) NewUserClient(user, host string) (*ssh.Client, error) {
 	sshcfg := ssh.ClientConfig{
-		User: a.User,
+		User: user,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeysCallback(a.Signers),
 		},
@@ -93,3 +93,29 @@ func TestSSHNewClient(t *testing.T) {
 	// Oh god... I give up for now.
 	t.Skip("Implementation incomplete")
 }
+
+func TestAttachSSHAgent(t *testing.T) {
+	a, err := NewSSHAgent(&net.Dialer{})
+	if err != nil {
+		t.Fatalf("NewSSHAgent failed: %v", err)
+	}
+	defer a.Close()
+
+	attached, err := AttachSSHAgent(a.Socket, &net.Dialer{})
+	if err != nil {
+		t.Fatalf("AttachSSHAgent failed: %v", err)
+	}
+	defer attached.Close()
+
+	keys, err := a.List()
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	attachedKeys, err := attached.List()
+	if err != nil {
+		t.Fatalf("Keys of attached agent failed: %v", err)
+	}
+	if len(attachedKeys) != 1 || !bytes.Equal(attachedKeys[0].Marshal(), keys[0].Marshal()) {
+		t.Errorf("attached agent has keys %v, want %v", attachedKeys, keys)
+	}
+}
@@ -51,6 +51,18 @@ func (am *awsMachine) PrivateIP() string {
 	return *am.mach.PrivateIpAddress
 }
 
+func (ac *awsCluster) SSHAgentSocket() string {
+	return ac.agent.Socket
+}
+
+func (ac *awsCluster) NetNSPath() string {
+	return ""
+}
+
+func (am *awsMachine) IPs() []string {
+	return []string{am.IP(), am.PrivateIP()}
+}
+
 func (am *awsMachine) SSHClient() (*ssh.Client, error) {
 	sshClient, err := am.cluster.agent.NewClient(am.IP())
 	if err != nil {
@@ -81,14 +93,40 @@ func (am *awsMachine) SSH(cmd string) ([]byte, error) {
 	return out, err
 }
 
-func (am *awsMachine) Destroy() error {
-	id := am.ID()
+func (am *awsMachine) ConsoleOutput() (string, error) {
+	input := &ec2.GetConsoleOutputInput{
+		InstanceId: am.mach.InstanceId,
+	}
 
-	input := &ec2.TerminateInstancesInput{
-		InstanceIds: []*string{&id},
+	resp, err := am.cluster.api.GetConsoleOutput(input)
+	if err != nil {
+		return "", err
+	}
+
+	// EC2 only has output once the instance has been running for a
+	// while.
+	if resp.Output == nil {
+		return "", nil
 	}
 
-	if _, err := am.cluster.api.TerminateInstances(input); err != nil {
+	out, err := base64.StdEncoding.DecodeString(*resp.Output)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+func (am *awsMachine) Reboot() error {
+	return rebootMachine(am, sshRetries)
+}
+
+func (am *awsMachine) WaitForBoot(bootID string) error {
+	return waitForBoot(am, bootID, sshRetries)
+}
+
+func (am *awsMachine) Destroy() error {
+	if err := am.cluster.terminate(am.mach.InstanceId); err != nil {
 		return err
 	}
 
@@ -98,18 +136,46 @@ func (am *awsMachine) Destroy() error {
 
 // AWSOptions contains AWS-specific instance options.
 type AWSOptions struct {
+	// AMI is the image to boot, or "alpha", "beta" or "stable" for
+	// the latest CoreOS HVM image of that channel.
 	AMI           string
 	KeyName       string
 	InstanceType  string
 	SecurityGroup string
+
+	// EphemeralNetwork creates a VPC with a public subnet for the
+	// cluster, a security group only allowing SSH from anywhere and
+	// any traffic between the machines, and a key pair of the
+	// cluster's SSH key. Destroy deletes them along with the machines.
+	// KeyName and SecurityGroup are ignored.
+	EphemeralNetwork bool
+
+	// Region overrides $AWS_REGION and Endpoint the EC2 API endpoint
+	// of the region, e.g. with a local stand-in for testing.
+	Region   string
+	Endpoint string
+}
+
+// awsCoreOSOwner is the AWS account publishing the CoreOS AMIs.
+const awsCoreOSOwner = "595879546273"
+
+// awsNetwork holds the resources created for a cluster with
+// EphemeralNetwork set.
+type awsNetwork struct {
+	vpc, subnet, gateway, securityGroup, keyName *string
 }
 
 type awsCluster struct {
-	mu    sync.Mutex
-	api   *ec2.EC2
-	conf  AWSOptions
-	agent *network.SSHAgent
-	machs map[string]*awsMachine
+	mu      sync.Mutex
+	api     *ec2.EC2
+	conf    AWSOptions
+	agent   *network.SSHAgent
+	machs   map[string]*awsMachine
+	network *awsNetwork
+
+	// launched holds the IDs of all instances run by the cluster,
+	// which must be gone before the network can be deleted.
+	launched []*string
 }
 
 // NewAWSCluster creates an instance of a Cluster suitable for spawning
@@ -119,7 +185,20 @@ type awsCluster struct {
 // $AWS_ACCESS_KEY_ID, and $AWS_SECRET_ACCESS_KEY to determine the region to
 // spawn instances in and the credentials to use to authenticate.
 func NewAWSCluster(conf AWSOptions) (Cluster, error) {
-	api := ec2.New(aws.NewConfig().WithCredentials(credentials.NewEnvCredentials()))
+	cfg := aws.NewConfig().WithCredentials(credentials.NewEnvCredentials())
+	if conf.Region != "" {
+		cfg = cfg.WithRegion(conf.Region)
+	}
+	if conf.Endpoint != "" {
+		cfg = cfg.WithEndpoint(conf.Endpoint)
+	}
+	api := ec2.New(cfg)
+
+	ami, err := resolveAMI(api, conf.AMI)
+	if err != nil {
+		return nil, err
+	}
+	conf.AMI = ami
 
 	agent, err := network.NewSSHAgent(&net.Dialer{})
 	if err != nil {
@@ -133,9 +212,220 @@ func NewAWSCluster(conf AWSOptions) (Cluster, error) {
 		machs: make(map[string]*awsMachine),
 	}
 
+	if conf.EphemeralNetwork {
+		if err := ac.createNetwork(); err != nil {
+			if err2 := ac.deleteNetwork(); err2 != nil {
+				plog.Errorf("deleting the partial network: %v", err2)
+			}
+			agent.Close()
+			return nil, err
+		}
+	}
+
 	return ac, nil
 }
 
+// resolveAMI returns the ID of the latest CoreOS HVM image of the channel
+// ami names, or ami itself if it is not a channel.
+func resolveAMI(api *ec2.EC2, ami string) (string, error) {
+	switch ami {
+	case "alpha", "beta", "stable":
+	default:
+		return ami, nil
+	}
+
+	resp, err := api.DescribeImages(&ec2.DescribeImagesInput{
+		Owners: []*string{aws.String(awsCoreOSOwner)},
+		Filters: []*ec2.Filter{
+			{Name: aws.String("name"), Values: []*string{aws.String("CoreOS-" + ami + "-*")}},
+			{Name: aws.String("virtualization-type"), Values: []*string{aws.String("hvm")}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up the %s AMI: %v", ami, err)
+	}
+
+	var latest *ec2.Image
+	for _, img := range resp.Images {
+		// creation dates are ISO 8601, so they sort as strings.
+		if latest == nil || aws.StringValue(img.CreationDate) > aws.StringValue(latest.CreationDate) {
+			latest = img
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("no %s AMI found", ami)
+	}
+
+	return aws.StringValue(latest.ImageId), nil
+}
+
+// createNetwork creates the VPC, subnet, internet gateway, security
+// group and key pair of the cluster, see EphemeralNetwork.
+func (ac *awsCluster) createNetwork() error {
+	ac.network = &awsNetwork{}
+	n := ac.network
+
+	vpc, err := ac.api.CreateVpc(&ec2.CreateVpcInput{
+		CidrBlock: aws.String("10.0.0.0/16"),
+	})
+	if err != nil {
+		return fmt.Errorf("creating VPC: %v", err)
+	}
+	n.vpc = vpc.Vpc.VpcId
+
+	subnet, err := ac.api.CreateSubnet(&ec2.CreateSubnetInput{
+		VpcId:     n.vpc,
+		CidrBlock: aws.String("10.0.0.0/24"),
+	})
+	if err != nil {
+		return fmt.Errorf("creating subnet: %v", err)
+	}
+	n.subnet = subnet.Subnet.SubnetId
+
+	// machines are reached on their public addresses.
+	if _, err := ac.api.ModifySubnetAttribute(&ec2.ModifySubnetAttributeInput{
+		SubnetId:            n.subnet,
+		MapPublicIpOnLaunch: &ec2.AttributeBooleanValue{Value: aws.Bool(true)},
+	}); err != nil {
+		return fmt.Errorf("modifying subnet: %v", err)
+	}
+
+	gateway, err := ac.api.CreateInternetGateway(&ec2.CreateInternetGatewayInput{})
+	if err != nil {
+		return fmt.Errorf("creating internet gateway: %v", err)
+	}
+	n.gateway = gateway.InternetGateway.InternetGatewayId
+
+	if _, err := ac.api.AttachInternetGateway(&ec2.AttachInternetGatewayInput{
+		InternetGatewayId: n.gateway,
+		VpcId:             n.vpc,
+	}); err != nil {
+		return fmt.Errorf("attaching internet gateway: %v", err)
+	}
+
+	// the main route table is created and deleted with the VPC.
+	tables, err := ac.api.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: []*string{n.vpc}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("listing route tables: %v", err)
+	}
+	if len(tables.RouteTables) == 0 {
+		return fmt.Errorf("VPC %s has no route table", aws.StringValue(n.vpc))
+	}
+
+	if _, err := ac.api.CreateRoute(&ec2.CreateRouteInput{
+		RouteTableId:         tables.RouteTables[0].RouteTableId,
+		DestinationCidrBlock: aws.String("0.0.0.0/0"),
+		GatewayId:            n.gateway,
+	}); err != nil {
+		return fmt.Errorf("creating default route: %v", err)
+	}
+
+	name := "kola-" + aws.StringValue(n.vpc)
+
+	sg, err := ac.api.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String("kola cluster"),
+		VpcId:       n.vpc,
+	})
+	if err != nil {
+		return fmt.Errorf("creating security group: %v", err)
+	}
+	n.securityGroup = sg.GroupId
+
+	if _, err := ac.api.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: n.securityGroup,
+		IpPermissions: []*ec2.IpPermission{
+			{
+				IpProtocol: aws.String("tcp"),
+				FromPort:   aws.Int64(22),
+				ToPort:     aws.Int64(22),
+				IpRanges:   []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+			},
+			{
+				IpProtocol:       aws.String("-1"),
+				UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: n.securityGroup}},
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("authorizing security group ingress: %v", err)
+	}
+
+	keys, err := ac.agent.List()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no SSH key to import")
+	}
+
+	if _, err := ac.api.ImportKeyPair(&ec2.ImportKeyPairInput{
+		KeyName:           aws.String(name),
+		PublicKeyMaterial: []byte(keys[0].String()),
+	}); err != nil {
+		return fmt.Errorf("importing key pair: %v", err)
+	}
+	n.keyName = aws.String(name)
+
+	return nil
+}
+
+// deleteNetwork deletes what createNetwork created, in reverse order. The
+// cluster's instances must be terminated.
+func (ac *awsCluster) deleteNetwork() error {
+	n := ac.network
+	if n == nil {
+		return nil
+	}
+
+	var err error
+	firstErr := func(what string, e error) {
+		if e != nil && err == nil {
+			err = fmt.Errorf("deleting %s: %v", what, e)
+		}
+	}
+
+	if n.keyName != nil {
+		_, e := ac.api.DeleteKeyPair(&ec2.DeleteKeyPairInput{KeyName: n.keyName})
+		firstErr("key pair", e)
+	}
+	if n.securityGroup != nil {
+		_, e := ac.api.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{GroupId: n.securityGroup})
+		firstErr("security group", e)
+	}
+	if n.gateway != nil {
+		// detaching fails if attaching did, which is fine.
+		ac.api.DetachInternetGateway(&ec2.DetachInternetGatewayInput{
+			InternetGatewayId: n.gateway,
+			VpcId:             n.vpc,
+		})
+		_, e := ac.api.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{InternetGatewayId: n.gateway})
+		firstErr("internet gateway", e)
+	}
+	if n.subnet != nil {
+		_, e := ac.api.DeleteSubnet(&ec2.DeleteSubnetInput{SubnetId: n.subnet})
+		firstErr("subnet", e)
+	}
+	if n.vpc != nil {
+		_, e := ac.api.DeleteVpc(&ec2.DeleteVpcInput{VpcId: n.vpc})
+		firstErr("VPC", e)
+	}
+
+	ac.network = nil
+	return err
+}
+
+// terminate terminates the instance id.
+func (ac *awsCluster) terminate(id *string) error {
+	_, err := ac.api.TerminateInstances(&ec2.TerminateInstancesInput{
+		InstanceIds: []*string{id},
+	})
+	return err
+}
+
 func (ac *awsCluster) addMach(m *awsMachine) {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
@@ -153,6 +443,21 @@ func (ac *awsCluster) NewCommand(name string, arg ...string) exec.Cmd {
 }
 
 func (ac *awsCluster) NewMachine(userdata string) (Machine, error) {
+	return ac.newMachine(userdata, standaloneVars())
+}
+
+func (ac *awsCluster) newMachine(userdata string, vars UserdataVars) (Machine, error) {
+	// addresses are only known once the instance is running, so
+	// leave them to coreos-cloudinit.
+	vars.Platform = "aws"
+	vars.PublicIPv4 = "$public_ipv4"
+	vars.PrivateIPv4 = "$private_ipv4"
+
+	userdata, err := RenderUserdata(userdata, vars)
+	if err != nil {
+		return nil, err
+	}
+
 	conf, err := NewConf(userdata)
 	if err != nil {
 		return nil, err
@@ -166,26 +471,20 @@ func (ac *awsCluster) NewMachine(userdata string) (Machine, error) {
 	conf.CopyKeys(keys)
 
 	ud := base64.StdEncoding.EncodeToString([]byte(conf.String()))
-	cnt := int64(1)
-
-	inst := ec2.RunInstancesInput{
-		ImageId:        &ac.conf.AMI,
-		MinCount:       &cnt,
-		MaxCount:       &cnt,
-		KeyName:        &ac.conf.KeyName, // this is only useful if you wish to ssh in for debugging
-		InstanceType:   &ac.conf.InstanceType,
-		SecurityGroups: []*string{&ac.conf.SecurityGroup},
-		UserData:       &ud,
-	}
 
-	resp, err := ac.api.RunInstances(&inst)
+	resp, err := ac.api.RunInstances(ac.runInstancesInput(ud))
 	if err != nil {
 		return nil, err
 	}
 
 	ids := []*string{resp.Instances[0].InstanceId}
 
+	ac.mu.Lock()
+	ac.launched = append(ac.launched, ids...)
+	ac.mu.Unlock()
+
 	if err := waitForAWSInstances(ac.api, ids, 5*time.Minute); err != nil {
+		ac.terminate(ids[0])
 		return nil, err
 	}
 
@@ -195,6 +494,7 @@ func (ac *awsCluster) NewMachine(userdata string) (Machine, error) {
 
 	insts, err := ac.api.DescribeInstances(getinst)
 	if err != nil {
+		ac.terminate(ids[0])
 		return nil, err
 	}
 
@@ -204,6 +504,7 @@ func (ac *awsCluster) NewMachine(userdata string) (Machine, error) {
 	}
 
 	if err := commonMachineChecks(mach); err != nil {
+		ac.terminate(ids[0])
 		return nil, fmt.Errorf("machine %q failed basic checks: %v", mach.ID(), err)
 	}
 
@@ -212,6 +513,29 @@ func (ac *awsCluster) NewMachine(userdata string) (Machine, error) {
 	return mach, nil
 }
 
+// runInstancesInput returns the request for an instance with the base64
+// encoded userdata ud, in the cluster's network if it has one.
+func (ac *awsCluster) runInstancesInput(ud string) *ec2.RunInstancesInput {
+	inst := &ec2.RunInstancesInput{
+		ImageId:      &ac.conf.AMI,
+		MinCount:     aws.Int64(1),
+		MaxCount:     aws.Int64(1),
+		InstanceType: &ac.conf.InstanceType,
+		UserData:     &ud,
+	}
+
+	if n := ac.network; n != nil {
+		inst.KeyName = n.keyName
+		inst.SubnetId = n.subnet
+		inst.SecurityGroupIds = []*string{n.securityGroup}
+	} else {
+		inst.KeyName = &ac.conf.KeyName // this is only useful if you wish to ssh in for debugging
+		inst.SecurityGroups = []*string{&ac.conf.SecurityGroup}
+	}
+
+	return inst
+}
+
 func (ac *awsCluster) Machines() []Machine {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
@@ -241,11 +565,69 @@ func (ac *awsCluster) GetDiscoveryURL(size int) (string, error) {
 }
 
 func (ac *awsCluster) Destroy() error {
+	var err error
+	firstErr := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
 	machs := ac.Machines()
 	for _, am := range machs {
-		am.Destroy()
+		firstErr(am.Destroy())
+	}
+
+	if ac.network != nil {
+		ac.mu.Lock()
+		launched := ac.launched
+		ac.mu.Unlock()
+
+		// the network is in use until the instances are gone.
+		if e := waitForAWSTermination(ac.api, launched, 5*time.Minute); e != nil {
+			firstErr(e)
+		} else {
+			firstErr(ac.deleteNetwork())
+		}
+	}
+
+	firstErr(ac.agent.Close())
+	return err
+}
+
+// waitForAWSTermination waits until a set of aws ec2 instances is
+// terminated.
+func waitForAWSTermination(api *ec2.EC2, ids []*string, d time.Duration) error {
+	after := time.After(d)
+
+	for len(ids) > 0 {
+		insts, err := api.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: ids,
+		})
+		if err != nil {
+			return err
+		}
+
+		var running []*string
+		for _, r := range insts.Reservations {
+			for _, i := range r.Instances {
+				// "terminated"
+				if *i.State.Code != int64(48) {
+					running = append(running, i.InstanceId)
+				}
+			}
+		}
+		if len(running) == 0 {
+			return nil
+		}
+		ids = running
+
+		select {
+		case <-after:
+			return fmt.Errorf("timed out waiting for instances to terminate")
+		case <-time.After(10 * time.Second):
+		}
 	}
-	ac.agent.Close()
+
 	return nil
 }
 
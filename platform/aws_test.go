@@ -15,8 +15,13 @@
 package platform
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -55,3 +60,246 @@ func TestAWSMachine(t *testing.T) {
 
 	defer m.Destroy()
 }
+
+// fakeEC2 is a local stand-in for the EC2 API, implementing just enough
+// of it to create and delete the network of a cluster. Like EC2, it
+// refuses to delete resources others still depend on.
+type fakeEC2 struct {
+	mu        sync.Mutex
+	next      int
+	resources map[string]string // ID to the ID of the VPC it is in
+	public    map[string]bool   // subnets mapping public IPs
+	routes    map[string]string // route table to gateway of the default route
+	rules     map[string][]string
+	keys      map[string]string
+}
+
+func newFakeEC2() *fakeEC2 {
+	return &fakeEC2{
+		resources: make(map[string]string),
+		public:    make(map[string]bool),
+		routes:    make(map[string]string),
+		rules:     make(map[string][]string),
+		keys:      make(map[string]string),
+	}
+}
+
+func (f *fakeEC2) create(prefix, vpc string) string {
+	f.next++
+	id := fmt.Sprintf("%s-%d", prefix, f.next)
+	f.resources[id] = vpc
+	return id
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r.ParseForm()
+	action := r.Form.Get("Action")
+
+	fail := func(code, format string, args ...interface{}) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors></Response>",
+			code, fmt.Sprintf(format, args...))
+	}
+	exists := func(ids ...string) bool {
+		for _, id := range ids {
+			if _, ok := f.resources[id]; !ok {
+				fail("InvalidID", "%s: no resource %q", action, id)
+				return false
+			}
+		}
+		return true
+	}
+	del := func(id string) {
+		if !exists(id) {
+			return
+		}
+		for other, vpc := range f.resources {
+			if vpc == id && !strings.HasPrefix(other, "rtb-") {
+				fail("DependencyViolation", "%s is in use by %s", id, other)
+				return
+			}
+		}
+		delete(f.resources, id)
+		fmt.Fprintf(w, "<%sResponse><return>true</return></%sResponse>", action, action)
+	}
+
+	var body string
+	switch action {
+	case "CreateVpc":
+		vpc := f.create("vpc", "")
+		f.create("rtb", vpc)
+		body = "<vpc><vpcId>" + vpc + "</vpcId></vpc>"
+	case "CreateSubnet":
+		vpc := r.Form.Get("VpcId")
+		if !exists(vpc) {
+			return
+		}
+		body = "<subnet><subnetId>" + f.create("subnet", vpc) + "</subnetId></subnet>"
+	case "ModifySubnetAttribute":
+		subnet := r.Form.Get("SubnetId")
+		if !exists(subnet) {
+			return
+		}
+		f.public[subnet] = r.Form.Get("MapPublicIpOnLaunch.Value") == "true"
+	case "CreateInternetGateway":
+		body = "<internetGateway><internetGatewayId>" + f.create("igw", "") + "</internetGatewayId></internetGateway>"
+	case "AttachInternetGateway", "DetachInternetGateway":
+		igw, vpc := r.Form.Get("InternetGatewayId"), r.Form.Get("VpcId")
+		if !exists(igw, vpc) {
+			return
+		}
+		if action == "DetachInternetGateway" {
+			vpc = ""
+		}
+		f.resources[igw] = vpc
+	case "DescribeRouteTables":
+		body = "<routeTableSet>"
+		for id, vpc := range f.resources {
+			if strings.HasPrefix(id, "rtb-") && vpc == r.Form.Get("Filter.1.Value.1") {
+				body += "<item><routeTableId>" + id + "</routeTableId><vpcId>" + vpc + "</vpcId></item>"
+			}
+		}
+		body += "</routeTableSet>"
+	case "CreateRoute":
+		rtb, igw := r.Form.Get("RouteTableId"), r.Form.Get("GatewayId")
+		if !exists(rtb, igw) {
+			return
+		}
+		f.routes[rtb] = igw
+	case "CreateSecurityGroup":
+		vpc := r.Form.Get("VpcId")
+		if !exists(vpc) {
+			return
+		}
+		body = "<groupId>" + f.create("sg", vpc) + "</groupId>"
+	case "AuthorizeSecurityGroupIngress":
+		sg := r.Form.Get("GroupId")
+		if !exists(sg) {
+			return
+		}
+		for i := 1; r.Form.Get(fmt.Sprintf("IpPermissions.%d.IpProtocol", i)) != ""; i++ {
+			p := fmt.Sprintf("IpPermissions.%d.", i)
+			f.rules[sg] = append(f.rules[sg], fmt.Sprintf("%s %s-%s from %s%s",
+				r.Form.Get(p+"IpProtocol"), r.Form.Get(p+"FromPort"), r.Form.Get(p+"ToPort"),
+				r.Form.Get(p+"IpRanges.1.CidrIp"), r.Form.Get(p+"Groups.1.GroupId")))
+		}
+	case "ImportKeyPair":
+		key, err := base64.StdEncoding.DecodeString(r.Form.Get("PublicKeyMaterial"))
+		if err != nil {
+			fail("InvalidKey.Format", "%v", err)
+			return
+		}
+		name := r.Form.Get("KeyName")
+		f.keys[name] = string(key)
+		body = "<keyName>" + name + "</keyName>"
+	case "DeleteKeyPair":
+		delete(f.keys, r.Form.Get("KeyName"))
+	case "DeleteSecurityGroup":
+		del(r.Form.Get("GroupId"))
+		return
+	case "DeleteInternetGateway":
+		igw := r.Form.Get("InternetGatewayId")
+		if exists(igw) && f.resources[igw] != "" {
+			fail("DependencyViolation", "%s is attached", igw)
+			return
+		}
+		del(igw)
+		return
+	case "DeleteSubnet":
+		del(r.Form.Get("SubnetId"))
+		return
+	case "DeleteVpc":
+		vpc := r.Form.Get("VpcId")
+		del(vpc)
+		for id, v := range f.resources {
+			if v == vpc {
+				delete(f.resources, id)
+			}
+		}
+		return
+	case "DescribeImages":
+		body = `<imagesSet>
+<item><imageId>ami-old</imageId><creationDate>2015-10-01T00:00:00.000Z</creationDate></item>
+<item><imageId>ami-new</imageId><creationDate>2015-11-01T00:00:00.000Z</creationDate></item>
+</imagesSet>`
+	default:
+		fail("InvalidAction", "unsupported action %q", action)
+		return
+	}
+
+	fmt.Fprintf(w, "<%sResponse>%s</%sResponse>", action, body, action)
+}
+
+func TestAWSEphemeralNetwork(t *testing.T) {
+	for k, v := range map[string]string{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret"} {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+
+	f := newFakeEC2()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	c, err := NewAWSCluster(AWSOptions{
+		AMI:              "alpha",
+		InstanceType:     "t2.micro",
+		EphemeralNetwork: true,
+		Region:           "us-west-1",
+		Endpoint:         srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := c.(*awsCluster)
+
+	if ac.conf.AMI != "ami-new" {
+		t.Errorf("alpha resolved to %q, want the latest image ami-new", ac.conf.AMI)
+	}
+
+	n := ac.network
+	subnet, sg, key := *n.subnet, *n.securityGroup, *n.keyName
+	if !f.public[subnet] {
+		t.Errorf("subnet %s does not map public IPs", subnet)
+	}
+	if len(f.routes) != 1 {
+		t.Errorf("want a default route through the gateway, got %v", f.routes)
+	}
+	for rtb, igw := range f.routes {
+		if f.resources[rtb] != *n.vpc || igw != *n.gateway {
+			t.Errorf("route of %s through %s, want the VPC's through %s", rtb, igw, *n.gateway)
+		}
+	}
+
+	wantRules := []string{"tcp 22-22 from 0.0.0.0/0", "-1 - from " + sg}
+	if fmt.Sprint(f.rules[sg]) != fmt.Sprint(wantRules) {
+		t.Errorf("security group rules %q, want %q", f.rules[sg], wantRules)
+	}
+
+	keys, err := ac.agent.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.keys[key] != keys[0].String() {
+		t.Errorf("imported key %q, want the cluster's %q", f.keys[key], keys[0].String())
+	}
+
+	in := ac.runInstancesInput("")
+	if *in.SubnetId != subnet || len(in.SecurityGroupIds) != 1 || *in.SecurityGroupIds[0] != sg || *in.KeyName != key || in.SecurityGroups != nil {
+		t.Errorf("instances not in the cluster's network: %v", in)
+	}
+
+	if err := c.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.resources) != 0 || len(f.keys) != 0 {
+		t.Errorf("left behind %v and keys %v", f.resources, f.keys)
+	}
+}
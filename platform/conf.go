@@ -17,6 +17,7 @@ package platform
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 
 	cci "github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/coreos-cloudinit/config"
 	ign "github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/ignition/src/config"
@@ -30,22 +31,29 @@ type Conf struct {
 	cloudconfig *cci.CloudConfig
 }
 
-var (
-	defConfig = cci.CloudConfig{}
-)
+// rootDevice is the filesystem Ignition writes files to.
+const rootDevice = "/dev/disk/by-partlabel/ROOT"
 
 // NewConf parses userdata and returns a new Conf. It returns an error if the
 // userdata can't be parsed as a coreos-cloudinit or ignition configuration.
+// Empty userdata gives an empty cloud-config, which every platform applies.
 func NewConf(userdata string) (*Conf, error) {
+	return newConf(userdata, false)
+}
+
+// newConf is NewConf, but empty userdata gives an empty Ignition config
+// if ignition is set, for platforms passing Ignition configs to machines.
+func newConf(userdata string, ignition bool) (*Conf, error) {
 	c := &Conf{}
 
 	ignc, err := ign.Parse([]byte(userdata))
 	switch err {
 	case ign.ErrEmpty:
-		// empty, noop
-		// XXX(mischief): i would use ignition as the default config,
-		// but there's no way to load it in qemu yet.
-		c.cloudconfig = &defConfig
+		if ignition {
+			c.ignition = &ign.Config{Version: ign.Version}
+		} else {
+			c.cloudconfig = &cci.CloudConfig{}
+		}
 	case ign.ErrCloudConfig:
 		// fall back to cloud-config
 		c.cloudconfig, err = cci.NewCloudConfig(userdata)
@@ -62,6 +70,21 @@ func NewConf(userdata string) (*Conf, error) {
 	return c, nil
 }
 
+// NewIgnitionConf returns a new, empty Ignition configuration.
+func NewIgnitionConf() *Conf {
+	return &Conf{ignition: &ign.Config{Version: ign.Version}}
+}
+
+// NewCloudConfigConf returns a new, empty coreos-cloudinit configuration.
+func NewCloudConfigConf() *Conf {
+	return &Conf{cloudconfig: &cci.CloudConfig{}}
+}
+
+// IsIgnition reports whether c is an Ignition configuration.
+func (c *Conf) IsIgnition() bool {
+	return c.ignition != nil
+}
+
 // String returns the string representation of the userdata in Conf.
 func (c *Conf) String() string {
 	if c.ignition != nil {
@@ -80,43 +103,324 @@ func (c *Conf) String() string {
 	return ""
 }
 
-func (c *Conf) copyKeysIgnition(keys []*agent.Key) {
-	// lookup core user entry
-	var usr *ign.User
-
+// ignitionUser returns the entry for user name, creating it if needed.
+func (c *Conf) ignitionUser(name string) *ign.User {
 	users := c.ignition.Passwd.Users
+	for i := range users {
+		if users[i].Name == name {
+			return &users[i]
+		}
+	}
 
-	for i, u := range users {
-		if u.Name == "core" {
-			usr = &users[i]
+	c.ignition.Passwd.Users = append(users, ign.User{Name: name})
+	return &c.ignition.Passwd.Users[len(c.ignition.Passwd.Users)-1]
+}
+
+// cloudConfigUser returns the entry for user name, creating it if needed.
+func (c *Conf) cloudConfigUser(name string) *cci.User {
+	users := c.cloudconfig.Users
+	for i := range users {
+		if users[i].Name == name {
+			return &users[i]
 		}
 	}
 
-	// doesn't exist yet - create it
-	if usr == nil {
-		u := ign.User{Name: "core"}
-		users = append(users, u)
-		c.ignition.Passwd.Users = users
-		usr = &users[len(users)-1]
+	c.cloudconfig.Users = append(users, cci.User{Name: name})
+	return &c.cloudconfig.Users[len(c.cloudconfig.Users)-1]
+}
+
+// ignitionUnit returns the entry for unit name, creating it if needed.
+func (c *Conf) ignitionUnit(name string) *ign.SystemdUnit {
+	units := c.ignition.Systemd.Units
+	for i := range units {
+		if string(units[i].Name) == name {
+			return &units[i]
+		}
 	}
 
-	for _, key := range keys {
-		usr.SSHAuthorizedKeys = append(usr.SSHAuthorizedKeys, key.String())
+	c.ignition.Systemd.Units = append(units, ign.SystemdUnit{Name: ign.SystemdUnitName(name)})
+	return &c.ignition.Systemd.Units[len(c.ignition.Systemd.Units)-1]
+}
+
+// cloudConfigUnit returns the entry for unit name, creating it if needed.
+func (c *Conf) cloudConfigUnit(name string) *cci.Unit {
+	units := c.cloudconfig.CoreOS.Units
+	for i := range units {
+		if units[i].Name == name {
+			return &units[i]
+		}
 	}
+
+	c.cloudconfig.CoreOS.Units = append(units, cci.Unit{Name: name})
+	return &c.cloudconfig.CoreOS.Units[len(c.cloudconfig.CoreOS.Units)-1]
 }
 
-func (c *Conf) copyKeysCloudConfig(keys []*agent.Key) {
-	for _, key := range keys {
-		c.cloudconfig.SSHAuthorizedKeys = append(c.cloudconfig.SSHAuthorizedKeys, key.String())
+// ignitionFilesystem returns the entry for device, creating it if needed.
+func (c *Conf) ignitionFilesystem(device string) *ign.Filesystem {
+	fss := c.ignition.Storage.Filesystems
+	for i := range fss {
+		if string(fss[i].Device) == device {
+			return &fss[i]
+		}
+	}
+
+	fs := ign.Filesystem{Device: ign.DevicePath(device), Format: "ext4"}
+	c.ignition.Storage.Filesystems = append(fss, fs)
+	return &c.ignition.Storage.Filesystems[len(c.ignition.Storage.Filesystems)-1]
+}
+
+// AddSystemdUnit adds the unit name with the given contents. An empty
+// contents refers to a unit already on the machine. If enable is set the
+// unit is enabled by Ignition, or started by coreos-cloudinit.
+func (c *Conf) AddSystemdUnit(name, contents string, enable bool) {
+	if c.ignition != nil {
+		u := c.ignitionUnit(name)
+		u.Contents = contents
+		u.Enable = enable
+	} else if c.cloudconfig != nil {
+		u := c.cloudConfigUnit(name)
+		u.Content = contents
+		if enable {
+			u.Command = "start"
+		}
+	}
+}
+
+// AddSystemdUnitDropin adds the drop-in name with the given contents to
+// the unit service.
+func (c *Conf) AddSystemdUnitDropin(service, name, contents string) {
+	if c.ignition != nil {
+		u := c.ignitionUnit(service)
+		u.DropIns = append(u.DropIns, ign.SystemdUnitDropIn{
+			Name:     ign.SystemdUnitDropInName(name),
+			Contents: contents,
+		})
+	} else if c.cloudconfig != nil {
+		u := c.cloudConfigUnit(service)
+		u.DropIns = append(u.DropIns, cci.UnitDropIn{
+			Name:    name,
+			Content: contents,
+		})
+	}
+}
+
+// AddFile writes contents to path on the root filesystem with the
+// permissions mode. A file already added at path is replaced.
+func (c *Conf) AddFile(path, contents string, mode int) {
+	if c.ignition != nil {
+		fs := c.ignitionFilesystem(rootDevice)
+		f := ign.File{
+			Path:     path,
+			Contents: contents,
+			Mode:     ign.FileMode(mode),
+		}
+		for i := range fs.Files {
+			if fs.Files[i].Path == path {
+				fs.Files[i] = f
+				return
+			}
+		}
+		fs.Files = append(fs.Files, f)
+	} else if c.cloudconfig != nil {
+		f := cci.File{
+			Path:               path,
+			Content:            contents,
+			RawFilePermissions: fmt.Sprintf("%04o", mode),
+		}
+		for i := range c.cloudconfig.WriteFiles {
+			if c.cloudconfig.WriteFiles[i].Path == path {
+				c.cloudconfig.WriteFiles[i] = f
+				return
+			}
+		}
+		c.cloudconfig.WriteFiles = append(c.cloudconfig.WriteFiles, f)
+	}
+}
+
+// AddUser creates the user name as a member of groups.
+func (c *Conf) AddUser(name string, groups ...string) {
+	if c.ignition != nil {
+		u := c.ignitionUser(name)
+		if u.Create == nil {
+			u.Create = &ign.UserCreate{}
+		}
+		u.Create.Groups = append(u.Create.Groups, groups...)
+	} else if c.cloudconfig != nil {
+		u := c.cloudConfigUser(name)
+		u.Groups = append(u.Groups, groups...)
+	}
+}
+
+// AddAuthorizedKeys adds the SSH public keys to the authorized keys of
+// user name. Keys for a user other than core are only installed if the
+// user exists or is added with AddUser.
+func (c *Conf) AddAuthorizedKeys(name string, keys []string) {
+	if c.ignition != nil {
+		u := c.ignitionUser(name)
+		u.SSHAuthorizedKeys = append(u.SSHAuthorizedKeys, keys...)
+	} else if c.cloudconfig != nil {
+		if name == "core" {
+			c.cloudconfig.SSHAuthorizedKeys = append(c.cloudconfig.SSHAuthorizedKeys, keys...)
+			return
+		}
+		u := c.cloudConfigUser(name)
+		u.SSHAuthorizedKeys = append(u.SSHAuthorizedKeys, keys...)
+	}
+}
+
+// SetHostname sets the hostname of the machine. Ignition has no setting
+// for it, so /etc/hostname is written instead.
+func (c *Conf) SetHostname(name string) {
+	if c.ignition != nil {
+		c.AddFile("/etc/hostname", name, 0644)
+	} else if c.cloudconfig != nil {
+		c.cloudconfig.Hostname = name
 	}
 }
 
 // CopyKeys copies public keys from agent ag into the configuration to the
 // appropriate configuration section for the core user.
 func (c *Conf) CopyKeys(keys []*agent.Key) {
-	if c.ignition != nil {
-		c.copyKeysIgnition(keys)
-	} else if c.cloudconfig != nil {
-		c.copyKeysCloudConfig(keys)
+	var strs []string
+	for _, key := range keys {
+		strs = append(strs, key.String())
+	}
+	c.AddAuthorizedKeys("core", strs)
+}
+
+// Merge adds the contents of other to c, so a test can combine a base
+// configuration with its own additions. Units, users and files that
+// appear in both are combined: drop-ins, groups and keys are appended,
+// and other's contents replace those of c. Both configurations must be
+// of the same kind.
+func (c *Conf) Merge(other *Conf) error {
+	switch {
+	case c.ignition != nil && other.ignition != nil:
+		c.mergeIgnition(other.ignition)
+	case c.cloudconfig != nil && other.cloudconfig != nil:
+		c.mergeCloudConfig(other.cloudconfig)
+	default:
+		return fmt.Errorf("cannot merge Ignition and cloud-config configurations")
+	}
+	return nil
+}
+
+func (c *Conf) mergeIgnition(o *ign.Config) {
+	for _, ou := range o.Systemd.Units {
+		u := c.ignitionUnit(string(ou.Name))
+		if ou.Contents != "" {
+			u.Contents = ou.Contents
+		}
+		u.Enable = u.Enable || ou.Enable
+		u.Mask = u.Mask || ou.Mask
+		u.DropIns = append(u.DropIns, ou.DropIns...)
+	}
+
+	for _, ofs := range o.Storage.Filesystems {
+		fs := c.ignitionFilesystem(string(ofs.Device))
+		if ofs.Format != "" {
+			fs.Format = ofs.Format
+		}
+		if ofs.Create != nil {
+			fs.Create = ofs.Create
+		}
+	files:
+		for _, of := range ofs.Files {
+			for i := range fs.Files {
+				if fs.Files[i].Path == of.Path {
+					fs.Files[i] = of
+					continue files
+				}
+			}
+			fs.Files = append(fs.Files, of)
+		}
+	}
+	c.ignition.Storage.Disks = append(c.ignition.Storage.Disks, o.Storage.Disks...)
+	c.ignition.Storage.Arrays = append(c.ignition.Storage.Arrays, o.Storage.Arrays...)
+	c.ignition.Networkd.Units = append(c.ignition.Networkd.Units, o.Networkd.Units...)
+
+	for _, ou := range o.Passwd.Users {
+		u := c.ignitionUser(ou.Name)
+		if ou.PasswordHash != "" {
+			u.PasswordHash = ou.PasswordHash
+		}
+		u.SSHAuthorizedKeys = append(u.SSHAuthorizedKeys, ou.SSHAuthorizedKeys...)
+		if ou.Create != nil {
+			if u.Create == nil {
+				u.Create = &ign.UserCreate{}
+			}
+			groups := append(u.Create.Groups, ou.Create.Groups...)
+			*u.Create = *ou.Create
+			u.Create.Groups = groups
+		}
+	}
+	c.ignition.Passwd.Groups = append(c.ignition.Passwd.Groups, o.Passwd.Groups...)
+}
+
+func (c *Conf) mergeCloudConfig(o *cci.CloudConfig) {
+	for _, ou := range o.CoreOS.Units {
+		u := c.cloudConfigUnit(ou.Name)
+		if ou.Content != "" {
+			u.Content = ou.Content
+		}
+		if ou.Command != "" {
+			u.Command = ou.Command
+		}
+		u.Enable = u.Enable || ou.Enable
+		u.Mask = u.Mask || ou.Mask
+		u.Runtime = u.Runtime || ou.Runtime
+		u.DropIns = append(u.DropIns, ou.DropIns...)
+	}
+
+files:
+	for _, of := range o.WriteFiles {
+		for i := range c.cloudconfig.WriteFiles {
+			if c.cloudconfig.WriteFiles[i].Path == of.Path {
+				c.cloudconfig.WriteFiles[i] = of
+				continue files
+			}
+		}
+		c.cloudconfig.WriteFiles = append(c.cloudconfig.WriteFiles, of)
+	}
+
+	c.cloudconfig.SSHAuthorizedKeys = append(c.cloudconfig.SSHAuthorizedKeys, o.SSHAuthorizedKeys...)
+	for _, ou := range o.Users {
+		u := c.cloudConfigUser(ou.Name)
+		keys := append(u.SSHAuthorizedKeys, ou.SSHAuthorizedKeys...)
+		groups := append(u.Groups, ou.Groups...)
+		*u = ou
+		u.SSHAuthorizedKeys = keys
+		u.Groups = groups
+	}
+
+	if o.Hostname != "" {
+		c.cloudconfig.Hostname = o.Hostname
+	}
+	if o.ManageEtcHosts != "" {
+		c.cloudconfig.ManageEtcHosts = o.ManageEtcHosts
+	}
+
+	// the remaining coreos sections are taken whole.
+	oc, cc := &o.CoreOS, &c.cloudconfig.CoreOS
+	if !cci.IsZero(oc.Etcd) {
+		cc.Etcd = oc.Etcd
+	}
+	if !cci.IsZero(oc.Etcd2) {
+		cc.Etcd2 = oc.Etcd2
+	}
+	if !cci.IsZero(oc.Flannel) {
+		cc.Flannel = oc.Flannel
+	}
+	if !cci.IsZero(oc.Fleet) {
+		cc.Fleet = oc.Fleet
+	}
+	if !cci.IsZero(oc.Locksmith) {
+		cc.Locksmith = oc.Locksmith
+	}
+	if !cci.IsZero(oc.OEM) {
+		cc.OEM = oc.OEM
+	}
+	if !cci.IsZero(oc.Update) {
+		cc.Update = oc.Update
 	}
 }
@@ -58,3 +58,63 @@ func TestConfCopyKey(t *testing.T) {
 		}
 	}
 }
+
+func TestConfEmpty(t *testing.T) {
+	conf, err := NewConf("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.IsIgnition() {
+		t.Errorf("empty userdata gave an Ignition config")
+	}
+
+	conf, err = newConf("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.IsIgnition() {
+		t.Errorf("empty userdata gave a cloud-config with the Ignition default")
+	}
+}
+
+func TestConfBuilders(t *testing.T) {
+	for _, base := range []*Conf{NewIgnitionConf(), NewCloudConfigConf()} {
+		base.AddSystemdUnit("etcd2.service", "", true)
+		base.AddFile("/etc/motd", "motd-base", 0644)
+		base.AddAuthorizedKeys("core", []string{"ssh-rsa base"})
+
+		extra := NewIgnitionConf()
+		if !base.IsIgnition() {
+			extra = NewCloudConfigConf()
+		}
+		extra.AddSystemdUnitDropin("etcd2.service", "10-opts.conf", "[Service]")
+		extra.AddFile("/etc/motd", "motd-extra", 0600)
+		extra.AddUser("tester", "docker")
+		extra.AddAuthorizedKeys("core", []string{"ssh-rsa extra"})
+		extra.SetHostname("merged")
+
+		if err := base.Merge(extra); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+
+		// parse the result back to make sure it is still valid.
+		conf, err := NewConf(base.String())
+		if err != nil {
+			t.Fatalf("failed to parse merged config: %v\n%s", err, base.String())
+		}
+		str := conf.String()
+
+		for _, want := range []string{"etcd2.service", "10-opts.conf", "motd-extra", "tester", "docker", "ssh-rsa base", "ssh-rsa extra", "merged"} {
+			if !strings.Contains(str, want) {
+				t.Errorf("%q not found in merged config:\n%s", want, str)
+			}
+		}
+		if strings.Contains(str, "motd-base") {
+			t.Errorf("replaced file contents still in merged config:\n%s", str)
+		}
+	}
+
+	if err := NewIgnitionConf().Merge(NewCloudConfigConf()); err == nil {
+		t.Errorf("merging Ignition and cloud-config did not fail")
+	}
+}
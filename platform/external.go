@@ -0,0 +1,557 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	cci "github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/coreos-cloudinit/config"
+	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/network"
+)
+
+// ExternalOptions contains options for running on pre-existing hosts,
+// e.g. bare metal or VMs provisioned by other tooling.
+type ExternalOptions struct {
+	// HostsFile is a JSON list of ExternalHost.
+	HostsFile string
+
+	// Reserve is how many hosts the cluster takes at once when created,
+	// for the machines of a test, so parallel tests never each hold part
+	// of the hosts they need.
+	Reserve int
+}
+
+// ExternalHost is a CoreOS host reachable with SSH.
+type ExternalHost struct {
+	// Address is the host name or IP, optionally with a port.
+	Address string
+
+	// PrivateIP is the address other hosts reach it at, Address by
+	// default.
+	PrivateIP string
+
+	// User logs in with the unencrypted private key in the file Key.
+	// User is "core" by default.
+	User string
+	Key  string
+}
+
+// externalHostTimeout is how long a cluster waits for hosts in use by
+// other clusters to be freed.
+var externalHostTimeout = 10 * time.Minute
+
+// externalPool holds the free hosts of a hosts file, shared by all the
+// clusters using that file so parallel tests never get the same host.
+type externalPool struct {
+	size int
+
+	mu    sync.Mutex
+	free  []ExternalHost
+	freed chan struct{} // closed when hosts are put back
+}
+
+// take removes n free hosts from the pool at once. If fewer are free and
+// wait is set, it waits up to externalHostTimeout for other clusters to
+// free enough; a caller holding hosts must not wait, or clusters waiting
+// for each other's hosts would deadlock.
+func (p *externalPool) take(n int, wait bool) ([]ExternalHost, error) {
+	if n > p.size {
+		return nil, fmt.Errorf("%d external hosts needed, only %d listed", n, p.size)
+	}
+
+	timeout := time.After(externalHostTimeout)
+	for {
+		p.mu.Lock()
+		if len(p.free) >= n {
+			hosts := append([]ExternalHost(nil), p.free[:n]...)
+			p.free = p.free[n:]
+			p.mu.Unlock()
+			return hosts, nil
+		}
+		freed := p.freed
+		p.mu.Unlock()
+
+		if !wait {
+			return nil, fmt.Errorf("no free external host, reserve more hosts for the cluster")
+		}
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return nil, fmt.Errorf("%d external hosts not freed within %v", n, externalHostTimeout)
+		}
+	}
+}
+
+// put returns hosts to the pool.
+func (p *externalPool) put(hosts ...ExternalHost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.free = append(p.free, hosts...)
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+var (
+	externalPoolsMu sync.Mutex
+	externalPools   = make(map[string]*externalPool) // by absolute path of the hosts file
+)
+
+// getExternalPool returns the pool of the hosts file path, filling a new
+// pool with hosts on first use.
+func getExternalPool(path string, hosts []ExternalHost) (*externalPool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	externalPoolsMu.Lock()
+	defer externalPoolsMu.Unlock()
+
+	if pool, ok := externalPools[path]; ok {
+		return pool, nil
+	}
+
+	pool := &externalPool{
+		size:  len(hosts),
+		free:  hosts,
+		freed: make(chan struct{}),
+	}
+	externalPools[path] = pool
+	return pool, nil
+}
+
+type externalCluster struct {
+	mu       sync.Mutex
+	agent    *network.SSHAgent
+	pool     *externalPool
+	reserved []ExternalHost              // taken from the pool, not in use yet
+	machines map[string]*externalMachine // by Address, for hosts in use
+}
+
+type externalMachine struct {
+	ec   *externalCluster
+	host ExternalHost
+
+	// undo is a script stopping the units started by the cloud-config
+	// applied to the host and removing those it wrote.
+	undo string
+}
+
+// NewExternalCluster creates a Cluster of the hosts listed in
+// conf.HostsFile, taking conf.Reserve of them at once. NewMachine hands
+// out a reserved host, or the next free one, rather than creating one;
+// Destroy undoes the units of the host's cloud-config and frees it.
+// Hosts are not otherwise reset between tests.
+func NewExternalCluster(conf ExternalOptions) (Cluster, error) {
+	b, err := ioutil.ReadFile(conf.HostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []ExternalHost
+	if err := json.Unmarshal(b, &hosts); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", conf.HostsFile, err)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts in %s", conf.HostsFile)
+	}
+
+	agent, err := network.NewSSHAgent(&net.Dialer{})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, h := range hosts {
+		if h.User == "" {
+			hosts[i].User = "core"
+		}
+		if h.Key == "" {
+			agent.Close()
+			return nil, fmt.Errorf("no key for %s", h.Address)
+		}
+
+		if err := addKeyFile(agent, h.Key); err != nil {
+			agent.Close()
+			return nil, fmt.Errorf("key of %s: %v", h.Address, err)
+		}
+	}
+
+	pool, err := getExternalPool(conf.HostsFile, hosts)
+	if err != nil {
+		agent.Close()
+		return nil, err
+	}
+
+	var reserved []ExternalHost
+	if conf.Reserve > 0 {
+		if reserved, err = pool.take(conf.Reserve, true); err != nil {
+			agent.Close()
+			return nil, err
+		}
+	}
+
+	return &externalCluster{
+		agent:    agent,
+		pool:     pool,
+		reserved: reserved,
+		machines: make(map[string]*externalMachine),
+	}, nil
+}
+
+// addKeyFile adds the private key in the file path to agent.
+func addKeyFile(agent *network.SSHAgent, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	key, err := ssh.ParseRawPrivateKey(b)
+	if err != nil {
+		return err
+	}
+
+	return agent.Add(key, nil, path)
+}
+
+func (ec *externalCluster) NewMachine(userdata string) (Machine, error) {
+	return ec.newMachine(userdata, standaloneVars())
+}
+
+func (ec *externalCluster) newMachine(userdata string, vars UserdataVars) (Machine, error) {
+	em, err := ec.takeHost()
+	if err != nil {
+		return nil, err
+	}
+
+	vars.Platform = "external"
+	vars.PublicIPv4 = em.IP()
+	vars.PrivateIPv4 = em.PrivateIP()
+
+	ud, err := RenderUserdata(userdata, vars)
+	if err != nil {
+		em.Destroy()
+		return nil, err
+	}
+
+	if err := commonMachineChecks(em); err != nil {
+		em.Destroy()
+		return nil, fmt.Errorf("host %q failed basic checks: %v", em.ID(), err)
+	}
+
+	if err := em.applyUserdata(ud); err != nil {
+		em.Destroy()
+		return nil, err
+	}
+
+	return em, nil
+}
+
+// takeHost hands out a reserved host, or else the next free one. Only a
+// cluster holding no host waits for other clusters to free one, up to
+// externalHostTimeout; it fails at once if the cluster holds every host.
+func (ec *externalCluster) takeHost() (*externalMachine, error) {
+	ec.mu.Lock()
+	if n := len(ec.reserved); n > 0 {
+		em := &externalMachine{ec: ec, host: ec.reserved[n-1]}
+		ec.reserved = ec.reserved[:n-1]
+		ec.machines[em.host.Address] = em
+		ec.mu.Unlock()
+		return em, nil
+	}
+	held := len(ec.machines)
+	ec.mu.Unlock()
+
+	if held == ec.pool.size {
+		return nil, fmt.Errorf("all %d external hosts are in use by this cluster", ec.pool.size)
+	}
+
+	hosts, err := ec.pool.take(1, held == 0)
+	if err != nil {
+		return nil, err
+	}
+
+	em := &externalMachine{ec: ec, host: hosts[0]}
+	ec.mu.Lock()
+	ec.machines[em.host.Address] = em
+	ec.mu.Unlock()
+	return em, nil
+}
+
+func (ec *externalCluster) Machines() []Machine {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	machines := make([]Machine, 0, len(ec.machines))
+	for _, em := range ec.machines {
+		machines = append(machines, em)
+	}
+	return machines
+}
+
+func (ec *externalCluster) EtcdEndpoint() string {
+	return ""
+}
+
+func (ec *externalCluster) GetDiscoveryURL(size int) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("https://discovery.etcd.io/new?size=%d", size))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (ec *externalCluster) SSHAgentSocket() string {
+	return ec.agent.Socket
+}
+
+func (ec *externalCluster) NetNSPath() string {
+	return ""
+}
+
+func (ec *externalCluster) Destroy() error {
+	var err error
+	firstErr := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	for _, m := range ec.Machines() {
+		firstErr(m.Destroy())
+	}
+
+	ec.mu.Lock()
+	ec.pool.put(ec.reserved...)
+	ec.reserved = nil
+	ec.mu.Unlock()
+
+	firstErr(ec.agent.Close())
+	return err
+}
+
+// applyUserdata applies a cloud-config or script with coreos-cloudinit,
+// without rebooting. Ignition configs only apply at first boot, and
+// cloud-configs setting up etcd, fleet or flannel can't be applied again
+// to a host keeping their state, so they are unsupported.
+func (em *externalMachine) applyUserdata(ud string) error {
+	if strings.TrimSpace(ud) == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(ud, "#!") {
+		conf, err := NewConf(ud)
+		if err != nil {
+			return err
+		}
+		if conf.IsIgnition() {
+			return &UnsupportedError{
+				Platform: "external",
+				Reason:   "Ignition configs need a fresh boot",
+			}
+		}
+		if em.undo, err = externalUndo(conf.cloudconfig); err != nil {
+			return err
+		}
+	}
+
+	client, err := em.SSHClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = strings.NewReader(ud)
+	out, err := session.CombinedOutput(`f=$(mktemp) && cat >"$f" && sudo coreos-cloudinit --from-file="$f"; r=$?; rm -f "$f"; exit $r`)
+	if err != nil {
+		return fmt.Errorf("coreos-cloudinit on %s failed: %v: %s", em.ID(), err, out)
+	}
+	return nil
+}
+
+// externalUndo returns a script stopping and disabling the units cc
+// starts or enables, and removing the units and drop-ins it writes, for
+// the next test on the host. It returns an UnsupportedError for
+// cloud-configs that can't be cleanly applied twice.
+func externalUndo(cc *cci.CloudConfig) (string, error) {
+	co := cc.CoreOS
+	for _, c := range []struct {
+		name string
+		set  bool
+	}{
+		{"etcd", !reflect.DeepEqual(co.Etcd, cci.Etcd{})},
+		{"etcd2", !reflect.DeepEqual(co.Etcd2, cci.Etcd2{})},
+		{"fleet", !reflect.DeepEqual(co.Fleet, cci.Fleet{})},
+		{"flannel", !reflect.DeepEqual(co.Flannel, cci.Flannel{})},
+	} {
+		if c.set {
+			return "", &UnsupportedError{
+				Platform: "external",
+				Reason:   fmt.Sprintf("%s keeps its state on the host, its config can't be applied twice", c.name),
+			}
+		}
+	}
+
+	var stop, remove []string
+	for _, u := range co.Units {
+		dir := "/etc/systemd/system"
+		if u.Runtime {
+			dir = "/run/systemd/system"
+		}
+
+		switch u.Command {
+		case "start", "restart", "reload", "try-restart", "reload-or-restart", "reload-or-try-restart":
+			stop = append(stop, "sudo systemctl stop "+shellQuote(u.Name))
+		}
+		if u.Enable {
+			stop = append(stop, "sudo systemctl disable "+shellQuote(u.Name))
+		}
+		if u.Content != "" || u.Mask {
+			remove = append(remove, "sudo rm -f "+shellQuote(path.Join(dir, u.Name)))
+		}
+		for _, d := range u.DropIns {
+			if d.Content != "" {
+				remove = append(remove, "sudo rm -f "+shellQuote(path.Join(dir, u.Name+".d", d.Name)))
+			}
+		}
+	}
+	if len(remove) > 0 {
+		remove = append(remove, "sudo systemctl daemon-reload")
+	}
+
+	cmds := append(stop, remove...)
+	if len(cmds) == 0 {
+		return "", nil
+	}
+	return "r=0\n" + strings.Join(cmds, " || r=1\n") + " || r=1\nexit $r\n", nil
+}
+
+// shellQuote quotes s for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (em *externalMachine) ID() string {
+	return em.host.Address
+}
+
+func (em *externalMachine) IP() string {
+	if host, _, err := net.SplitHostPort(em.host.Address); err == nil {
+		return host
+	}
+	return em.host.Address
+}
+
+func (em *externalMachine) PrivateIP() string {
+	if em.host.PrivateIP != "" {
+		return em.host.PrivateIP
+	}
+	return em.IP()
+}
+
+func (em *externalMachine) IPs() []string {
+	if em.PrivateIP() == em.IP() {
+		return []string{em.IP()}
+	}
+	return []string{em.IP(), em.PrivateIP()}
+}
+
+func (em *externalMachine) SSHClient() (*ssh.Client, error) {
+	return em.ec.agent.NewUserClient(em.host.User, em.host.Address)
+}
+
+func (em *externalMachine) SSH(cmd string) ([]byte, error) {
+	client, err := em.SSHClient()
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	defer session.Close()
+
+	session.Stderr = os.Stderr
+	out, err := session.Output(cmd)
+	out = bytes.TrimSpace(out)
+	return out, err
+}
+
+// ConsoleOutput returns nothing, the platform has no access to the
+// consoles of the hosts.
+func (em *externalMachine) ConsoleOutput() (string, error) {
+	return "", nil
+}
+
+func (em *externalMachine) Reboot() error {
+	return rebootMachine(em, sshRetries)
+}
+
+func (em *externalMachine) WaitForBoot(bootID string) error {
+	return waitForBoot(em, bootID, sshRetries)
+}
+
+// Destroy undoes the units of the host's cloud-config and frees the host
+// for another machine, leaving it running.
+func (em *externalMachine) Destroy() error {
+	em.ec.mu.Lock()
+	if _, ok := em.ec.machines[em.host.Address]; !ok {
+		em.ec.mu.Unlock()
+		return nil
+	}
+	delete(em.ec.machines, em.host.Address)
+	em.ec.mu.Unlock()
+
+	var err error
+	if em.undo != "" {
+		if out, e := em.SSH(em.undo); e != nil {
+			err = fmt.Errorf("undoing the cloud-config of %s: %v: %s", em.ID(), e, out)
+		}
+	}
+
+	em.ec.pool.put(em.host)
+	return err
+}
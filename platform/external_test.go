@@ -0,0 +1,265 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExternalCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hostsFile := filepath.Join(dir, "hosts.json")
+	hosts := fmt.Sprintf(`[{"Address": "192.0.2.1:2222", "PrivateIP": "10.0.0.1", "Key": %q}]`, keyFile)
+	if err := ioutil.WriteFile(hostsFile, []byte(hosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewExternalCluster(ExternalOptions{HostsFile: hostsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	ec := c.(*externalCluster)
+
+	em, err := ec.takeHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if em.host.User != "core" || em.IP() != "192.0.2.1" || em.PrivateIP() != "10.0.0.1" {
+		t.Errorf("unexpected host %+v, IP %s, PrivateIP %s", em.host, em.IP(), em.PrivateIP())
+	}
+
+	if _, err := ec.takeHost(); err == nil {
+		t.Errorf("took a host in use")
+	} else if _, ok := err.(*UnsupportedError); ok {
+		t.Errorf("running out of hosts returned UnsupportedError, skipping the test")
+	}
+
+	// another cluster of the same file waits for the host
+	c2, err := NewExternalCluster(ExternalOptions{HostsFile: hostsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Destroy()
+	ec2 := c2.(*externalCluster)
+
+	defer func(d time.Duration) { externalHostTimeout = d }(externalHostTimeout)
+	externalHostTimeout = 10 * time.Millisecond
+	if _, err := ec2.takeHost(); err == nil {
+		t.Errorf("another cluster took a host in use")
+	}
+
+	externalHostTimeout = time.Minute
+	taken := make(chan error, 1)
+	go func() {
+		em2, err := ec2.takeHost()
+		if err == nil {
+			em2.Destroy()
+		}
+		taken <- err
+	}()
+
+	// neither needs to reach the host
+	if err := em.applyUserdata(""); err != nil {
+		t.Errorf("applying empty userdata: %v", err)
+	}
+	if err := em.applyUserdata(`{"ignitionVersion": 1}`); err == nil {
+		t.Errorf("applied an Ignition config")
+	} else if _, ok := err.(*UnsupportedError); !ok {
+		t.Errorf("applying an Ignition config returned %v, want UnsupportedError", err)
+	}
+
+	em.Destroy()
+	if len(c.Machines()) != 0 {
+		t.Errorf("host still in use after Destroy")
+	}
+	if err := <-taken; err != nil {
+		t.Errorf("waiting for a freed host: %v", err)
+	}
+	if _, err := ec.takeHost(); err != nil {
+		t.Errorf("freed host not available: %v", err)
+	}
+}
+
+func TestExternalClusterReserve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hostsFile := filepath.Join(dir, "hosts.json")
+	hosts := fmt.Sprintf(`[{"Address": "192.0.2.1", "Key": %[1]q}, {"Address": "192.0.2.2", "Key": %[1]q}]`, keyFile)
+	if err := ioutil.WriteFile(hostsFile, []byte(hosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewExternalCluster(ExternalOptions{HostsFile: hostsFile, Reserve: 3}); err == nil {
+		t.Errorf("reserved more hosts than listed")
+	}
+
+	c, err := NewExternalCluster(ExternalOptions{HostsFile: hostsFile, Reserve: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := c.(*externalCluster)
+	em, err := ec.takeHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := NewExternalCluster(ExternalOptions{HostsFile: hostsFile, Reserve: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cluster holding a host doesn't wait for more.
+	defer func(d time.Duration) { externalHostTimeout = d }(externalHostTimeout)
+	externalHostTimeout = time.Minute
+	start := time.Now()
+	if _, err := ec.takeHost(); err == nil {
+		t.Errorf("took a host reserved by another cluster")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("a cluster holding a host waited for another")
+	}
+
+	// a cluster needing both hosts gets them together.
+	created := make(chan error, 1)
+	go func() {
+		c3, err := NewExternalCluster(ExternalOptions{HostsFile: hostsFile, Reserve: 2})
+		if err == nil {
+			if n := len(c3.(*externalCluster).reserved); n != 2 {
+				err = fmt.Errorf("reserved %d hosts, want 2", n)
+			}
+			c3.Destroy()
+		}
+		created <- err
+	}()
+
+	em.Destroy()
+	if err := c.Destroy(); err != nil {
+		t.Error(err)
+	}
+	if err := c2.Destroy(); err != nil {
+		t.Error(err)
+	}
+	if err := <-created; err != nil {
+		t.Errorf("reserving all hosts: %v", err)
+	}
+}
+
+func TestExternalUndo(t *testing.T) {
+	for _, tt := range []struct {
+		userdata string
+		undo     string
+	}{
+		{"#cloud-config", ""},
+		{`#cloud-config
+coreos:
+  units:
+    - name: foo.service
+      command: start
+      enable: true
+      content: |
+        [Service]
+        ExecStart=/bin/true
+    - name: docker.service
+      runtime: true
+      drop_ins:
+        - name: 50-opts.conf
+          content: |
+            [Service]
+            Environment=FOO=1
+`, `r=0
+sudo systemctl stop 'foo.service' || r=1
+sudo systemctl disable 'foo.service' || r=1
+sudo rm -f '/etc/systemd/system/foo.service' || r=1
+sudo rm -f '/run/systemd/system/docker.service.d/50-opts.conf' || r=1
+sudo systemctl daemon-reload || r=1
+exit $r
+`},
+	} {
+		conf, err := NewConf(tt.userdata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		undo, err := externalUndo(conf.cloudconfig)
+		if err != nil {
+			t.Errorf("%q: %v", tt.userdata, err)
+		} else if undo != tt.undo {
+			t.Errorf("%q: got undo script %q, want %q", tt.userdata, undo, tt.undo)
+		}
+	}
+
+	conf, err := NewConf("#cloud-config\ncoreos:\n  etcd2:\n    discovery: https://discovery.etcd.io/x\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := externalUndo(conf.cloudconfig); err == nil {
+		t.Errorf("etcd2 config accepted")
+	} else if _, ok := err.(*UnsupportedError); !ok {
+		t.Errorf("etcd2 config returned %v, want UnsupportedError", err)
+	}
+}
+
+func TestExternalClusterNoKey(t *testing.T) {
+	f, err := ioutil.TempFile("", "external-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`[{"Address": "192.0.2.1"}]`)
+	f.Close()
+
+	if _, err := NewExternalCluster(ExternalOptions{HostsFile: f.Name()}); err == nil {
+		t.Errorf("created a cluster with a host without key")
+	}
+}
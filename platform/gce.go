@@ -18,11 +18,13 @@ package platform
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -44,10 +46,16 @@ type GCEOptions struct {
 	ServiceAuth bool
 }
 
+// gceRunKey is the metadata key tagging the instances created by kola
+// with the run ID of their cluster, see gceCluster.Destroy and
+// GCEGarbageCollect.
+const gceRunKey = "kola-run"
+
 type gceCluster struct {
 	api      *compute.Service
 	sshAgent *network.SSHAgent
 	conf     *GCEOptions
+	runID    string // tags the cluster's instances, and is part of their names
 	machines map[string]*gceMachine
 	mu       sync.Mutex // protects concurrent access to machines
 }
@@ -76,9 +84,15 @@ func NewGCECluster(conf GCEOptions) (Cluster, error) {
 		return nil, err
 	}
 
+	runID := make([]byte, 4)
+	if _, err := rand.Read(runID); err != nil {
+		return nil, err
+	}
+
 	gc := &gceCluster{
 		api:      api,
 		conf:     &conf,
+		runID:    fmt.Sprintf("%x", runID),
 		machines: make(map[string]*gceMachine),
 	}
 
@@ -95,27 +109,83 @@ func (gc *gceCluster) EtcdEndpoint() string {
 }
 
 func (gc *gceCluster) Machines() []Machine {
-	machines := make([]Machine, 0, len(gc.machines))
-
 	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	machines := make([]Machine, 0, len(gc.machines))
 	for _, m := range gc.machines {
 		machines = append(machines, m)
 	}
-	gc.mu.Unlock()
-
 	return machines
 }
 
+// Destroy deletes the machines of the cluster, then any instances and
+// disks of its run left behind by failures in NewMachine.
 func (gc *gceCluster) Destroy() error {
-	for _, gm := range gc.machines {
-		gm.Destroy()
+	var err error
+	firstErr := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
 	}
-	gc.sshAgent.Close()
-	return nil
+
+	// instances being deleted are still listed, those whose delete
+	// failed get another try from the reaper.
+	destroyed := make(map[string]bool)
+	failed := make(map[string]error)
+	for _, m := range gc.Machines() {
+		if err := m.Destroy(); err != nil {
+			failed["instance "+m.ID()] = err
+		} else {
+			destroyed[m.ID()] = true
+		}
+	}
+
+	leaked, reapErr := gceReap(gc.api, gc.conf.Project, func(inst *compute.Instance) bool {
+		run, _ := gceMetadata(inst, gceRunKey)
+		return run == gc.runID && !destroyed[inst.Name]
+	}, func(disk *compute.Disk) bool {
+		return strings.HasPrefix(disk.Name, gc.namePrefix())
+	})
+	for _, name := range leaked {
+		if _, ok := failed[name]; ok {
+			delete(failed, name)
+			continue
+		}
+		plog.Noticef("deleted leaked %s", name)
+	}
+	for _, e := range failed {
+		firstErr(e)
+	}
+	firstErr(reapErr)
+
+	firstErr(gc.sshAgent.Close())
+	return err
+}
+
+// namePrefix returns the prefix of the names of the cluster's instances
+// and their disks.
+func (gc *gceCluster) namePrefix() string {
+	return gc.conf.BaseName + "-" + gc.runID + "-"
 }
 
 // Calling in parallel is ok
 func (gc *gceCluster) NewMachine(userdata string) (Machine, error) {
+	return gc.newMachine(userdata, standaloneVars())
+}
+
+func (gc *gceCluster) newMachine(userdata string, vars UserdataVars) (Machine, error) {
+	// addresses are only known once the instance is running, so
+	// leave them to coreos-cloudinit.
+	vars.Platform = "gce"
+	vars.PublicIPv4 = "$public_ipv4"
+	vars.PrivateIPv4 = "$private_ipv4"
+
+	userdata, err := RenderUserdata(userdata, vars)
+	if err != nil {
+		return nil, err
+	}
+
 	conf, err := NewConf(userdata)
 	if err != nil {
 		return nil, err
@@ -128,8 +198,25 @@ func (gc *gceCluster) NewMachine(userdata string) (Machine, error) {
 
 	conf.CopyKeys(keys)
 
-	// Create gce VM and wait for creation to succeed.
-	gm, err := GCECreateVM(gc.api, gc.conf, conf.String())
+	// the cluster's keys are also given as metadata, so the machine is
+	// reachable even if it fails to apply its userdata.
+	var sshKeys []string
+	for _, key := range keys {
+		sshKeys = append(sshKeys, "core:"+key.String())
+	}
+	metadata := []*compute.MetadataItems{
+		{Key: gceRunKey, Value: gc.runID},
+		{Key: "sshKeys", Value: strings.Join(sshKeys, "\n")},
+	}
+
+	name, err := newName(gc.namePrefix())
+	if err != nil {
+		return nil, fmt.Errorf("Failed allocating unique name for vm: %v\n", err)
+	}
+
+	// Create gce VM and wait for creation to succeed. Instances left
+	// behind on failure are deleted by Destroy.
+	gm, err := gceCreateVM(gc.api, gc.conf, name, conf.String(), metadata)
 	if err != nil {
 		return nil, err
 	}
@@ -173,6 +260,18 @@ func (gm *gceMachine) PrivateIP() string {
 	return gm.intIP
 }
 
+func (gc *gceCluster) SSHAgentSocket() string {
+	return gc.sshAgent.Socket
+}
+
+func (gc *gceCluster) NetNSPath() string {
+	return ""
+}
+
+func (gm *gceMachine) IPs() []string {
+	return []string{gm.extIP, gm.intIP}
+}
+
 func (gm *gceMachine) SSHClient() (*ssh.Client, error) {
 	sshClient, err := gm.gc.sshAgent.NewClient(gm.IP())
 	if err != nil {
@@ -202,6 +301,27 @@ func (gm *gceMachine) SSH(cmd string) ([]byte, error) {
 	return out, err
 }
 
+func (gm *gceMachine) ConsoleOutput() (string, error) {
+	if gm.gc == nil {
+		return "", fmt.Errorf("machine %s is not part of a cluster", gm.name)
+	}
+
+	out, err := gm.gc.api.Instances.GetSerialPortOutput(gm.gc.conf.Project, gm.gc.conf.Zone, gm.name).Do()
+	if err != nil {
+		return "", err
+	}
+
+	return out.Contents, nil
+}
+
+func (gm *gceMachine) Reboot() error {
+	return rebootMachine(gm, sshRetries)
+}
+
+func (gm *gceMachine) WaitForBoot(bootID string) error {
+	return waitForBoot(gm, bootID, sshRetries)
+}
+
 func (gm *gceMachine) Destroy() error {
 	_, err := gm.gc.api.Instances.Delete(gm.gc.conf.Project, gm.gc.conf.Zone, gm.name).Do()
 	if err != nil {
@@ -217,15 +337,22 @@ func (gm *gceMachine) Destroy() error {
 
 func GCECreateVM(api *compute.Service, opts *GCEOptions, userdata string) (*gceMachine, error) {
 	// generate name
-	name, err := newName(opts)
+	name, err := newName(opts.BaseName + "-")
 	if err != nil {
 		return nil, fmt.Errorf("Failed allocating unique name for vm: %v\n", err)
 	}
 
+	return gceCreateVM(api, opts, name, userdata, nil)
+}
+
+// gceCreateVM creates the instance name with metadata in addition to the
+// userdata.
+func gceCreateVM(api *compute.Service, opts *GCEOptions, name, userdata string, metadata []*compute.MetadataItems) (*gceMachine, error) {
 	instance, err := gceMakeInstance(opts, userdata, name)
 	if err != nil {
 		return nil, err
 	}
+	instance.Metadata.Items = append(instance.Metadata.Items, metadata...)
 
 	// request instance
 	op, err := api.Instances.Insert(opts.Project, opts.Zone, instance).Do()
@@ -335,6 +462,114 @@ func GCEListVMs(api *compute.Service, opts *GCEOptions, prefix string) ([]Machin
 	return vms, nil
 }
 
+// GCEGarbageCollect deletes the instances kola created in any zone of
+// project more than age ago, and the disks as old named with prefix, e.g.
+// kola's BaseName, that were left without their instance. It returns
+// what it deleted.
+func GCEGarbageCollect(api *compute.Service, project, prefix string, age time.Duration) ([]string, error) {
+	older := func(timestamp string) bool {
+		t, err := time.Parse(time.RFC3339, timestamp)
+		return err == nil && time.Since(t) > age
+	}
+
+	return gceReap(api, project, func(inst *compute.Instance) bool {
+		_, ok := gceMetadata(inst, gceRunKey)
+		return ok && older(inst.CreationTimestamp)
+	}, func(disk *compute.Disk) bool {
+		return strings.HasPrefix(disk.Name, prefix) && older(disk.CreationTimestamp)
+	})
+}
+
+// gceReap deletes the instances of project accepted by instMatch, in any
+// zone, and the disks accepted by diskMatch that have no instance of the
+// same name, e.g. those of instances that failed to be created. Disks of
+// deleted instances go with them. It returns what it deleted; failing
+// deletes are reported together once everything else was tried.
+func gceReap(api *compute.Service, project string, instMatch func(*compute.Instance) bool, diskMatch func(*compute.Disk) bool) ([]string, error) {
+	var deleted, failed []string
+	instances := make(map[string]bool) // by zone/name
+
+	// reapErr returns the failed deletes, with err if not nil.
+	reapErr := func(err error) error {
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		return errors.New(strings.Join(failed, "; "))
+	}
+
+	for token := ""; ; {
+		list, err := api.Instances.AggregatedList(project).PageToken(token).Do()
+		if err != nil {
+			// without all instances, disks in use can't be told apart.
+			return deleted, reapErr(fmt.Errorf("listing instances: %v", err))
+		}
+
+		for _, scoped := range list.Items {
+			for _, inst := range scoped.Instances {
+				zone := path.Base(inst.Zone)
+				instances[zone+"/"+inst.Name] = true
+				if !instMatch(inst) {
+					continue
+				}
+
+				if _, err := api.Instances.Delete(project, zone, inst.Name).Do(); err != nil {
+					failed = append(failed, fmt.Sprintf("deleting instance %s: %v", inst.Name, err))
+					continue
+				}
+				deleted = append(deleted, "instance "+inst.Name)
+			}
+		}
+
+		if token = list.NextPageToken; token == "" {
+			break
+		}
+	}
+
+	for token := ""; ; {
+		list, err := api.Disks.AggregatedList(project).PageToken(token).Do()
+		if err != nil {
+			return deleted, reapErr(fmt.Errorf("listing disks: %v", err))
+		}
+
+		for _, scoped := range list.Items {
+			for _, disk := range scoped.Disks {
+				zone := path.Base(disk.Zone)
+				if instances[zone+"/"+disk.Name] || !diskMatch(disk) {
+					continue
+				}
+
+				if _, err := api.Disks.Delete(project, zone, disk.Name).Do(); err != nil {
+					failed = append(failed, fmt.Sprintf("deleting disk %s: %v", disk.Name, err))
+					continue
+				}
+				deleted = append(deleted, "disk "+disk.Name)
+			}
+		}
+
+		if token = list.NextPageToken; token == "" {
+			break
+		}
+	}
+
+	return deleted, reapErr(nil)
+}
+
+// gceMetadata returns the metadata value of inst for key.
+func gceMetadata(inst *compute.Instance, key string) (string, bool) {
+	if inst.Metadata == nil {
+		return "", false
+	}
+	for _, item := range inst.Metadata.Items {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return "", false
+}
+
 func GCEListImages(client *http.Client, proj, prefix string) ([]string, error) {
 	var images []string
 	computeService, err := compute.New(client)
@@ -452,17 +687,15 @@ OpLoop:
 
 }
 
-// newName returns a random name prefixed by BaseName
-func newName(opts *GCEOptions) (string, error) {
-	base := opts.BaseName
-
+// newName returns a random name starting with prefix
+func newName(prefix string) (string, error) {
 	randBytes := make([]byte, 16) //128 bits of entropy
 	_, err := rand.Read(randBytes)
 	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%v-%x", base, randBytes), nil
+	return fmt.Sprintf("%v%x", prefix, randBytes), nil
 }
 
 // Taken from: https://github.com/golang/build/blob/master/buildlet/gce.go#L323
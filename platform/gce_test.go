@@ -0,0 +1,230 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/google.golang.org/api/compute/v1"
+
+	"github.com/coreos/mantle/network"
+)
+
+func TestGCEGarbageCollect(t *testing.T) {
+	old := time.Now().Add(-10 * time.Hour).Format(time.RFC3339)
+	recent := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	zone := "https://www.googleapis.com/compute/v1/projects/p/zones/z"
+	tagged := &compute.Metadata{Items: []*compute.MetadataItems{{Key: gceRunKey, Value: "0123abcd"}}}
+
+	instances := compute.InstanceAggregatedList{Items: map[string]compute.InstancesScopedList{
+		"zones/z": {Instances: []*compute.Instance{
+			{Name: "kola-old", Zone: zone, CreationTimestamp: old, Metadata: tagged},
+			{Name: "kola-recent", Zone: zone, CreationTimestamp: recent, Metadata: tagged},
+			{Name: "kola-untagged", Zone: zone, CreationTimestamp: old},
+		}},
+	}}
+	disks := compute.DiskAggregatedList{Items: map[string]compute.DisksScopedList{
+		"zones/z": {Disks: []*compute.Disk{
+			{Name: "kola-old", Zone: zone, CreationTimestamp: old},
+			{Name: "kola-untagged", Zone: zone, CreationTimestamp: old},
+			{Name: "kola-leaked", Zone: zone, CreationTimestamp: old},
+			{Name: "kola-leaked-recent", Zone: zone, CreationTimestamp: recent},
+			{Name: "other", Zone: zone, CreationTimestamp: old},
+		}},
+	}}
+
+	var deletes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{} = &compute.Operation{Name: "op"}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/p/aggregated/instances":
+			v = instances
+		case r.Method == "GET" && r.URL.Path == "/p/aggregated/disks":
+			v = disks
+		case r.Method == "DELETE":
+			deletes = append(deletes, r.URL.Path)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	defer srv.Close()
+
+	api, err := compute.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.BasePath = srv.URL + "/"
+
+	deleted, err := GCEGarbageCollect(api, "p", "kola-", 5*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"instance kola-old", "disk kola-leaked"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+
+	sort.Strings(deletes)
+	if want := []string{"/p/zones/z/disks/kola-leaked", "/p/zones/z/instances/kola-old"}; !reflect.DeepEqual(deletes, want) {
+		t.Errorf("DELETE requests %v, want %v", deletes, want)
+	}
+}
+
+func TestGCEReapContinuesAfterFailedDelete(t *testing.T) {
+	zone := "https://www.googleapis.com/compute/v1/projects/p/zones/z"
+	old := time.Now().Add(-10 * time.Hour).Format(time.RFC3339)
+	tagged := &compute.Metadata{Items: []*compute.MetadataItems{{Key: gceRunKey, Value: "0123abcd"}}}
+
+	instances := compute.InstanceAggregatedList{Items: map[string]compute.InstancesScopedList{
+		"zones/z": {Instances: []*compute.Instance{
+			{Name: "kola-a", Zone: zone, CreationTimestamp: old, Metadata: tagged},
+			{Name: "kola-b", Zone: zone, CreationTimestamp: old, Metadata: tagged},
+		}},
+	}}
+	disks := compute.DiskAggregatedList{Items: map[string]compute.DisksScopedList{
+		"zones/z": {Disks: []*compute.Disk{
+			{Name: "kola-a", Zone: zone, CreationTimestamp: old},
+			{Name: "kola-leaked", Zone: zone, CreationTimestamp: old},
+		}},
+	}}
+
+	// every delete of kola-a fails, the rest must still go.
+	var deletes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{} = &compute.Operation{Name: "op"}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/p/aggregated/instances":
+			v = instances
+		case r.Method == "GET" && r.URL.Path == "/p/aggregated/disks":
+			v = disks
+		case r.Method == "DELETE":
+			deletes = append(deletes, r.URL.Path)
+			if r.URL.Path == "/p/zones/z/instances/kola-a" {
+				http.Error(w, "backend error", http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	defer srv.Close()
+
+	api, err := compute.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.BasePath = srv.URL + "/"
+
+	deleted, err := GCEGarbageCollect(api, "p", "kola-", 5*time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "kola-a") {
+		t.Errorf("got error %v, want the failed delete of kola-a", err)
+	}
+
+	if want := []string{"instance kola-b", "disk kola-leaked"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+
+	// the disk of kola-a is kept as the instance still exists.
+	sort.Strings(deletes)
+	want := []string{"/p/zones/z/disks/kola-leaked", "/p/zones/z/instances/kola-a", "/p/zones/z/instances/kola-b"}
+	if !reflect.DeepEqual(deletes, want) {
+		t.Errorf("DELETE requests %v, want %v", deletes, want)
+	}
+}
+
+func TestGCEDestroyRetriesFailedDeletes(t *testing.T) {
+	zone := "https://www.googleapis.com/compute/v1/projects/p/zones/z"
+	tagged := &compute.Metadata{Items: []*compute.MetadataItems{{Key: gceRunKey, Value: "0123abcd"}}}
+	now := time.Now().Format(time.RFC3339)
+
+	// both instances are still listed, the first delete of kola-b fails.
+	instances := compute.InstanceAggregatedList{Items: map[string]compute.InstancesScopedList{
+		"zones/z": {Instances: []*compute.Instance{
+			{Name: "kola-0123abcd-a", Zone: zone, CreationTimestamp: now, Metadata: tagged},
+			{Name: "kola-0123abcd-b", Zone: zone, CreationTimestamp: now, Metadata: tagged},
+		}},
+	}}
+
+	var deletes []string
+	failed := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{} = &compute.Operation{Name: "op"}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/p/aggregated/instances":
+			v = instances
+		case r.Method == "GET" && r.URL.Path == "/p/aggregated/disks":
+			v = compute.DiskAggregatedList{}
+		case r.Method == "DELETE":
+			deletes = append(deletes, r.URL.Path)
+			if r.URL.Path == "/p/zones/z/instances/kola-0123abcd-b" && !failed[r.URL.Path] {
+				failed[r.URL.Path] = true
+				http.Error(w, "backend error", http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	defer srv.Close()
+
+	api, err := compute.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.BasePath = srv.URL + "/"
+
+	agent, err := network.NewSSHAgent(&net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gc := &gceCluster{
+		api:      api,
+		sshAgent: agent,
+		conf:     &GCEOptions{Project: "p", Zone: "z", BaseName: "kola"},
+		runID:    "0123abcd",
+		machines: make(map[string]*gceMachine),
+	}
+	gc.machines["kola-0123abcd-b"] = &gceMachine{gc: gc, name: "kola-0123abcd-b"}
+	gc.machines["kola-0123abcd-a"] = &gceMachine{gc: gc, name: "kola-0123abcd-a"}
+
+	if err := gc.Destroy(); err != nil {
+		t.Errorf("Destroy failed although the reaper deleted the instance: %v", err)
+	}
+
+	var retried int
+	for _, d := range deletes {
+		if d == "/p/zones/z/instances/kola-0123abcd-b" {
+			retried++
+		}
+	}
+	if retried != 2 {
+		t.Errorf("DELETE requests %v, want kola-0123abcd-b deleted again by the reaper", deletes)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/kola/native"
+)
+
+// koletAgent is a kolet process running native functions on a single
+// machine over one long-lived SSH session.
+type koletAgent struct {
+	mu      sync.Mutex
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stderr  syncBuffer
+	enc     *json.Encoder
+	dec     *json.Decoder
+	nextID  int
+}
+
+// syncBuffer is a bytes.Buffer safe to write from the SSH session's
+// copying goroutine while call reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newKoletAgent(m Machine) (*koletAgent, error) {
+	client, err := m.SSHClient()
+	if err != nil {
+		return nil, fmt.Errorf("kolet SSH client: %v", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("kolet SSH session: %v", err)
+	}
+
+	a := &koletAgent{
+		client:  client,
+		session: session,
+	}
+
+	// anything kolet prints before the agent is running, such as a
+	// missing binary, ends up on stderr.
+	session.Stderr = &a.stderr
+
+	a.stdin, err = session.StdinPipe()
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	a.enc = json.NewEncoder(a.stdin)
+	a.dec = json.NewDecoder(stdout)
+
+	if err := session.Start("./kolet agent"); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("kolet agent: %v", err)
+	}
+
+	return a, nil
+}
+
+func (a *koletAgent) call(test, fn string, args []string) (*native.Result, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.nextID++
+	id := a.nextID
+
+	req := &native.Request{
+		ID:   id,
+		Test: test,
+		Func: fn,
+		Args: args,
+	}
+	if err := a.enc.Encode(req); err != nil {
+		return nil, fmt.Errorf("kolet agent: %v", err)
+	}
+
+	var output bytes.Buffer
+	for {
+		var ev native.Event
+		if err := a.dec.Decode(&ev); err != nil {
+			if stderr := strings.TrimSpace(a.stderr.String()); stderr != "" {
+				return nil, fmt.Errorf("kolet agent: %v: %s", err, stderr)
+			}
+			return nil, fmt.Errorf("kolet agent: %v", err)
+		}
+
+		// output written between calls is not attributed to any
+		// function, so just log it.
+		if ev.ID != id {
+			plog.Debugf("kolet: %s", ev.Log)
+			continue
+		}
+
+		if ev.Result != nil {
+			ev.Result.Output = output.String()
+			return ev.Result, nil
+		}
+
+		plog.Debugf("%s: %s", fn, ev.Log)
+		output.WriteString(ev.Log)
+		output.WriteByte('\n')
+	}
+}
+
+// Close stops kolet by closing its input and tears down the SSH session.
+func (a *koletAgent) Close() error {
+	if a.stdin != nil {
+		a.stdin.Close()
+	}
+	a.session.Close()
+	return a.client.Close()
+}
+
+// koletAgents tracks the agent of each machine in a TestCluster.
+type koletAgents struct {
+	mu     sync.Mutex
+	agents map[string]*koletAgent
+}
+
+func (k *koletAgents) get(m Machine) (*koletAgent, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if a, ok := k.agents[m.ID()]; ok {
+		return a, nil
+	}
+
+	a, err := newKoletAgent(m)
+	if err != nil {
+		return nil, err
+	}
+
+	k.agents[m.ID()] = a
+	return a, nil
+}
+
+// drop forgets the agent of m, e.g. after its session broke.
+func (k *koletAgents) drop(m Machine) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if a, ok := k.agents[m.ID()]; ok {
+		a.Close()
+		delete(k.agents, m.ID())
+	}
+}
+
+func (k *koletAgents) closeAll() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var err error
+	for id, a := range k.agents {
+		if e := a.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(k.agents, id)
+	}
+	return err
+}
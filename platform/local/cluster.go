@@ -17,10 +17,13 @@ package local
 import (
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/vishvananda/netlink"
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/vishvananda/netns"
@@ -32,24 +35,46 @@ import (
 type LocalCluster struct {
 	Dnsmasq    *Dnsmasq
 	NTPServer  *ntp.Server
+	PXE        *PXEServer
+	FileServer *FileServer
+	Registry   *Registry
 	SSHAgent   *network.SSHAgent
 	SimpleEtcd *SimpleEtcd
 	nshandle   netns.NsHandle
+
+	// state of the network faults, see faults.go
+	faultMu   sync.Mutex
+	netemTaps map[string]bool
+
+	uplink *uplink // see topology.go
+
+	dnsMu sync.Mutex // protects the records of Dnsmasq, see dns.go
+	pxeMu sync.Mutex // protects starting PXE
 }
 
-func NewLocalCluster() (*LocalCluster, error) {
-	lc := &LocalCluster{}
+// NewLocalCluster creates a network namespace running the services of
+// the cluster: dnsmasq, etcd, NTP, the file server and the Docker
+// registry. The PXE server is only started by StartPXE.
+func NewLocalCluster() (_ *LocalCluster, err error) {
+	lc := &LocalCluster{
+		netemTaps: make(map[string]bool),
+	}
 
-	var err error
 	lc.nshandle, err = NsCreate()
 	if err != nil {
 		return nil, err
 	}
 
+	// on failure, tear down what was started so far.
+	defer func() {
+		if err != nil {
+			lc.Destroy()
+		}
+	}()
+
 	dialer := NewNsDialer(lc.nshandle)
 	lc.SSHAgent, err = network.NewSSHAgent(dialer)
 	if err != nil {
-		lc.nshandle.Close()
 		return nil, err
 	}
 
@@ -62,29 +87,72 @@ func NewLocalCluster() (*LocalCluster, error) {
 
 	lc.Dnsmasq, err = NewDnsmasq()
 	if err != nil {
-		lc.nshandle.Close()
 		return nil, err
 	}
 
 	lc.SimpleEtcd, err = NewSimpleEtcd()
 	if err != nil {
-		lc.Dnsmasq.Destroy()
-		lc.nshandle.Close()
 		return nil, err
 	}
 
 	lc.NTPServer, err = ntp.NewServer(":123")
 	if err != nil {
-		lc.Dnsmasq.Destroy()
-		lc.SimpleEtcd.Destroy()
-		lc.nshandle.Close()
 		return nil, err
 	}
 	go lc.NTPServer.Serve()
 
+	var ips []net.IP
+	for _, seg := range lc.Dnsmasq.Segments {
+		ips = append(ips, seg.BridgeIf.DHCPv4[0].IP, seg.BridgeIf.DHCPv6[0].IP)
+	}
+	lc.FileServer, err = NewFileServer(ips)
+	if err != nil {
+		return nil, err
+	}
+
+	lc.Registry, err = NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+
 	return lc, nil
 }
 
+// StartPXE starts the cluster's PXE server, serving kernel and initrd,
+// unless it is running already.
+func (lc *LocalCluster) StartPXE(kernel, initrd string) error {
+	lc.pxeMu.Lock()
+	defer lc.pxeMu.Unlock()
+
+	if lc.PXE != nil {
+		return nil
+	}
+
+	nsExit, err := NsEnter(lc.nshandle)
+	if err != nil {
+		return err
+	}
+	defer nsExit()
+
+	pxe, err := NewPXEServer()
+	if err != nil {
+		return err
+	}
+	pxe.Kernel, pxe.Initrd = kernel, initrd
+	lc.PXE = pxe
+	return nil
+}
+
+func (lc *LocalCluster) SSHAgentSocket() string {
+	return lc.SSHAgent.Socket
+}
+
+// NetNSPath returns the path of the cluster's network namespace, valid
+// while this process runs.
+func (lc *LocalCluster) NetNSPath() string {
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), lc.nshandle)
+}
+
 func (lc *LocalCluster) NewCommand(name string, arg ...string) exec.Cmd {
 	cmd := NewNsCommand(lc.nshandle, name, arg...)
 	sshEnv := fmt.Sprintf("SSH_AUTH_SOCK=%s", lc.SSHAgent.Socket)
@@ -92,15 +160,12 @@ func (lc *LocalCluster) NewCommand(name string, arg ...string) exec.Cmd {
 	return cmd
 }
 
+// EtcdEndpoint returns the etcd URL on the address of br0. It is
+// reachable from every segment since the address is local to the
+// namespace, whatever the Topology.
 func (lc *LocalCluster) EtcdEndpoint() string {
-	// hackydoo
-	bridge := "br0"
-	for _, seg := range lc.Dnsmasq.Segments {
-		if bridge == seg.BridgeName {
-			return fmt.Sprintf("http://%s:%d", seg.BridgeIf.DHCPv4[0].IP, lc.SimpleEtcd.Port)
-		}
-	}
-	panic("Not a valid bridge!")
+	seg := lc.Dnsmasq.Segments[0]
+	return fmt.Sprintf("http://%s:%d", seg.BridgeIf.DHCPv4[0].IP, lc.SimpleEtcd.Port)
 }
 
 func (lc *LocalCluster) GetDiscoveryURL(size int) (string, error) {
@@ -158,6 +223,71 @@ func (lc *LocalCluster) NewTap(bridge string) (*TunTap, error) {
 	return tap, nil
 }
 
+// NewVeth creates a veth pair attached to bridge, named name on the
+// bridge and peer on the other end, which gets the MAC address mac. The
+// peer is meant to be moved into a container's network namespace.
+func (lc *LocalCluster) NewVeth(bridge, name, peer string, mac net.HardwareAddr) error {
+	nsExit, err := NsEnter(lc.nshandle)
+	if err != nil {
+		return err
+	}
+	defer nsExit()
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		PeerName:  peer,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("veth failed: %v", err)
+	}
+
+	p, err := netlink.LinkByName(peer)
+	if err != nil {
+		netlink.LinkDel(veth)
+		return fmt.Errorf("veth peer failed: %v", err)
+	}
+
+	if err := netlink.LinkSetHardwareAddr(p, mac); err != nil {
+		netlink.LinkDel(veth)
+		return fmt.Errorf("veth mac failed: %v", err)
+	}
+
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		netlink.LinkDel(veth)
+		return fmt.Errorf("bridge failed: %v", err)
+	}
+
+	if err := netlink.LinkSetMaster(veth, br.(*netlink.Bridge)); err != nil {
+		netlink.LinkDel(veth)
+		return fmt.Errorf("set master failed: %v", err)
+	}
+
+	if err := netlink.LinkSetUp(veth); err != nil {
+		netlink.LinkDel(veth)
+		return fmt.Errorf("veth up failed: %v", err)
+	}
+
+	return nil
+}
+
+// DelLink removes the link name, e.g. the bridge end of a veth pair.
+func (lc *LocalCluster) DelLink(name string) error {
+	nsExit, err := NsEnter(lc.nshandle)
+	if err != nil {
+		return err
+	}
+	defer nsExit()
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+// Destroy stops the services of the cluster and removes its network
+// namespace. It also cleans up after a NewLocalCluster failing halfway.
 func (lc *LocalCluster) Destroy() error {
 	var err error
 	firstErr := func(e error) {
@@ -166,9 +296,28 @@ func (lc *LocalCluster) Destroy() error {
 		}
 	}
 
-	firstErr(lc.SimpleEtcd.Destroy())
-	firstErr(lc.Dnsmasq.Destroy())
-	firstErr(lc.SSHAgent.Close())
+	firstErr(lc.destroyUplink())
+	if lc.Registry != nil {
+		firstErr(lc.Registry.Destroy())
+	}
+	if lc.FileServer != nil {
+		firstErr(lc.FileServer.Destroy())
+	}
+	if lc.PXE != nil {
+		firstErr(lc.PXE.Destroy())
+	}
+	if lc.NTPServer != nil {
+		firstErr(lc.NTPServer.Close())
+	}
+	if lc.SimpleEtcd != nil {
+		firstErr(lc.SimpleEtcd.Destroy())
+	}
+	if lc.Dnsmasq != nil {
+		firstErr(lc.Dnsmasq.Destroy())
+	}
+	if lc.SSHAgent != nil {
+		firstErr(lc.SSHAgent.Close())
+	}
 	firstErr(lc.nshandle.Close())
 	return err
 }
@@ -0,0 +1,117 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"net"
+)
+
+// HostRecord gives A, AAAA and PTR records for the name and addresses.
+type HostRecord struct {
+	Name string
+	IPs  []net.IP
+}
+
+// SRVRecord is a SRV record for Service, e.g.
+// "_etcd-server._tcp.br0.local".
+type SRVRecord struct {
+	Service  string
+	Target   string
+	Port     int
+	Priority int
+	Weight   int
+}
+
+// CNAMERecord makes Alias an alias of Target, which must be a name
+// served by the cluster.
+type CNAMERecord struct {
+	Alias  string
+	Target string
+}
+
+// DNSRecords are served by the cluster's dnsmasq in addition to the
+// names it assigns with DHCP.
+type DNSRecords struct {
+	Hosts  []HostRecord
+	SRVs   []SRVRecord
+	CNAMEs []CNAMERecord
+}
+
+// AddDNSRecords adds records to the cluster's DNS.
+func (lc *LocalCluster) AddDNSRecords(r DNSRecords) error {
+	lc.dnsMu.Lock()
+	defer lc.dnsMu.Unlock()
+
+	old := lc.Dnsmasq.records
+	var records DNSRecords
+	records.Hosts = append(append(records.Hosts, old.Hosts...), r.Hosts...)
+	records.SRVs = append(append(records.SRVs, old.SRVs...), r.SRVs...)
+	records.CNAMEs = append(append(records.CNAMEs, old.CNAMEs...), r.CNAMEs...)
+
+	return lc.updateDnsmasq(records)
+}
+
+// RemoveDNSRecords removes the host records, SRV records and aliases
+// with the given names from the cluster's DNS.
+func (lc *LocalCluster) RemoveDNSRecords(names ...string) error {
+	lc.dnsMu.Lock()
+	defer lc.dnsMu.Unlock()
+
+	remove := make(map[string]bool)
+	for _, name := range names {
+		remove[name] = true
+	}
+
+	var r DNSRecords
+	for _, h := range lc.Dnsmasq.records.Hosts {
+		if !remove[h.Name] {
+			r.Hosts = append(r.Hosts, h)
+		}
+	}
+	for _, s := range lc.Dnsmasq.records.SRVs {
+		if !remove[s.Service] {
+			r.SRVs = append(r.SRVs, s)
+		}
+	}
+	for _, c := range lc.Dnsmasq.records.CNAMEs {
+		if !remove[c.Alias] {
+			r.CNAMEs = append(r.CNAMEs, c)
+		}
+	}
+	return lc.updateDnsmasq(r)
+}
+
+// DisableDHCPv4 makes netif IPv6 only: dnsmasq stops offering it a
+// DHCPv4 lease, leaving SLAAC and DHCPv6. It must be called before the
+// machine using netif boots.
+func (lc *LocalCluster) DisableDHCPv4(netif *Interface) error {
+	lc.dnsMu.Lock()
+	defer lc.dnsMu.Unlock()
+
+	netif.IPv6Only = true
+	return lc.updateDnsmasq(lc.Dnsmasq.records)
+}
+
+// updateDnsmasq applies records and changes to the DHCP hosts of
+// dnsmasq, see Dnsmasq.update.
+func (lc *LocalCluster) updateDnsmasq(records DNSRecords) error {
+	nsExit, err := NsEnter(lc.nshandle)
+	if err != nil {
+		return err
+	}
+	defer nsExit()
+
+	return lc.Dnsmasq.update(records)
+}
@@ -15,9 +15,19 @@
 package local
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/pkg/capnslog"
 	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/vishvananda/netlink"
@@ -29,7 +39,13 @@ type Interface struct {
 	HardwareAddr net.HardwareAddr
 	DHCPv4       []net.IPNet
 	DHCPv6       []net.IPNet
-	//SLAAC net.IPAddr
+
+	// SLAAC is the address the machine assigns itself from router
+	// advertisements, derived from HardwareAddr.
+	SLAAC net.IPNet
+
+	// IPv6Only denies DHCPv4 to the interface, see DisableDHCPv4.
+	IPv6Only bool
 }
 
 type Segment struct {
@@ -41,7 +57,22 @@ type Segment struct {
 
 type Dnsmasq struct {
 	Segments []*Segment
-	dnsmasq  *exec.ExecCmd
+
+	// TFTPRoot is served over TFTP, to chain load iPXE on PXE clients
+	// other than iPXE itself.
+	TFTPRoot string
+
+	records DNSRecords // see dns.go
+	confDir string     // hosts and DHCP hosts files, re-read on SIGHUP
+	dnsmasq *exec.ExecCmd
+}
+
+// ipxeImages are the locations of the iPXE image for BIOS PXE clients
+// in common distributions.
+var ipxeImages = []string{
+	"/usr/share/ipxe/undionly.kpxe",
+	"/usr/lib/ipxe/undionly.kpxe",
+	"/usr/share/syslinux/undionly.kpxe",
 }
 
 var configTemplate = template.Must(template.New("dnsmasq").Parse(`
@@ -61,42 +92,89 @@ enable-ra
 dhcp-option=option:ntp-server,0.0.0.0
 dhcp-option=option6:ntp-server,[::]
 
+# network boot: PXE clients load iPXE over TFTP, and iPXE (including
+# QEMU's NIC option ROMs) loads its script from the PXEServer.
+enable-tftp
+tftp-root={{.TFTPRoot}}
+dhcp-match=set:ipxe,175
+dhcp-boot=tag:!ipxe,undionly.kpxe
+
 {{range .Segments}}
 domain={{.BridgeName}}.local
 
+{{$bridge := .BridgeName}}
 {{range .BridgeIf.DHCPv4}}
-dhcp-range={{.IP}},static
+dhcp-range=set:{{$bridge}},{{.IP}},static
+dhcp-boot=tag:{{$bridge}},tag:ipxe,http://{{.IP}}/boot.ipxe
 {{end}}
 
 {{range .BridgeIf.DHCPv6}}
 dhcp-range={{.IP}},ra-names,slaac
 {{end}}
 
-{{range .Interfaces}}
-dhcp-host={{.HardwareAddr}}{{template "ips" .DHCPv4}}{{template "ips" .DHCPv6}}
 {{end}}
+
+# host records and DHCP hosts change while running, see reload.
+addn-hosts={{.HostsFile}}
+dhcp-hostsfile={{.DHCPHostsFile}}
+
+{{range .Records.SRVs}}
+srv-host={{.Service}},{{.Target}},{{.Port}},{{.Priority}},{{.Weight}}
+{{end}}
+
+{{range .Records.CNAMEs}}
+cname={{.Alias}},{{.Target}}
 {{end}}
 
-{{define "ips"}}{{range .}}{{printf ",%s" .IP}}{{end}}{{end}}
 `))
 
+var hostsTemplate = template.Must(template.New("hosts").Parse(
+	`{{range $h := .Hosts}}{{range .IPs}}{{.}} {{$h.Name}}
+{{end}}{{end}}`))
+
+var dhcpHostsTemplate = template.Must(template.New("dhcp-hosts").Parse(
+	`{{range .Segments}}{{range .Interfaces}}{{.HardwareAddr}}{{if not .IPv6Only}}{{template "ips" .DHCPv4}}{{end}}{{template "ips6" .DHCPv6}}
+{{end}}{{end}}` +
+		`{{define "ips"}}{{range .}}{{printf ",%s" .IP}}{{end}}{{end}}` +
+		`{{define "ips6"}}{{range .}}{{printf ",[%s]" .IP}}{{end}}{{end}}`))
+
+// dnsmasqStartTimeout is how long dnsmasq may take to report it started.
+const dnsmasqStartTimeout = 10 * time.Second
+
 const (
 	numInterfaces = 16
 	numSegments   = 3
 )
 
 func newInterface(s, i byte) *Interface {
+	mac := net.HardwareAddr{0x02, s, 0, 0, 0, i}
 	return &Interface{
-		HardwareAddr: net.HardwareAddr{0x02, s, 0, 0, 0, i},
+		HardwareAddr: mac,
 		DHCPv4: []net.IPNet{{
 			IP:   net.IP{10, s, 0, i},
 			Mask: net.CIDRMask(24, 32)}},
 		DHCPv6: []net.IPNet{{
 			IP:   net.IP{0xfd, s, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, i},
 			Mask: net.CIDRMask(64, 128)}},
+		SLAAC: net.IPNet{
+			IP:   slaacIP(net.IP{0xfd, s, 0, 0, 0, 0, 0, 0}, mac),
+			Mask: net.CIDRMask(64, 128)},
 	}
 }
 
+// slaacIP returns the address a host with hardware address mac assigns
+// itself in the /64 prefix, with the modified EUI-64 interface
+// identifier of RFC 4291.
+func slaacIP(prefix net.IP, mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix[:8])
+	ip[8] = mac[0] ^ 0x02
+	ip[9], ip[10] = mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	return ip
+}
+
 func newSegment(s byte) (*Segment, error) {
 	seg := &Segment{
 		BridgeName: fmt.Sprintf("br%d", s),
@@ -141,6 +219,38 @@ func newSegment(s byte) (*Segment, error) {
 
 func NewDnsmasq() (*Dnsmasq, error) {
 	dm := &Dnsmasq{}
+
+	var err error
+	dm.TFTPRoot, err = ioutil.TempDir("", "mantle-tftp")
+	if err != nil {
+		return nil, err
+	}
+	// dnsmasq serves TFTP as an unprivileged user.
+	if err := os.Chmod(dm.TFTPRoot, 0755); err != nil {
+		os.RemoveAll(dm.TFTPRoot)
+		return nil, err
+	}
+	for _, image := range ipxeImages {
+		if _, err := os.Stat(image); err == nil {
+			if err := os.Symlink(image, filepath.Join(dm.TFTPRoot, "undionly.kpxe")); err != nil {
+				os.RemoveAll(dm.TFTPRoot)
+				return nil, err
+			}
+			break
+		}
+	}
+
+	dm.confDir, err = ioutil.TempDir("", "mantle-dnsmasq")
+	if err != nil {
+		os.RemoveAll(dm.TFTPRoot)
+		return nil, err
+	}
+	// dnsmasq re-reads the files as an unprivileged user too.
+	if err := os.Chmod(dm.confDir, 0755); err != nil {
+		dm.removeDirs()
+		return nil, err
+	}
+
 	for s := byte(0); s < numSegments; s++ {
 		seg, err := newSegment(s)
 		if err != nil {
@@ -159,31 +269,153 @@ func NewDnsmasq() (*Dnsmasq, error) {
 		return nil, fmt.Errorf("Network loopback setup failed: %v", err)
 	}
 
+	if err := dm.start(); err != nil {
+		dm.removeDirs()
+		return nil, err
+	}
+
+	return dm, nil
+}
+
+func (dm *Dnsmasq) removeDirs() error {
+	err := os.RemoveAll(dm.TFTPRoot)
+	if err2 := os.RemoveAll(dm.confDir); err == nil && err2 != nil {
+		err = err2
+	}
+	return err
+}
+
+func (dm *Dnsmasq) hostsFile() string {
+	return filepath.Join(dm.confDir, "hosts")
+}
+
+func (dm *Dnsmasq) dhcpHostsFile() string {
+	return filepath.Join(dm.confDir, "dhcp-hosts")
+}
+
+// writeFiles writes the files dnsmasq re-reads on SIGHUP.
+func (dm *Dnsmasq) writeFiles() error {
+	if err := writeTemplate(dm.hostsFile(), hostsTemplate, dm.records); err != nil {
+		return err
+	}
+	return writeTemplate(dm.dhcpHostsFile(), dhcpHostsTemplate, dm)
+}
+
+// writeTemplate replaces the file path with the output of t, so dnsmasq
+// never reads it half written.
+func writeTemplate(path string, t *template.Template, data interface{}) error {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// start runs dnsmasq with the current configuration, in the current
+// network namespace, and waits for it to report it started.
+func (dm *Dnsmasq) start() error {
+	if err := dm.writeFiles(); err != nil {
+		return err
+	}
+
 	dm.dnsmasq = exec.Command("dnsmasq", "--conf-file=-")
 	cfg, err := dm.dnsmasq.StdinPipe()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	out, err := dm.dnsmasq.StdoutPipe()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	dm.dnsmasq.Stderr = dm.dnsmasq.Stdout
-	go util.LogFrom(capnslog.INFO, out)
+
+	// dnsmasq logs "started" once it parsed its configuration and
+	// opened its sockets, and exits on failure.
+	started := make(chan bool, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		util.LogFrom(capnslog.INFO, io.TeeReader(out, pw))
+		pw.Close()
+	}()
+	go func() {
+		ok := false
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			if !ok && strings.Contains(scanner.Text(), "started, version") {
+				ok = true
+				started <- true
+			}
+		}
+		io.Copy(ioutil.Discard, pr)
+		if !ok {
+			started <- false
+		}
+	}()
 
 	if err = dm.dnsmasq.Start(); err != nil {
 		cfg.Close()
-		return nil, err
+		pw.Close()
+		return err
 	}
 
-	if err = configTemplate.Execute(cfg, dm); err != nil {
+	data := struct {
+		*Dnsmasq
+		Records       DNSRecords
+		HostsFile     string
+		DHCPHostsFile string
+	}{dm, dm.records, dm.hostsFile(), dm.dhcpHostsFile()}
+
+	if err = configTemplate.Execute(cfg, data); err != nil {
 		cfg.Close()
-		dm.Destroy()
-		return nil, err
+		dm.dnsmasq.Kill()
+		return err
 	}
 	cfg.Close()
 
-	return dm, nil
+	select {
+	case ok := <-started:
+		if !ok {
+			return fmt.Errorf("dnsmasq failed to start: %v", dm.dnsmasq.Wait())
+		}
+	case <-time.After(dnsmasqStartTimeout):
+		dm.dnsmasq.Kill()
+		return fmt.Errorf("dnsmasq did not start within %v", dnsmasqStartTimeout)
+	}
+
+	return nil
+}
+
+// update applies records. Host records and DHCP hosts are reloaded with
+// SIGHUP, leaving DHCP and TFTP exchanges in flight undisturbed, but
+// dnsmasq only reads SRV records and aliases at startup so changing
+// those restarts it. It must be called in the network namespace dnsmasq
+// was started in.
+func (dm *Dnsmasq) update(records DNSRecords) error {
+	restart := !reflect.DeepEqual(records.SRVs, dm.records.SRVs) ||
+		!reflect.DeepEqual(records.CNAMEs, dm.records.CNAMEs)
+	dm.records = records
+
+	if !restart {
+		return dm.reload()
+	}
+
+	if err := dm.dnsmasq.Kill(); err != nil {
+		return err
+	}
+	return dm.start()
+}
+
+// reload makes dnsmasq re-read its hosts and DHCP hosts files.
+func (dm *Dnsmasq) reload() error {
+	if err := dm.writeFiles(); err != nil {
+		return err
+	}
+	return dm.dnsmasq.Process.Signal(syscall.SIGHUP)
 }
 
 func (dm *Dnsmasq) GetInterface(bridge string) (in *Interface) {
@@ -200,6 +432,21 @@ func (dm *Dnsmasq) GetInterface(bridge string) (in *Interface) {
 	panic("Not a valid bridge!")
 }
 
+// PutInterface gives back in, unused, after a failure. It is only
+// handed out again if it was the last interface taken on its segment.
+func (dm *Dnsmasq) PutInterface(in *Interface) {
+	for _, seg := range dm.Segments {
+		if seg.nextIf > 0 && seg.Interfaces[seg.nextIf-1] == in {
+			seg.nextIf--
+			return
+		}
+	}
+}
+
 func (dm *Dnsmasq) Destroy() error {
-	return dm.dnsmasq.Kill()
+	err := dm.dnsmasq.Kill()
+	if err2 := dm.removeDirs(); err == nil && err2 != nil {
+		err = err2
+	}
+	return err
 }
@@ -0,0 +1,100 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConfigRecords(t *testing.T) {
+	dm := &Dnsmasq{
+		Segments: []*Segment{{
+			BridgeName: "br0",
+			BridgeIf:   newInterface(0, 1),
+			Interfaces: []*Interface{newInterface(0, 2), newInterface(0, 3)},
+		}},
+		TFTPRoot: "/tmp/tftp",
+	}
+	dm.Segments[0].Interfaces[1].IPv6Only = true
+	records := DNSRecords{
+		Hosts: []HostRecord{{
+			Name: "instance0",
+			IPs:  []net.IP{net.IP{10, 0, 0, 2}, net.ParseIP("fd00::2")},
+		}},
+		SRVs: []SRVRecord{{
+			Service: "_etcd-server._tcp.br0.local",
+			Target:  "instance0.br0.local",
+			Port:    2380,
+		}},
+		CNAMEs: []CNAMERecord{{Alias: "etcd", Target: "instance0"}},
+	}
+
+	var buf bytes.Buffer
+	data := struct {
+		*Dnsmasq
+		Records       DNSRecords
+		HostsFile     string
+		DHCPHostsFile string
+	}{dm, records, "/tmp/dnsmasq/hosts", "/tmp/dnsmasq/dhcp-hosts"}
+	if err := configTemplate.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := buf.String()
+	for _, want := range []string{
+		"dhcp-range=set:br0,10.0.0.1,static",
+		"dhcp-boot=tag:br0,tag:ipxe,http://10.0.0.1/boot.ipxe",
+		"tftp-root=/tmp/tftp",
+		"addn-hosts=/tmp/dnsmasq/hosts\n",
+		"dhcp-hostsfile=/tmp/dnsmasq/dhcp-hosts\n",
+		"srv-host=_etcd-server._tcp.br0.local,instance0.br0.local,2380,0,0",
+		"cname=etcd,instance0",
+	} {
+		if !strings.Contains(cfg, want) {
+			t.Errorf("config lacks %q:\n%s", want, cfg)
+		}
+	}
+
+	buf.Reset()
+	if err := hostsTemplate.Execute(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	if want := "10.0.0.2 instance0\nfd00::2 instance0\n"; buf.String() != want {
+		t.Errorf("hosts file %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := dhcpHostsTemplate.Execute(&buf, dm); err != nil {
+		t.Fatal(err)
+	}
+	if want := "02:00:00:00:00:02,10.0.0.2,[fd00::2]\n02:00:00:00:00:03,[fd00::3]\n"; buf.String() != want {
+		t.Errorf("DHCP hosts file %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSLAAC(t *testing.T) {
+	netif := newInterface(1, 2)
+	if want := net.ParseIP("fd01::1:ff:fe00:2"); !netif.SLAAC.IP.Equal(want) {
+		t.Errorf("SLAAC address %s, want %s", netif.SLAAC.IP, want)
+	}
+
+	ip := slaacIP(net.ParseIP("fd00::"), net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56})
+	if want := net.ParseIP("fd00::5054:ff:fe12:3456"); !ip.Equal(want) {
+		t.Errorf("SLAAC address %s, want %s", ip, want)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/mantle/system/exec"
+)
+
+// Netem describes the network conditions emulated on a link by the tc
+// netem queueing discipline. The zero value emulates a perfect link.
+type Netem struct {
+	// Delay is added to each packet, varying by up to Jitter.
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// Loss is the percentage of packets dropped.
+	Loss float64
+
+	// Rate limits the bandwidth in bits per second if non-zero.
+	Rate uint64
+}
+
+func (n Netem) args() []string {
+	args := []string{"netem"}
+	if n.Delay > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dus", n.Delay/time.Microsecond))
+		if n.Jitter > 0 {
+			args = append(args, fmt.Sprintf("%dus", n.Jitter/time.Microsecond))
+		}
+	}
+	if n.Loss > 0 {
+		args = append(args, "loss", fmt.Sprintf("%g%%", n.Loss))
+	}
+	if n.Rate > 0 {
+		args = append(args, "rate", fmt.Sprintf("%dbit", n.Rate))
+	}
+	return args
+}
+
+// run runs a command inside the cluster's network namespace.
+func (lc *LocalCluster) run(name string, args ...string) error {
+	return runCmd(lc.NewCommand(name, args...), name, args)
+}
+
+// runHost runs a command in the host's network namespace.
+func runHost(name string, args ...string) error {
+	return runCmd(exec.Command(name, args...), name, args)
+}
+
+func runCmd(cmd exec.Cmd, name string, args []string) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// SetNetem emulates the conditions n on the tap, which affects the
+// traffic sent to the machine behind it.
+func (lc *LocalCluster) SetNetem(tap string, n Netem) error {
+	lc.faultMu.Lock()
+	defer lc.faultMu.Unlock()
+
+	args := append([]string{"qdisc", "replace", "dev", tap, "root"}, n.args()...)
+	if err := lc.run("tc", args...); err != nil {
+		return err
+	}
+
+	lc.netemTaps[tap] = true
+	return nil
+}
+
+// ClearNetem removes the conditions set by SetNetem from the tap.
+func (lc *LocalCluster) ClearNetem(tap string) error {
+	lc.faultMu.Lock()
+	defer lc.faultMu.Unlock()
+
+	return lc.clearNetem(tap)
+}
+
+func (lc *LocalCluster) clearNetem(tap string) error {
+	if !lc.netemTaps[tap] {
+		return nil
+	}
+
+	delete(lc.netemTaps, tap)
+	return lc.run("tc", "qdisc", "del", "dev", tap, "root")
+}
+
+// Partition drops all traffic between taps of different groups, which
+// must be attached to the same bridge. Taps not in any group are not
+// affected. A previous partition is replaced.
+func (lc *LocalCluster) Partition(groups ...[]string) error {
+	lc.faultMu.Lock()
+	defer lc.faultMu.Unlock()
+
+	if err := lc.run("ebtables", "-F", "FORWARD"); err != nil {
+		return err
+	}
+
+	for i, g := range groups {
+		for j, h := range groups {
+			if i == j {
+				continue
+			}
+			for _, in := range g {
+				for _, out := range h {
+					if err := lc.run("ebtables", "-A", "FORWARD", "-i", in, "-o", out, "-j", "DROP"); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Heal removes any partition and all conditions set by SetNetem.
+func (lc *LocalCluster) Heal() error {
+	lc.faultMu.Lock()
+	defer lc.faultMu.Unlock()
+
+	err := lc.run("ebtables", "-F", "FORWARD")
+	for tap := range lc.netemTaps {
+		if err2 := lc.clearNetem(tap); err == nil && err2 != nil {
+			err = err2
+		}
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNetemArgs(t *testing.T) {
+	tests := []struct {
+		in  Netem
+		out []string
+	}{
+		{Netem{}, []string{"netem"}},
+		{Netem{Delay: 100 * time.Millisecond}, []string{"netem", "delay", "100000us"}},
+		{Netem{Delay: time.Second, Jitter: 10 * time.Millisecond, Loss: 2.5},
+			[]string{"netem", "delay", "1000000us", "10000us", "loss", "2.5%"}},
+		{Netem{Jitter: time.Second, Rate: 1000000}, []string{"netem", "rate", "1000000bit"}},
+	}
+
+	for _, tt := range tests {
+		if out := tt.in.args(); !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("%+v: got %v, want %v", tt.in, out, tt.out)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	FileServerPort    = 8080
+	FileServerTLSPort = 8443
+)
+
+// certValidity is how long the file server's certificate is valid,
+// enough for clusters kept running with kola spawn.
+const certValidity = 30 * 24 * time.Hour
+
+// FileServer serves files to the machines of a cluster over HTTP and
+// HTTPS on every bridge, so tests can fetch files without the internet.
+// Files added with AddFile take precedence over those in Dir.
+type FileServer struct {
+	// Dir is a local directory to serve, if set.
+	Dir string
+
+	// CACert is the PEM encoded self-signed certificate of the HTTPS
+	// server, for machines to trust.
+	CACert string
+
+	mu          sync.Mutex
+	files       map[string][]byte
+	listener    net.Listener
+	tlsListener net.Listener
+}
+
+// NewFileServer starts a FileServer in the current network namespace.
+// ips are the addresses the HTTPS certificate is valid for.
+func NewFileServer(ips []net.IP) (*FileServer, error) {
+	cert, certPEM, err := selfSignedCert(ips)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", FileServerPort))
+	if err != nil {
+		return nil, err
+	}
+
+	tl, err := tls.Listen("tcp", fmt.Sprintf(":%d", FileServerTLSPort), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	fs := &FileServer{
+		CACert:      string(certPEM),
+		files:       make(map[string][]byte),
+		listener:    l,
+		tlsListener: tl,
+	}
+
+	go http.Serve(l, fs)
+	go http.Serve(tl, fs)
+
+	return fs, nil
+}
+
+// selfSignedCert creates a certificate for ips which is its own CA.
+func selfSignedCert(ips []net.IP) (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "kola file server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return cert, certPEM, nil
+}
+
+// AddFile serves contents at path, e.g. "/etcd.tar.gz".
+func (fs *FileServer) AddFile(path string, contents []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.files[path] = contents
+}
+
+// RemoveFile stops serving the file added at path.
+func (fs *FileServer) RemoveFile(path string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.files, path)
+}
+
+func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	contents, ok := fs.files[r.URL.Path]
+	fs.mu.Unlock()
+
+	switch {
+	case ok:
+		w.Write(contents)
+	case fs.Dir != "":
+		http.FileServer(http.Dir(fs.Dir)).ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (fs *FileServer) Destroy() error {
+	err := fs.listener.Close()
+	if err2 := fs.tlsListener.Close(); err == nil && err2 != nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileserver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("from dir"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &FileServer{Dir: dir, files: make(map[string][]byte)}
+	fs.AddFile("/b", []byte("from memory"))
+
+	get := func(path string) (int, string) {
+		r, _ := http.NewRequest("GET", "http://10.0.0.1:8080"+path, nil)
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	for _, tt := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/a", http.StatusOK, "from dir"},
+		{"/b", http.StatusOK, "from memory"},
+		{"/c", http.StatusNotFound, ""},
+	} {
+		code, body := get(tt.path)
+		if code != tt.code || (tt.body != "" && body != tt.body) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.path, code, body, tt.code, tt.body)
+		}
+	}
+
+	fs.RemoveFile("/b")
+	if code, _ := get("/b"); code != http.StatusNotFound {
+		t.Errorf("removed file: got status %d, want 404", code)
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	ip := net.IP{10, 0, 0, 1}
+	_, certPEM, err := selfSignedCert([]net.IP{ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatalf("invalid PEM:\n%s", certPEM)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: ip.String(), Roots: roots}); err != nil {
+		t.Errorf("certificate is not its own CA for %s: %v", ip, err)
+	}
+
+	later := time.Now().Add(29 * 24 * time.Hour)
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: ip.String(), Roots: roots, CurrentTime: later}); err != nil {
+		t.Errorf("certificate expires within 29 days: %v", err)
+	}
+}
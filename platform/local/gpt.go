@@ -0,0 +1,94 @@
+// Copyright 2014-2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf16"
+)
+
+const gptSectorSize = 512
+
+// Partition is a partition of a disk image.
+type Partition struct {
+	Label  string
+	Offset int64 // in bytes from the start of the image
+	Size   int64 // in bytes
+}
+
+// FindPartition returns the partition of the GPT formatted disk image
+// named label, e.g. "USR-A" or "ROOT" in CoreOS images.
+func FindPartition(image, label string) (*Partition, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the header is in the second sector, after the protective MBR.
+	header := make([]byte, 92)
+	if _, err := f.ReadAt(header, gptSectorSize); err != nil {
+		return nil, fmt.Errorf("reading GPT header of %s: %v", image, err)
+	}
+	if !bytes.Equal(header[:8], []byte("EFI PART")) {
+		return nil, fmt.Errorf("%s has no GPT", image)
+	}
+
+	le := binary.LittleEndian
+	entriesLBA := int64(le.Uint64(header[72:]))
+	numEntries := int(le.Uint32(header[80:]))
+	entrySize := int(le.Uint32(header[84:]))
+	if entrySize < 128 {
+		return nil, fmt.Errorf("invalid GPT entry size %d in %s", entrySize, image)
+	}
+
+	r := io.NewSectionReader(f, entriesLBA*gptSectorSize, int64(numEntries*entrySize))
+	entry := make([]byte, entrySize)
+	for i := 0; i < numEntries; i++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return nil, fmt.Errorf("reading GPT entries of %s: %v", image, err)
+		}
+
+		first, last := int64(le.Uint64(entry[32:])), int64(le.Uint64(entry[40:]))
+		if first == 0 || gptName(entry[56:128]) != label {
+			continue
+		}
+
+		return &Partition{
+			Label:  label,
+			Offset: first * gptSectorSize,
+			Size:   (last - first + 1) * gptSectorSize,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no partition %q in %s", label, image)
+}
+
+// gptName decodes the NUL padded UTF-16LE name of a GPT entry.
+func gptName(b []byte) string {
+	var u []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,75 @@
+// Copyright 2014-2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestFindPartition(t *testing.T) {
+	f, err := ioutil.TempFile("", "mantle-gpt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	le := binary.LittleEndian
+	header := make([]byte, 92)
+	copy(header, "EFI PART")
+	le.PutUint64(header[72:], 2)   // entries start at LBA 2
+	le.PutUint32(header[80:], 4)   // number of entries
+	le.PutUint32(header[84:], 128) // entry size
+	if _, err := f.WriteAt(header, gptSectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, p := range []struct {
+		name        string
+		first, last uint64
+	}{
+		{"USR-A", 4096, 8191},
+		{"ROOT", 8192, 16383},
+	} {
+		entry := make([]byte, 128)
+		le.PutUint64(entry[32:], p.first)
+		le.PutUint64(entry[40:], p.last)
+		for j, c := range utf16.Encode([]rune(p.name)) {
+			le.PutUint16(entry[56+2*j:], c)
+		}
+		if _, err := f.WriteAt(entry, 2*gptSectorSize+int64(i*128)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(16384 * gptSectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := FindPartition(f.Name(), "ROOT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Offset != 8192*gptSectorSize || p.Size != 8192*gptSectorSize {
+		t.Errorf("ROOT at %d size %d, want %d size %d", p.Offset, p.Size, 8192*gptSectorSize, 8192*gptSectorSize)
+	}
+
+	if _, err := FindPartition(f.Name(), "OEM"); err == nil {
+		t.Errorf("found nonexistent partition OEM")
+	}
+}
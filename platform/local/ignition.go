@@ -0,0 +1,50 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// IgnitionConfig is an Ignition config written to a file, which QEMU
+// passes to the machine via fw_cfg.
+type IgnitionConfig struct {
+	Path string
+}
+
+func NewIgnitionConfig(config string) (*IgnitionConfig, error) {
+	f, err := ioutil.TempFile("", "mantle-ignition")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(config); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &IgnitionConfig{Path: f.Name()}, nil
+}
+
+// FwCfgArgs returns the QEMU arguments passing the config to CoreOS.
+func (c *IgnitionConfig) FwCfgArgs() []string {
+	return []string{"-fw_cfg", "name=opt/com.coreos/config,file=" + c.Path}
+}
+
+func (c *IgnitionConfig) Destroy() error {
+	return os.Remove(c.Path)
+}
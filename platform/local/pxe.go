@@ -0,0 +1,147 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// PXEServer serves machines booting with iPXE over HTTP on port 80 of
+// every bridge. dnsmasq points iPXE at /boot.ipxe, which chains to a
+// script for the machine's MAC address booting Kernel and Initrd with
+// the machine's userdata.
+type PXEServer struct {
+	// Kernel and Initrd are the paths of the CoreOS PXE images.
+	Kernel string
+	Initrd string
+
+	mu       sync.Mutex
+	machines map[string]*pxeMachine
+	listener net.Listener
+}
+
+type pxeMachine struct {
+	cmdline  string
+	userdata string
+	ignition bool
+}
+
+// bootScript is served to every iPXE client, ${net0/mac:hexhyp} is
+// expanded by iPXE.
+const bootScript = `#!ipxe
+chain http://%s/machine/${net0/mac:hexhyp}
+`
+
+// NewPXEServer starts a PXEServer in the current network namespace.
+func NewPXEServer() (*PXEServer, error) {
+	l, err := net.Listen("tcp", ":80")
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &PXEServer{
+		machines: make(map[string]*pxeMachine),
+		listener: l,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/boot.ipxe", ps.serveBoot)
+	mux.HandleFunc("/machine/", ps.serveMachine)
+	mux.HandleFunc("/config/", ps.serveConfig)
+	mux.HandleFunc("/kernel", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, ps.Kernel)
+	})
+	mux.HandleFunc("/initrd", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, ps.Initrd)
+	})
+
+	go http.Serve(l, mux)
+
+	return ps, nil
+}
+
+// pxeKey formats mac as iPXE's hexhyp does.
+func pxeKey(mac net.HardwareAddr) string {
+	return strings.Replace(mac.String(), ":", "-", -1)
+}
+
+// AddMachine makes the machine with the given MAC address boot with the
+// kernel command line cmdline and userdata, which is passed to Ignition
+// or coreos-cloudinit as a URL.
+func (ps *PXEServer) AddMachine(mac net.HardwareAddr, cmdline, userdata string, ignition bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.machines[pxeKey(mac)] = &pxeMachine{
+		cmdline:  cmdline,
+		userdata: userdata,
+		ignition: ignition,
+	}
+}
+
+// RemoveMachine stops serving the machine with the given MAC address.
+func (ps *PXEServer) RemoveMachine(mac net.HardwareAddr) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.machines, pxeKey(mac))
+}
+
+func (ps *PXEServer) machine(r *http.Request, prefix string) *pxeMachine {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.machines[strings.TrimPrefix(r.URL.Path, prefix)]
+}
+
+func (ps *PXEServer) serveBoot(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, bootScript, r.Host)
+}
+
+func (ps *PXEServer) serveMachine(w http.ResponseWriter, r *http.Request) {
+	m := ps.machine(r, "/machine/")
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	config := fmt.Sprintf("http://%s/config/%s", r.Host, strings.TrimPrefix(r.URL.Path, "/machine/"))
+	if m.ignition {
+		config = "coreos.first_boot=1 coreos.config.url=" + config
+	} else {
+		config = "cloud-config-url=" + config
+	}
+
+	fmt.Fprintf(w, "#!ipxe\nkernel http://%s/kernel %s %s\ninitrd http://%s/initrd\nboot\n",
+		r.Host, m.cmdline, config, r.Host)
+}
+
+func (ps *PXEServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	m := ps.machine(r, "/config/")
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	fmt.Fprint(w, m.userdata)
+}
+
+func (ps *PXEServer) Destroy() error {
+	return ps.listener.Close()
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPXEServer(t *testing.T) {
+	ps := &PXEServer{machines: make(map[string]*pxeMachine)}
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	ps.AddMachine(mac, "console=ttyS0", `{"ignition":{}}`, true)
+
+	get := func(h http.HandlerFunc, path string) (int, string) {
+		r, _ := http.NewRequest("GET", "http://10.0.0.1"+path, nil)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	if _, body := get(ps.serveBoot, "/boot.ipxe"); !strings.Contains(body, "chain http://10.0.0.1/machine/${net0/mac:hexhyp}") {
+		t.Errorf("unexpected boot script:\n%s", body)
+	}
+
+	_, body := get(ps.serveMachine, "/machine/02-00-00-00-00-02")
+	for _, want := range []string{
+		"kernel http://10.0.0.1/kernel console=ttyS0 coreos.first_boot=1 coreos.config.url=http://10.0.0.1/config/02-00-00-00-00-02",
+		"initrd http://10.0.0.1/initrd",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("machine script lacks %q:\n%s", want, body)
+		}
+	}
+
+	if _, body := get(ps.serveConfig, "/config/02-00-00-00-00-02"); body != `{"ignition":{}}` {
+		t.Errorf("unexpected config %q", body)
+	}
+
+	ps.RemoveMachine(mac)
+	if code, _ := get(ps.serveMachine, "/machine/02-00-00-00-00-02"); code != http.StatusNotFound {
+		t.Errorf("removed machine: got status %d, want 404", code)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// QMP is a client for the QEMU Machine Protocol.
+type QMP struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+	dec  *json.Decoder
+}
+
+// QMPError is an error returned by QEMU for a command.
+type QMPError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *QMPError) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Event  string          `json:"event"`
+	Return json.RawMessage `json:"return"`
+	Error  *QMPError       `json:"error"`
+}
+
+// NewQMP connects to the QMP socket at path and enables commands.
+func NewQMP(path string) (*QMP, error) {
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	conn, err := net.DialUnix("unix", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &QMP{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+	}
+
+	var greeting qmpResponse
+	if err := q.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp greeting: %v", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp greeting missing")
+	}
+
+	if _, err := q.Execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Execute runs command with the given arguments and returns its result.
+func (q *QMP) Execute(command string, args interface{}) (json.RawMessage, error) {
+	return q.execute(command, args, nil)
+}
+
+// ExecuteWithFile is like Execute, but also passes f to QEMU, as needed
+// by the getfd command.
+func (q *QMP) ExecuteWithFile(command string, args interface{}, f *os.File) (json.RawMessage, error) {
+	return q.execute(command, args, f)
+}
+
+// HumanMonitorCommand runs a command of the human monitor, for features
+// QMP lacks such as savevm, and returns its output.
+func (q *QMP) HumanMonitorCommand(cmd string) (string, error) {
+	args := map[string]string{"command-line": cmd}
+	ret, err := q.Execute("human-monitor-command", args)
+	if err != nil {
+		return "", err
+	}
+
+	var out string
+	if err := json.Unmarshal(ret, &out); err != nil {
+		return "", fmt.Errorf("qmp: %v", err)
+	}
+	return out, nil
+}
+
+func (q *QMP) execute(command string, args interface{}, f *os.File) (json.RawMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	b, err := json.Marshal(&qmpCommand{Execute: command, Arguments: args})
+	if err != nil {
+		return nil, err
+	}
+
+	var oob []byte
+	if f != nil {
+		oob = syscall.UnixRights(int(f.Fd()))
+	}
+
+	if _, _, err := q.conn.WriteMsgUnix(b, oob, nil); err != nil {
+		return nil, fmt.Errorf("qmp %s: %v", command, err)
+	}
+
+	for {
+		var resp qmpResponse
+		if err := q.dec.Decode(&resp); err != nil {
+			return nil, fmt.Errorf("qmp %s: %v", command, err)
+		}
+
+		switch {
+		case resp.Event != "":
+			// asynchronous events are not reported
+		case resp.Error != nil:
+			return nil, resp.Error
+		case resp.Return != nil:
+			return resp.Return, nil
+		}
+	}
+}
+
+func (q *QMP) Close() error {
+	return q.conn.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeQMP serves a QMP greeting and the given responses, one per
+// command, and records the commands it receives.
+func fakeQMP(t *testing.T, l net.Listener, responses []string, commands chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Errorf("accept: %v", err)
+		close(commands)
+		return
+	}
+	defer conn.Close()
+	defer close(commands)
+
+	conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\r\n"))
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for _, resp := range responses {
+		var cmd qmpCommand
+		if err := dec.Decode(&cmd); err != nil {
+			t.Errorf("decoding command: %v", err)
+			return
+		}
+		commands <- cmd.Execute
+		conn.Write([]byte(resp + "\r\n"))
+	}
+}
+
+func TestQMP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qmp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "qmp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	commands := make(chan string, 10)
+	go fakeQMP(t, l, []string{
+		`{"return": {}}`,
+		`{"event": "STOP", "timestamp": {}}` + "\r\n" + `{"return": {}}`,
+		`{"error": {"class": "GenericError", "desc": "no such device"}}`,
+		`{"return": "OK\r\n"}`,
+	}, commands)
+
+	q, err := NewQMP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if _, err := q.Execute("stop", nil); err != nil {
+		t.Errorf("stop: %v", err)
+	}
+
+	_, err = q.Execute("device_del", map[string]string{"id": "nic9"})
+	if qerr, ok := err.(*QMPError); !ok || qerr.Desc != "no such device" {
+		t.Errorf("device_del: got error %v, want no such device", err)
+	}
+
+	if out, err := q.HumanMonitorCommand("drive_add 0 if=none"); err != nil || out != "OK\r\n" {
+		t.Errorf("drive_add: got %q, %v", out, err)
+	}
+
+	var got []string
+	for c := range commands {
+		got = append(got, c)
+	}
+	want := []string{"qmp_capabilities", "stop", "device_del", "human-monitor-command"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got commands %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RegistryPort = 5000
+
+const (
+	manifestType = "application/vnd.docker.distribution.manifest.v2+json"
+	configType   = "application/vnd.docker.container.image.v1+json"
+	layerType    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// Registry is a read-only stand-in for a Docker registry, speaking
+// enough of the registry HTTP API v2 for docker pull and rkt fetch. It
+// serves images loaded from `docker save` tarballs, with image manifest
+// version 2, schema 2.
+type Registry struct {
+	dir string // blobs, named by digest
+
+	mu        sync.Mutex
+	manifests map[string]map[string][]byte // by repository and tag or digest
+	listener  net.Listener
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+type imageManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// saveManifest is an entry of the manifest.json of `docker save`.
+type saveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// NewRegistry starts a Registry in the current network namespace.
+func NewRegistry() (*Registry, error) {
+	dir, err := ioutil.TempDir("", "mantle-registry")
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", RegistryPort))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	r := &Registry{
+		dir:       dir,
+		manifests: make(map[string]map[string][]byte),
+		listener:  l,
+	}
+
+	go http.Serve(l, r)
+
+	return r, nil
+}
+
+// LoadImage adds the images of a `docker save` tarball, as created by
+// docker 1.10 or later, under their repository names and tags. Layers
+// are compressed for serving. Files referenced by the manifests may be
+// symlinks, as docker saves layers shared between images only once.
+func (r *Registry) LoadImage(tarball string) error {
+	var saved []saveManifest
+	links := make(map[string]string) // symlink targets, by name
+	err := walkTar(tarball, func(hdr *tar.Header, rd io.Reader) error {
+		switch {
+		case hdr.Typeflag == tar.TypeSymlink:
+			links[hdr.Name] = path.Join(path.Dir(hdr.Name), hdr.Linkname)
+		case hdr.Name == "manifest.json":
+			return json.NewDecoder(rd).Decode(&saved)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", tarball, err)
+	}
+	if saved == nil {
+		return fmt.Errorf("%s has no manifest.json, was it created by docker save?", tarball)
+	}
+
+	// resolve follows symlinks to the regular file holding name.
+	resolve := func(name string) string {
+		name = path.Clean(name)
+		for i := 0; i < 10; i++ {
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		return name
+	}
+
+	// the blobs of the files referenced by the manifests
+	blobs := make(map[string]descriptor)
+	for _, s := range saved {
+		blobs[resolve(s.Config)] = descriptor{MediaType: configType}
+		for _, l := range s.Layers {
+			blobs[resolve(l)] = descriptor{MediaType: layerType}
+		}
+	}
+
+	err = walkTar(tarball, func(hdr *tar.Header, rd io.Reader) error {
+		d, ok := blobs[hdr.Name]
+		if !ok || hdr.Typeflag == tar.TypeSymlink {
+			return nil
+		}
+		d, err := r.addBlob(rd, d.MediaType == layerType)
+		if err != nil {
+			return err
+		}
+		d.MediaType = blobs[hdr.Name].MediaType
+		blobs[hdr.Name] = d
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", tarball, err)
+	}
+
+	// blob returns the descriptor of the file name.
+	blob := func(name string) (descriptor, error) {
+		d := blobs[resolve(name)]
+		if d.Digest == "" {
+			return d, fmt.Errorf("%s: %s not found", tarball, name)
+		}
+		return d, nil
+	}
+
+	manifests := make(map[string][]byte) // by RepoTag
+	for _, s := range saved {
+		m := imageManifest{
+			SchemaVersion: 2,
+			MediaType:     manifestType,
+		}
+		if m.Config, err = blob(s.Config); err != nil {
+			return err
+		}
+		for _, l := range s.Layers {
+			d, err := blob(l)
+			if err != nil {
+				return err
+			}
+			m.Layers = append(m.Layers, d)
+		}
+
+		b, err := json.Marshal(&m)
+		if err != nil {
+			return err
+		}
+
+		for _, repoTag := range s.RepoTags {
+			manifests[repoTag] = b
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for repoTag, b := range manifests {
+		repo, tag := splitRepoTag(repoTag)
+		if r.manifests[repo] == nil {
+			r.manifests[repo] = make(map[string][]byte)
+		}
+		r.manifests[repo][tag] = b
+		r.manifests[repo][digest(b)] = b
+	}
+
+	return nil
+}
+
+// walkTar calls f for each regular file and symlink in tarball, with
+// names cleaned of any leading "./".
+func walkTar(tarball string, f func(hdr *tar.Header, r io.Reader) error) error {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeSymlink:
+		default:
+			continue
+		}
+		hdr.Name = path.Clean(hdr.Name)
+		if err := f(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// addBlob stores the contents of rd, compressed if compress is set, and
+// returns its size and digest.
+func (r *Registry) addBlob(rd io.Reader, compress bool) (descriptor, error) {
+	tmp, err := ioutil.TempFile(r.dir, "blob")
+	if err != nil {
+		return descriptor{}, err
+	}
+	defer tmp.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(tmp, h)
+	if compress {
+		gz := gzip.NewWriter(w)
+		if _, err := io.Copy(gz, rd); err != nil {
+			os.Remove(tmp.Name())
+			return descriptor{}, err
+		}
+		err = gz.Close()
+	} else {
+		_, err = io.Copy(w, rd)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return descriptor{}, err
+	}
+
+	size, err := tmp.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return descriptor{}, err
+	}
+
+	d := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(tmp.Name(), filepath.Join(r.dir, d)); err != nil {
+		os.Remove(tmp.Name())
+		return descriptor{}, err
+	}
+
+	return descriptor{Size: size, Digest: d}, nil
+}
+
+func digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// splitRepoTag splits a name like "quay.io/coreos/etcd:v2.2.0" into the
+// repository, without registry host, and the tag.
+func splitRepoTag(repoTag string) (string, string) {
+	repo, tag := repoTag, "latest"
+	if i := strings.LastIndex(repoTag, ":"); i > strings.LastIndex(repoTag, "/") {
+		repo, tag = repoTag[:i], repoTag[i+1:]
+	}
+
+	if i := strings.Index(repo, "/"); i >= 0 && strings.ContainsAny(repo[:i], ".:") {
+		repo = repo[i+1:]
+	}
+	return repo, tag
+}
+
+// Images returns the names of the images, as "repository:tag".
+func (r *Registry) Images() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var images []string
+	for repo, refs := range r.manifests {
+		for ref := range refs {
+			if !strings.HasPrefix(ref, "sha256:") {
+				images = append(images, repo+":"+ref)
+			}
+		}
+	}
+	sort.Strings(images)
+	return images
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	path := req.URL.Path
+	switch {
+	case path == "/v2/":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+	case strings.HasSuffix(path, "/tags/list"):
+		r.serveTags(w, req, strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list"))
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(w, req, strings.TrimPrefix(path[:i], "/v2/"), path[i+len("/manifests/"):])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		r.serveBlob(w, req, path[i+len("/blobs/"):])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Registry) serveTags(w http.ResponseWriter, req *http.Request, repo string) {
+	r.mu.Lock()
+	refs, ok := r.manifests[repo]
+	tags := []string{}
+	for ref := range refs {
+		if !strings.HasPrefix(ref, "sha256:") {
+			tags = append(tags, ref)
+		}
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	sort.Strings(tags)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name": repo,
+		"tags": tags,
+	})
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	r.mu.Lock()
+	b, ok := r.manifests[repo][ref]
+	r.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", manifestType)
+	w.Header().Set("Docker-Content-Digest", digest(b))
+	w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+	if req.Method != "HEAD" {
+		w.Write(b)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, d string) {
+	if !strings.HasPrefix(d, "sha256:") || strings.ContainsAny(d, "/.") {
+		http.NotFound(w, req)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(r.dir, d))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Docker-Content-Digest", d)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", time.Time{}, f)
+}
+
+func (r *Registry) Destroy() error {
+	err := r.listener.Close()
+	if err2 := os.RemoveAll(r.dir); err == nil && err2 != nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	body string
+	link string // symlink target, if set
+}
+
+// writeTar writes a tarball of the entries.
+func writeTar(t *testing.T, path string, entries []tarEntry) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeSaveTarball writes a `docker save` tarball of a single image with
+// one layer.
+func writeSaveTarball(t *testing.T, path string, layer []byte) {
+	writeTar(t, path, []tarEntry{
+		{name: "manifest.json", body: `[{"Config":"abc.json","RepoTags":["quay.io/kola/busybox:1.0","busybox:latest"],"Layers":["def/layer.tar"]}]`},
+		{name: "abc.json", body: `{"architecture":"amd64"}`},
+		{name: "def/layer.tar", body: string(layer)},
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layer := []byte("pretend this is a tar")
+	tarball := filepath.Join(dir, "busybox.tar")
+	writeSaveTarball(t, tarball, layer)
+
+	r := &Registry{dir: dir, manifests: make(map[string]map[string][]byte)}
+	if err := r.LoadImage(tarball); err != nil {
+		t.Fatal(err)
+	}
+
+	images := r.Images()
+	if want := []string{"busybox:latest", "kola/busybox:1.0"}; !reflect.DeepEqual(images, want) {
+		t.Fatalf("images %v, want %v", images, want)
+	}
+
+	get := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://10.0.0.1:5000"+path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("GET", "/v2/"); w.Code != http.StatusOK || w.HeaderMap.Get("Docker-Distribution-API-Version") != "registry/2.0" {
+		t.Fatalf("GET /v2/: %d %v", w.Code, w.HeaderMap)
+	}
+
+	w := get("GET", "/v2/kola/busybox/manifests/1.0")
+	if w.Code != http.StatusOK || w.HeaderMap.Get("Content-Type") != manifestType {
+		t.Fatalf("GET manifest: %d %v", w.Code, w.HeaderMap)
+	}
+	var m imageManifest
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 1 || m.Config.MediaType != configType {
+		t.Fatalf("bad manifest %+v", m)
+	}
+
+	// the manifest is also available by digest, without body for HEAD
+	d := w.HeaderMap.Get("Docker-Content-Digest")
+	if w := get("HEAD", "/v2/busybox/manifests/"+d); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("HEAD manifest by digest: %d %q", w.Code, w.Body)
+	}
+
+	w = get("GET", "/v2/busybox/blobs/"+m.Config.Digest)
+	if w.Code != http.StatusOK || w.Body.String() != `{"architecture":"amd64"}` {
+		t.Fatalf("GET config: %d %q", w.Code, w.Body)
+	}
+
+	w = get("GET", "/v2/busybox/blobs/"+m.Layers[0].Digest)
+	if w.Code != http.StatusOK || int64(w.Body.Len()) != m.Layers[0].Size {
+		t.Fatalf("GET layer: %d, %d bytes", w.Code, w.Body.Len())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(gz); err != nil || !bytes.Equal(b, layer) {
+		t.Fatalf("layer %q, %v", b, err)
+	}
+
+	w = get("GET", "/v2/kola/busybox/tags/list")
+	if w.Code != http.StatusOK || w.Body.String() != "{\"name\":\"kola/busybox\",\"tags\":[\"1.0\"]}\n" {
+		t.Fatalf("GET tags: %d %q", w.Code, w.Body)
+	}
+
+	for _, path := range []string{
+		"/v2/busybox/manifests/nope",
+		"/v2/nope/manifests/latest",
+		"/v2/busybox/blobs/sha256:00",
+		"/v2/busybox/blobs/sha256:../../etc/passwd",
+	} {
+		if w := get("GET", path); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestRegistrySymlinkedLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// newer docker saves a layer shared by two images once, linking
+	// to it from the other's directory.
+	tarball := filepath.Join(dir, "images.tar")
+	writeTar(t, tarball, []tarEntry{
+		{name: "manifest.json", body: `[{"Config":"a.json","RepoTags":["a:latest"],"Layers":["l1/layer.tar"]},` +
+			`{"Config":"b.json","RepoTags":["b:latest"],"Layers":["l2/layer.tar"]}]`},
+		{name: "a.json", body: `{}`},
+		{name: "b.json", body: `{"b":1}`},
+		{name: "l1/layer.tar", body: "layer"},
+		{name: "l2/layer.tar", link: "../l1/layer.tar"},
+	})
+
+	r := &Registry{dir: dir, manifests: make(map[string]map[string][]byte)}
+	if err := r.LoadImage(tarball); err != nil {
+		t.Fatal(err)
+	}
+
+	var a, b imageManifest
+	if err := json.Unmarshal(r.manifests["a"]["latest"], &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(r.manifests["b"]["latest"], &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Layers[0].Digest == "" || b.Layers[0] != a.Layers[0] {
+		t.Errorf("symlinked layer %+v, want %+v", b.Layers[0], a.Layers[0])
+	}
+
+	// a layer missing from the tarball is an error, not an empty
+	// descriptor.
+	missing := filepath.Join(dir, "missing.tar")
+	writeTar(t, missing, []tarEntry{
+		{name: "manifest.json", body: `[{"Config":"a.json","RepoTags":["c:latest"],"Layers":["l3/layer.tar"]}]`},
+		{name: "a.json", body: `{}`},
+		{name: "l3/layer.tar", link: "../nope/layer.tar"},
+	})
+	if err := r.LoadImage(missing); err == nil {
+		t.Errorf("loaded an image with a missing layer")
+	}
+	if _, ok := r.manifests["c"]; ok {
+		t.Errorf("published the image with a missing layer")
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/vishvananda/netlink"
+)
+
+// Topology describes how the network segments of a LocalCluster are
+// connected. By default segments are isolated from each other and from
+// the host, and machines can only reach the services of the cluster
+// (etcd, DNS and NTP), which answer on the address of every bridge.
+type Topology struct {
+	// Routed lists the bridges whose segments are routed to each other.
+	Routed []string
+
+	// NAT lists the bridges whose segments can reach the host's
+	// network, and through it the internet, with NAT.
+	NAT []string
+
+	// UplinkRange is the IPv4 network the /30 connecting the cluster
+	// to the host for NAT is picked from, avoiding the host's addresses
+	// and routes. It is 100.64.0.0/10 by default.
+	UplinkRange *net.IPNet
+}
+
+// IsZero reports whether t is the default topology.
+func (t Topology) IsZero() bool {
+	return len(t.Routed) == 0 && len(t.NAT) == 0
+}
+
+// uplink connects the cluster's network namespace to the host.
+type uplink struct {
+	hostName  string
+	nsName    string
+	hostRules [][]string // iptables rules added on the host
+	forward   bool       // holds a reference on the host's ip_forward
+}
+
+const ipForward = "/proc/sys/net/ipv4/ip_forward"
+
+const (
+	// uplinkTries is how many free /30s setupUplink tries, in case
+	// other processes take them at the same time.
+	uplinkTries = 10
+
+	// uplinkScan is how many /30s pickUplinkSubnet checks in a row.
+	uplinkScan = 1024
+)
+
+// defaultUplinkRange is the shared address space of RFC 6598.
+var defaultUplinkRange = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+var (
+	// uplinkRand picks the names and subnets of uplinks, seeded so
+	// kola processes running side by side pick different ones.
+	uplinkMu   sync.Mutex
+	uplinkRand = rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())<<32))
+
+	// ip_forward of the host is enabled while any uplink of this
+	// process is up, then set back to what it was.
+	forwardUsers int
+	forwardSaved []byte
+)
+
+// holdForward enables IPv4 forwarding on the host, saving the previous
+// setting for releaseForward.
+func holdForward() error {
+	uplinkMu.Lock()
+	defer uplinkMu.Unlock()
+
+	if forwardUsers == 0 {
+		saved, err := ioutil.ReadFile(ipForward)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(ipForward, []byte("1"), 0644); err != nil {
+			return err
+		}
+		forwardSaved = saved
+	}
+	forwardUsers++
+	return nil
+}
+
+// releaseForward restores the setting of IPv4 forwarding saved by
+// holdForward once the last uplink is gone.
+func releaseForward() error {
+	uplinkMu.Lock()
+	defer uplinkMu.Unlock()
+
+	forwardUsers--
+	if forwardUsers > 0 {
+		return nil
+	}
+	return ioutil.WriteFile(ipForward, forwardSaved, 0644)
+}
+
+// SetTopology connects the network segments as described by t. NAT
+// enables IPv4 forwarding on the host until the cluster is destroyed.
+func (lc *LocalCluster) SetTopology(t Topology) error {
+	if t.IsZero() {
+		return nil
+	}
+
+	for _, bridge := range append(t.Routed, t.NAT...) {
+		if !lc.hasSegment(bridge) {
+			return fmt.Errorf("no network segment %q", bridge)
+		}
+	}
+
+	if err := lc.run("sysctl", "-q", "-w", "net.ipv4.ip_forward=1", "net.ipv6.conf.all.forwarding=1"); err != nil {
+		return err
+	}
+
+	for _, ipt := range []string{"iptables", "ip6tables"} {
+		if err := lc.run(ipt, "-P", "FORWARD", "DROP"); err != nil {
+			return err
+		}
+
+		// bridged traffic is never routed, in case br_netfilter
+		// shows it to iptables.
+		for _, seg := range lc.Dnsmasq.Segments {
+			br := seg.BridgeName
+			if err := lc.run(ipt, "-A", "FORWARD", "-i", br, "-o", br, "-j", "ACCEPT"); err != nil {
+				return err
+			}
+		}
+
+		for _, in := range t.Routed {
+			for _, out := range t.Routed {
+				if in == out {
+					continue
+				}
+				if err := lc.run(ipt, "-A", "FORWARD", "-i", in, "-o", out, "-j", "ACCEPT"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(t.NAT) > 0 {
+		return lc.setupUplink(t.NAT, t.UplinkRange)
+	}
+	return nil
+}
+
+func (lc *LocalCluster) hasSegment(bridge string) bool {
+	for _, seg := range lc.Dnsmasq.Segments {
+		if seg.BridgeName == bridge {
+			return true
+		}
+	}
+	return false
+}
+
+// setupUplink connects the namespace to the host with a veth pair in a
+// free /30 of r, and masquerades traffic from bridges leaving through it,
+// once in the namespace and once on the host.
+func (lc *LocalCluster) setupUplink(bridges []string, r *net.IPNet) error {
+	if r == nil {
+		r = defaultUplinkRange
+	}
+	if ones, bits := r.Mask.Size(); r.IP.To4() == nil || bits != 32 || ones > 30 {
+		return fmt.Errorf("uplink range %s is not an IPv4 network of a /30 or more", r)
+	}
+
+	var veth *netlink.Veth
+	var hostAddr, nsAddr *netlink.Addr
+	for try := 0; veth == nil; try++ {
+		if try == uplinkTries {
+			return fmt.Errorf("uplink failed: no free /30 in %s after %d tries", r, uplinkTries)
+		}
+
+		used, err := hostSubnets(nil)
+		if err != nil {
+			return fmt.Errorf("uplink failed: %v", err)
+		}
+		subnet, err := pickUplinkSubnet(r, used)
+		if err != nil {
+			return err
+		}
+
+		addr := func(i uint32) *netlink.Addr {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP)+i)
+			return &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: subnet.Mask}}
+		}
+		hostAddr, nsAddr = addr(1), addr(2)
+
+		uplinkMu.Lock()
+		n := uplinkRand.Intn(1 << 20)
+		uplinkMu.Unlock()
+
+		v := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("kola%05x", n)},
+			PeerName:  fmt.Sprintf("kola%05xn", n),
+		}
+		if err := netlink.LinkAdd(v); os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("uplink failed: %v", err)
+		}
+
+		// another process may have picked the same subnet meanwhile.
+		err = netlink.AddrAdd(v, hostAddr)
+		if err == nil {
+			var link netlink.Link
+			if link, err = netlink.LinkByName(v.Name); err == nil {
+				used, err = hostSubnets(link)
+			}
+		}
+		if err != nil {
+			netlink.LinkDel(v)
+			return fmt.Errorf("uplink address failed: %v", err)
+		}
+		if overlapsAny(subnet, used) {
+			netlink.LinkDel(v)
+			continue
+		}
+
+		veth = v
+		lc.uplink = &uplink{
+			hostName: v.Name,
+			nsName:   v.PeerName,
+		}
+	}
+
+	peer, err := netlink.LinkByName(lc.uplink.nsName)
+	if err != nil {
+		return fmt.Errorf("uplink peer failed: %v", err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(lc.nshandle)); err != nil {
+		return fmt.Errorf("uplink peer failed: %v", err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return fmt.Errorf("uplink up failed: %v", err)
+	}
+
+	if err := holdForward(); err != nil {
+		return err
+	}
+	lc.uplink.forward = true
+
+	subnet := &net.IPNet{IP: hostAddr.IP.Mask(hostAddr.Mask), Mask: hostAddr.Mask}
+	hostRules := [][]string{
+		{"-t", "nat", "-A", "POSTROUTING", "-s", subnet.String(), "-j", "MASQUERADE"},
+		{"-I", "FORWARD", "-i", lc.uplink.hostName, "-j", "ACCEPT"},
+		{"-I", "FORWARD", "-o", lc.uplink.hostName, "-j", "ACCEPT"},
+	}
+	for _, rule := range hostRules {
+		if err := runHost("iptables", rule...); err != nil {
+			return err
+		}
+		lc.uplink.hostRules = append(lc.uplink.hostRules, rule)
+	}
+
+	if err := lc.setupUplinkNs(nsAddr, hostAddr.IP); err != nil {
+		return err
+	}
+
+	if err := lc.run("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", lc.uplink.nsName, "-j", "MASQUERADE"); err != nil {
+		return err
+	}
+	for _, br := range bridges {
+		if err := lc.run("iptables", "-A", "FORWARD", "-i", br, "-o", lc.uplink.nsName, "-j", "ACCEPT"); err != nil {
+			return err
+		}
+		if err := lc.run("iptables", "-A", "FORWARD", "-i", lc.uplink.nsName, "-o", br,
+			"-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hostSubnets returns the IPv4 networks of the host's addresses and
+// routes, but those of the link skip if not nil.
+func hostSubnets(skip netlink.Link) ([]*net.IPNet, error) {
+	var name string
+	var index int
+	if skip != nil {
+		name, index = skip.Attrs().Name, skip.Attrs().Index
+	}
+
+	var subnets []*net.IPNet
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		// addresses are labeled with the name of their link.
+		if skip != nil && a.Label == name {
+			continue
+		}
+		subnets = append(subnets, &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask})
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if r.Dst != nil && (skip == nil || r.LinkIndex != index) {
+			subnets = append(subnets, r.Dst)
+		}
+	}
+	return subnets, nil
+}
+
+// pickUplinkSubnet returns a /30 of r overlapping none of used, looking
+// from a random one on.
+func pickUplinkSubnet(r *net.IPNet, used []*net.IPNet) (*net.IPNet, error) {
+	ones, _ := r.Mask.Size()
+	count := int64(1) << uint(30-ones)
+	base := binary.BigEndian.Uint32(r.IP.To4().Mask(r.Mask))
+
+	uplinkMu.Lock()
+	start := uplinkRand.Int63n(count)
+	uplinkMu.Unlock()
+
+	for i := int64(0); i < count && i < uplinkScan; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+uint32((start+i)%count)*4)
+		subnet := &net.IPNet{IP: ip, Mask: net.CIDRMask(30, 32)}
+		if !overlapsAny(subnet, used) {
+			return subnet, nil
+		}
+	}
+	return nil, fmt.Errorf("uplink failed: no free /30 in %s", r)
+}
+
+// overlapsAny reports whether subnet overlaps any of nets.
+func overlapsAny(subnet *net.IPNet, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(subnet.IP) || subnet.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupUplinkNs configures the namespace end of the uplink.
+func (lc *LocalCluster) setupUplinkNs(addr *netlink.Addr, gw net.IP) error {
+	nsExit, err := NsEnter(lc.nshandle)
+	if err != nil {
+		return err
+	}
+	defer nsExit()
+
+	link, err := netlink.LinkByName(lc.uplink.nsName)
+	if err != nil {
+		return fmt.Errorf("uplink peer failed: %v", err)
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("uplink peer address failed: %v", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("uplink peer up failed: %v", err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{Gw: gw}); err != nil {
+		return fmt.Errorf("uplink route failed: %v", err)
+	}
+	return nil
+}
+
+// destroyUplink removes the uplink and its rules from the host, and
+// restores IPv4 forwarding of the host after the last one.
+func (lc *LocalCluster) destroyUplink() error {
+	if lc.uplink == nil {
+		return nil
+	}
+
+	var err error
+	for _, rule := range lc.uplink.hostRules {
+		del := append([]string(nil), rule...)
+		for i, arg := range del {
+			if arg == "-A" || arg == "-I" {
+				del[i] = "-D"
+			}
+		}
+		if err2 := runHost("iptables", del...); err == nil && err2 != nil {
+			err = err2
+		}
+	}
+
+	if link, err2 := netlink.LinkByName(lc.uplink.hostName); err2 == nil {
+		err2 = netlink.LinkDel(link)
+		if err == nil && err2 != nil {
+			err = err2
+		}
+	}
+
+	if lc.uplink.forward {
+		if err2 := releaseForward(); err == nil && err2 != nil {
+			err = err2
+		}
+	}
+
+	lc.uplink = nil
+	return err
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPickUplinkSubnet(t *testing.T) {
+	cidr := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	r := cidr("192.0.2.0/29")
+	used := []*net.IPNet{cidr("192.0.2.0/30")}
+	for i := 0; i < 20; i++ {
+		subnet, err := pickUplinkSubnet(r, used)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subnet.String() != "192.0.2.4/30" {
+			t.Fatalf("picked %s, want the free 192.0.2.4/30", subnet)
+		}
+	}
+
+	// a route covering the whole range leaves nothing.
+	if subnet, err := pickUplinkSubnet(r, []*net.IPNet{cidr("192.0.0.0/16")}); err == nil {
+		t.Errorf("picked %s in a used range", subnet)
+	}
+
+	// an address inside a /30 takes it too.
+	used = []*net.IPNet{cidr("192.0.2.6/32")}
+	if subnet, err := pickUplinkSubnet(cidr("192.0.2.4/30"), used); err == nil {
+		t.Errorf("picked %s overlapping 192.0.2.6", subnet)
+	}
+}
@@ -0,0 +1,540 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/satori/go.uuid"
+	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh/agent"
+
+	"github.com/coreos/mantle/platform/local"
+	"github.com/coreos/mantle/system/exec"
+)
+
+// NspawnOptions contains options for running machines in
+// systemd-nspawn containers.
+type NspawnOptions struct {
+	// DiskImage is the production image whose USR-A and ROOT
+	// partitions the containers boot.
+	DiskImage string
+}
+
+const (
+	// nspawnRebootStatus is the exit status of systemd-nspawn when
+	// the container reboots.
+	nspawnRebootStatus = 133
+
+	// nspawnStopTimeout is how long a container is given to shut
+	// down before it is killed.
+	nspawnStopTimeout = 30 * time.Second
+)
+
+type nspawnCluster struct {
+	mu sync.Mutex
+	*local.LocalCluster
+	machines map[string]*nspawnMachine
+	conf     NspawnOptions
+	usrDir   string // USR-A partition, mounted read-only
+	rootDir  string // ROOT partition, mounted read-only and copied per machine
+}
+
+type nspawnMachine struct {
+	nc         *nspawnCluster
+	id         string
+	name       string // UserdataVars Name, the container's hostname
+	dir        string // root directory of the container
+	usrMounted bool
+	netif      *local.Interface
+	veth       string // bridge end of the veth pair
+	peer       string // container end of the veth pair
+	dnsNames   []string
+	console    string
+
+	// cmd is the running systemd-nspawn, started again by run when
+	// the container reboots until destroying is closed. done is
+	// closed once run returns.
+	cmdMu      sync.Mutex
+	cmd        *local.NsCmd
+	destroying chan struct{}
+	done       chan struct{}
+}
+
+// NewNspawnCluster creates a Cluster whose machines are systemd-nspawn
+// containers in the cluster's network namespace, booting the USR and
+// ROOT partitions of conf.DiskImage. Containers share the host's kernel
+// and skip the initramfs, so kola only runs tests tagged with
+// register.CapContainer on it and Ignition configs are unsupported.
+func NewNspawnCluster(conf NspawnOptions) (Cluster, error) {
+	lc, err := local.NewLocalCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	nc := &nspawnCluster{
+		LocalCluster: lc,
+		machines:     make(map[string]*nspawnMachine),
+		conf:         conf,
+	}
+
+	nc.usrDir, err = mountPartition(conf.DiskImage, "USR-A")
+	if err != nil {
+		lc.Destroy()
+		return nil, err
+	}
+
+	nc.rootDir, err = mountPartition(conf.DiskImage, "ROOT")
+	if err != nil {
+		unmountPartition(nc.usrDir)
+		lc.Destroy()
+		return nil, err
+	}
+
+	return Cluster(nc), nil
+}
+
+// mountPartition mounts the partition label of image read-only on a new
+// temporary directory.
+func mountPartition(image, label string) (string, error) {
+	part, err := local.FindPartition(image, label)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir("", "mantle-nspawn-"+label)
+	if err != nil {
+		return "", err
+	}
+
+	opts := fmt.Sprintf("ro,loop,offset=%d,sizelimit=%d", part.Offset, part.Size)
+	if out, err := exec.Command("mount", "-o", opts, image, dir).CombinedOutput(); err != nil {
+		os.Remove(dir)
+		return "", fmt.Errorf("mounting %s of %s failed: %v: %s", label, image, err, bytes.TrimSpace(out))
+	}
+
+	return dir, nil
+}
+
+// unmountPartition undoes mountPartition.
+func unmountPartition(dir string) error {
+	if err := syscall.Unmount(dir, 0); err != nil {
+		return fmt.Errorf("unmounting %s failed: %v", dir, err)
+	}
+	return os.Remove(dir)
+}
+
+func (nc *nspawnCluster) Machines() []Machine {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	machines := make([]Machine, 0, len(nc.machines))
+	for _, m := range nc.machines {
+		machines = append(machines, m)
+	}
+	return machines
+}
+
+func (nc *nspawnCluster) Destroy() error {
+	var err error
+	firstErr := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	for _, m := range nc.Machines() {
+		firstErr(m.Destroy())
+	}
+
+	firstErr(unmountPartition(nc.rootDir))
+	firstErr(unmountPartition(nc.usrDir))
+	firstErr(nc.LocalCluster.Destroy())
+	return err
+}
+
+func (nc *nspawnCluster) NewMachine(userdata string) (Machine, error) {
+	return nc.newMachine(userdata, standaloneVars())
+}
+
+func (nc *nspawnCluster) newMachine(userdata string, vars UserdataVars) (Machine, error) {
+	id := uuid.NewV4()
+
+	nc.mu.Lock()
+	netif := nc.Dnsmasq.GetInterface("br0")
+
+	vars.Platform = "nspawn"
+	vars.PublicIPv4 = netif.DHCPv4[0].IP.String()
+	vars.PrivateIPv4 = vars.PublicIPv4
+	vars.PublicIPv6 = netif.SLAAC.IP.String()
+	vars.PrivateIPv6 = vars.PublicIPv6
+
+	keys, err := nc.SSHAgent.List()
+	if err != nil {
+		nc.mu.Unlock()
+		return nil, err
+	}
+
+	conf, err := nspawnConf(userdata, vars, keys)
+	if err != nil {
+		nc.mu.Unlock()
+		return nil, err
+	}
+
+	nc.mu.Unlock()
+
+	m := &nspawnMachine{
+		nc:         nc,
+		id:         id.String(),
+		name:       vars.Name,
+		netif:      netif,
+		veth:       "vk-" + id.String()[:8],
+		peer:       "vc-" + id.String()[:8],
+		destroying: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if err := m.setupRoot(conf.String()); err != nil {
+		m.Destroy()
+		return nil, err
+	}
+
+	if err := m.addDNSRecords(); err != nil {
+		m.Destroy()
+		return nil, err
+	}
+
+	console, err := ioutil.TempFile("", "mantle-nspawn-console")
+	if err != nil {
+		m.Destroy()
+		return nil, err
+	}
+	m.console = console.Name()
+
+	cmd, err := m.start(console)
+	if err != nil {
+		console.Close()
+		m.Destroy()
+		return nil, err
+	}
+	go m.run(cmd, console)
+
+	if err := commonMachineChecks(m); err != nil {
+		m.Destroy()
+		return nil, err
+	}
+
+	nc.mu.Lock()
+	nc.machines[m.ID()] = m
+	nc.mu.Unlock()
+
+	return Machine(m), nil
+}
+
+// nspawnConf renders userdata for a container, authorizing keys. Empty
+// userdata gives a cloud-config, Ignition configs are unsupported.
+func nspawnConf(userdata string, vars UserdataVars, keys []*agent.Key) (*Conf, error) {
+	cfg, err := RenderUserdata(userdata, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := NewConf(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.IsIgnition() {
+		return nil, &UnsupportedError{
+			Platform: "nspawn",
+			Reason:   "Ignition runs in the initramfs, which containers skip",
+		}
+	}
+
+	conf.CopyKeys(keys)
+	return conf, nil
+}
+
+// setupRoot creates the root directory of the container from a copy of
+// the ROOT partition with the USR partition bind mounted on /usr. The
+// container's NIC is configured with DHCP by systemd-networkd and
+// coreos-cloudinit applies userdata at boot.
+func (m *nspawnMachine) setupRoot(userdata string) error {
+	var err error
+	m.dir, err = ioutil.TempDir("", "mantle-nspawn")
+	if err != nil {
+		return err
+	}
+
+	cp := exec.Command("cp", "-a", m.nc.rootDir+"/.", m.dir)
+	if out, err := cp.CombinedOutput(); err != nil {
+		return fmt.Errorf("copying ROOT failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	usr := filepath.Join(m.dir, "usr")
+	if err := os.MkdirAll(usr, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(m.nc.usrDir, usr, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("mounting USR failed: %v", err)
+	}
+	m.usrMounted = true
+
+	network := fmt.Sprintf("[Match]\nMACAddress=%s\n\n[Network]\nDHCP=yes\n", m.netif.HardwareAddr)
+	files := []struct {
+		path     string
+		contents string
+		mode     os.FileMode
+	}{
+		{"etc/systemd/network/10-kola.network", network, 0644},
+		{"var/lib/coreos-install/user_data", userdata, 0600},
+	}
+	for _, f := range files {
+		path := filepath.Join(m.dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(f.contents), f.mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// destroyRoot removes the root directory of the container.
+func (m *nspawnMachine) destroyRoot() error {
+	if m.usrMounted {
+		if err := syscall.Unmount(filepath.Join(m.dir, "usr"), 0); err != nil {
+			return fmt.Errorf("unmounting USR of %s failed: %v", m.id, err)
+		}
+		m.usrMounted = false
+	}
+	if m.dir != "" {
+		return os.RemoveAll(m.dir)
+	}
+	return nil
+}
+
+// addDNSRecords registers m in DNS as its name and as name.br0.local,
+// like QEMU machines on br0.
+func (m *nspawnMachine) addDNSRecords() error {
+	ips := []net.IP{m.netif.DHCPv4[0].IP, m.netif.SLAAC.IP}
+	records := local.DNSRecords{Hosts: []local.HostRecord{
+		{Name: m.name + ".br0.local", IPs: ips},
+		{Name: m.name, IPs: ips},
+	}}
+
+	if err := m.nc.AddDNSRecords(records); err != nil {
+		return err
+	}
+
+	for _, h := range records.Hosts {
+		m.dnsNames = append(m.dnsNames, h.Name)
+	}
+	return nil
+}
+
+// start boots the container with a new veth pair, since the container end
+// goes away with the container's network namespace, and writes its console
+// to console. It returns nil if the machine is being destroyed.
+func (m *nspawnMachine) start(console *os.File) (*local.NsCmd, error) {
+	m.cmdMu.Lock()
+	defer m.cmdMu.Unlock()
+
+	select {
+	case <-m.destroying:
+		return nil, nil
+	default:
+	}
+
+	// the bridge end of the previous pair may linger after a reboot.
+	m.nc.DelLink(m.veth)
+
+	if err := m.nc.NewVeth("br0", m.veth, m.peer, m.netif.HardwareAddr); err != nil {
+		return nil, err
+	}
+
+	cmd := m.nc.NewCommand("systemd-nspawn",
+		"--quiet",
+		"--boot",
+		"--register=no",
+		"--machine="+m.name,
+		"--uuid="+m.id,
+		"--directory="+m.dir,
+		"--network-interface="+m.peer).(*local.NsCmd)
+	cmd.Stdout = console
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		m.nc.DelLink(m.veth)
+		return nil, err
+	}
+
+	m.cmd = cmd
+	return cmd, nil
+}
+
+// run waits for systemd-nspawn to exit, starting the container again when
+// it reboots.
+func (m *nspawnMachine) run(cmd *local.NsCmd, console *os.File) {
+	defer close(m.done)
+	defer console.Close()
+
+	for cmd != nil {
+		err := cmd.Wait()
+
+		select {
+		case <-m.destroying:
+			return
+		default:
+		}
+
+		status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+		if !ok || status.ExitStatus() != nspawnRebootStatus {
+			plog.Warningf("%s: systemd-nspawn exited: %v", m.id, err)
+			return
+		}
+
+		cmd, err = m.start(console)
+		if err != nil {
+			plog.Errorf("%s: restarting after reboot: %v", m.id, err)
+			return
+		}
+	}
+}
+
+// stop shuts down the container, killing it if it takes longer than
+// nspawnStopTimeout.
+func (m *nspawnMachine) stop() {
+	m.cmdMu.Lock()
+	select {
+	case <-m.destroying:
+		m.cmdMu.Unlock()
+		return
+	default:
+	}
+
+	close(m.destroying)
+	if m.cmd == nil {
+		m.cmdMu.Unlock()
+		return
+	}
+	m.cmd.Process.Signal(syscall.SIGTERM)
+	m.cmdMu.Unlock()
+
+	select {
+	case <-m.done:
+		return
+	case <-time.After(nspawnStopTimeout):
+	}
+
+	plog.Warningf("%s did not shut down in %v, killing it", m.id, nspawnStopTimeout)
+	m.cmdMu.Lock()
+	m.cmd.Process.Kill()
+	m.cmdMu.Unlock()
+	<-m.done
+}
+
+func (m *nspawnMachine) ID() string {
+	return m.id
+}
+
+func (m *nspawnMachine) IP() string {
+	return m.netif.DHCPv4[0].IP.String()
+}
+
+func (m *nspawnMachine) PrivateIP() string {
+	return m.IP()
+}
+
+func (m *nspawnMachine) IPs() []string {
+	return []string{m.IP(), m.netif.SLAAC.IP.String()}
+}
+
+func (m *nspawnMachine) SSHClient() (*ssh.Client, error) {
+	return m.nc.SSHAgent.NewClient(m.IP())
+}
+
+func (m *nspawnMachine) SSH(cmd string) ([]byte, error) {
+	client, err := m.SSHClient()
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	defer session.Close()
+
+	session.Stderr = os.Stderr
+	out, err := session.Output(cmd)
+	out = bytes.TrimSpace(out)
+	return out, err
+}
+
+// Reboot reboots the container. systemd-nspawn exits when the container
+// reboots and is started again with a new boot ID.
+func (m *nspawnMachine) Reboot() error {
+	return rebootMachine(m, sshRetries)
+}
+
+func (m *nspawnMachine) WaitForBoot(bootID string) error {
+	return waitForBoot(m, bootID, sshRetries)
+}
+
+func (m *nspawnMachine) ConsoleOutput() (string, error) {
+	out, err := ioutil.ReadFile(m.console)
+	return string(out), err
+}
+
+func (m *nspawnMachine) Destroy() error {
+	m.stop()
+
+	var err error
+	firstErr := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	// deleting the bridge end removes the pair if it is still around.
+	m.nc.DelLink(m.veth)
+
+	if len(m.dnsNames) > 0 {
+		firstErr(m.nc.RemoveDNSRecords(m.dnsNames...))
+	}
+	firstErr(m.destroyRoot())
+	if m.console != "" {
+		firstErr(os.Remove(m.console))
+	}
+
+	m.nc.mu.Lock()
+	delete(m.nc.machines, m.ID())
+	m.nc.mu.Unlock()
+
+	return err
+}
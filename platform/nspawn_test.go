@@ -0,0 +1,54 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coreos/mantle/network"
+)
+
+func TestNspawnConf(t *testing.T) {
+	agent, err := network.NewSSHAgent(&net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	keys, err := agent.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tests without userdata, like coreos.basic, get a cloud-config
+	// with the keys rather than being skipped.
+	for _, userdata := range []string{"", "#cloud-config"} {
+		conf, err := nspawnConf(userdata, standaloneVars(), keys)
+		if err != nil {
+			t.Errorf("userdata %q: %v", userdata, err)
+			continue
+		}
+		if conf.IsIgnition() || !strings.Contains(conf.String(), "ssh-rsa ") {
+			t.Errorf("userdata %q gave %s", userdata, conf)
+		}
+	}
+
+	_, err = nspawnConf(`{"ignitionVersion": 1}`, standaloneVars(), keys)
+	if _, ok := err.(*UnsupportedError); !ok {
+		t.Errorf("Ignition config returned %v, want UnsupportedError", err)
+	}
+}
@@ -16,21 +16,38 @@ package platform
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/go-semver/semver"
+	"github.com/coreos/mantle/Godeps/_workspace/src/github.com/coreos/pkg/capnslog"
 	"github.com/coreos/mantle/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+
+	"github.com/coreos/mantle/kola/harness"
+	"github.com/coreos/mantle/kola/native"
+	"github.com/coreos/mantle/platform/local"
 	"github.com/coreos/mantle/util"
 )
 
+var plog = capnslog.NewPackageLogger("github.com/coreos/mantle", "platform")
+
 const (
 	sshRetries = 10
-	sshTimeout = 2 * time.Second
+
+	// rebootRetries is how often ssh is retried while a machine
+	// reboots, which takes longer than the initial boot on some
+	// platforms due to shutdown.
+	rebootRetries = 30
+	sshTimeout    = 2 * time.Second
 )
 
 // Machine represents a CoreOS instance.
@@ -44,20 +61,90 @@ type Machine interface {
 	// PrivateIP returns the machine's private IP.
 	PrivateIP() string
 
+	// IPs returns all the addresses of the machine, IPv4 and IPv6,
+	// starting with IP.
+	IPs() []string
+
 	// SSHClient establishes a new SSH connection to the machine.
 	SSHClient() (*ssh.Client, error)
 
 	// SSH runs a single command over a new SSH connection.
 	SSH(cmd string) ([]byte, error)
 
+	// ConsoleOutput returns the output of the machine's serial console
+	// so far.
+	ConsoleOutput() (string, error)
+
+	// Reboot reboots the machine and waits for it to boot again, see
+	// WaitForBoot.
+	Reboot() error
+
+	// WaitForBoot waits for the machine to come back after a reboot
+	// initiated otherwise, e.g. by an update. bootID is the BootID of
+	// the machine before the reboot. Once the machine is reachable
+	// with a new boot ID, the checks done on new machines are repeated.
+	WaitForBoot(bootID string) error
+
 	// Destroy terminates the machine and frees associated resources.
 	Destroy() error
 }
 
+// The following interfaces are implemented by machines of platforms
+// offering more control over them, currently QEMU. Tests type-assert a
+// Machine to them and skip when unsupported.
+
+// Pauser is implemented by machines that can be suspended.
+type Pauser interface {
+	// Pause stops the machine's CPUs, Resume restarts them.
+	Pause() error
+	Resume() error
+}
+
+// PowerController is implemented by machines with a virtual power and
+// reset button.
+type PowerController interface {
+	// Powerdown presses the power button, asking the OS to shut down.
+	Powerdown() error
+
+	// Reset resets the machine without shutting down the OS.
+	Reset() error
+}
+
+// Hotplugger is implemented by machines that support adding and
+// removing devices while running.
+type Hotplugger interface {
+	// AttachDisk adds a blank disk of size bytes and returns its ID.
+	AttachDisk(size int64) (string, error)
+
+	// AttachNIC adds a NIC on the network bridge and returns its ID.
+	// Its addresses are in DNS like those of the machine's other NICs.
+	AttachNIC(bridge string) (string, error)
+
+	// Detach asks the OS to release the disk or NIC id and removes it.
+	// The removal completes asynchronously, but what the device used on
+	// the host, e.g. a NIC's tap and DNS records, is released at once.
+	Detach(id string) error
+}
+
+// LinkController is implemented by machines whose NICs can lose their
+// link. The NICs created with a machine are "nic0", "nic1", ...
+type LinkController interface {
+	SetLink(nic string, up bool) error
+}
+
+// Snapshotter is implemented by machines whose state can be saved and
+// restored. Snapshots are stored in the machine's disks, which must
+// support them, e.g. qcow2 overlays.
+type Snapshotter interface {
+	SaveSnapshot(name string) error
+	LoadSnapshot(name string) error
+}
+
 // Cluster represents a cluster of CoreOS machines within a single platform.
 type Cluster interface {
-	// NewMachine creates a new CoreOS machine.
-	NewMachine(config string) (Machine, error)
+	// NewMachine creates a new CoreOS machine. The userdata is rendered
+	// as a template, see UserdataVars.
+	NewMachine(userdata string) (Machine, error)
 
 	// Machines returns a slice of the active machines in the Cluster.
 	Machines() []Machine
@@ -74,45 +161,360 @@ type Cluster interface {
 	Destroy() error
 }
 
+// FaultInjector is implemented by clusters that can simulate network
+// faults between their machines, currently QEMU.
+type FaultInjector interface {
+	// Partition splits machines into groups which cannot reach each
+	// other. Machines not in any group are not affected, and machines
+	// must share a network to be partitioned.
+	Partition(groups ...[]Machine) error
+
+	// SetNetem emulates delay, packet loss and bandwidth limits on
+	// the traffic sent to machine m. Apply it to both ends of a
+	// connection to affect both directions.
+	SetNetem(m Machine, n local.Netem) error
+
+	// Heal removes any partition and emulated conditions.
+	Heal() error
+}
+
+// DNSCluster is implemented by clusters serving DNS to their machines,
+// currently QEMU. Each machine is registered under its UserdataVars Name
+// and as "<Name>.<bridge>.local" for the bridge of each of its NICs.
+type DNSCluster interface {
+	// AddDNSRecords adds arbitrary records.
+	AddDNSRecords(r local.DNSRecords) error
+
+	// RemoveDNSRecords removes the records with the given names,
+	// i.e. host names, SRV services and aliases.
+	RemoveDNSRecords(names ...string) error
+
+	// AddEtcdSRVRecords publishes machines as an etcd cluster for
+	// etcd's DNS discovery and returns the domain to discover.
+	AddEtcdSRVRecords(machines []Machine) (string, error)
+}
+
+// FileServerCluster is implemented by clusters running an HTTP and
+// HTTPS file server for their machines, currently QEMU. Its URLs and
+// certificate are also available to userdata, see UserdataVars.
+type FileServerCluster interface {
+	// AddFile serves contents at path, e.g. "/etcd.tar.gz".
+	AddFile(path string, contents []byte)
+
+	// RemoveFile stops serving the file added at path.
+	RemoveFile(path string)
+
+	// FileURL returns the URL of path for machine m, with HTTPS if
+	// tls is set.
+	FileURL(m Machine, path string, tls bool) (string, error)
+}
+
+// RegistryCluster is implemented by clusters running a Docker registry
+// for their machines, currently QEMU. It serves images preloaded from
+// the host, so container tests need no internet access. The machines'
+// docker trusts the registry over plain HTTP; rkt needs
+// --insecure-options=image,http to fetch from it with a docker:// URL.
+// Only image manifest version 2, schema 2, is served, which needs docker
+// 1.10 or rkt 1.11 or later; TestCluster.LocalImage checks for them.
+type RegistryCluster interface {
+	// RegistryImages returns the images in the registry, as
+	// "repository:tag".
+	RegistryImages() []string
+
+	// RegistryAddr returns the host and port of the registry for
+	// machine m, to prefix image names with.
+	RegistryAddr(m Machine) (string, error)
+}
+
+// DiskKeeper is implemented by clusters which can keep the disks of their
+// machines for post-mortem analysis, e.g. after a failed test.
+type DiskKeeper interface {
+	// KeepDisks makes Destroy keep the disks and console logs of all
+	// machines, including machines that were already destroyed.
+	KeepDisks()
+}
+
+// UnsupportedError is returned by platforms for requests they cannot
+// honor, e.g. Ignition configs on pre-existing hosts. kola skips tests
+// getting it rather than failing them.
+type UnsupportedError struct {
+	Platform string
+	Reason   string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("not supported on %s: %s", e.Platform, e.Reason)
+}
+
+// AttachableCluster is implemented by clusters whose machines other
+// processes can reach while the cluster runs, see kola spawn.
+type AttachableCluster interface {
+	// SSHAgentSocket returns the socket of the agent holding the SSH
+	// key of the machines, see network.AttachSSHAgent.
+	SSHAgentSocket() string
+
+	// NetNSPath returns the path of the network namespace the machines
+	// are reachable in, or "" for the host's.
+	NetNSPath() string
+}
+
 // TestCluster embedds a Cluster to provide platform independant helper
-// methods.
+// methods. It also embedds the harness.T of the running test, which is
+// used for logging, failing and skipping.
 type TestCluster struct {
+	*harness.T
 	Name        string
 	NativeFuncs []string
 	Options     map[string]string
 	Cluster
+
+	// Discovery and ClusterSize are passed to userdata templates of
+	// machines created by NewMachine.
+	Discovery   string
+	ClusterSize int
+
+	// MachineOptions is the shape of machines created on QEMU.
+	MachineOptions QEMUMachineOptions
+
+	kolet     *koletAgents
+	nextIndex *int32
 }
 
-// RunNative runs a registered NativeFunc on a remote machine
-func (t *TestCluster) RunNative(funcName string, m Machine) error {
-	// scp and execute kolet on remote machine
-	client, err := m.SSHClient()
+// NewTestCluster wraps c for running the test name, which may call the
+// native functions nativeFuncs. Results are recorded in t.
+func NewTestCluster(t *harness.T, c Cluster, name string, nativeFuncs []string, options map[string]string) TestCluster {
+	return TestCluster{
+		T:           t,
+		Name:        name,
+		NativeFuncs: nativeFuncs,
+		Options:     options,
+		Cluster:     c,
+		kolet: &koletAgents{
+			agents: make(map[string]*koletAgent),
+		},
+		nextIndex: new(int32),
+	}
+}
+
+// NewMachine creates a new machine in the cluster, rendering userdata with
+// the UserdataVars of the test. Machines are numbered in the order they
+// are created, including machines created by subtests. On QEMU the
+// machine has the shape given by MachineOptions.
+func (t TestCluster) NewMachine(userdata string) (Machine, error) {
+	vars, err := t.userdataVars()
 	if err != nil {
-		return fmt.Errorf("kolet SSH client: %v", err)
+		return nil, err
 	}
 
-	defer client.Close()
+	if oc, ok := t.Cluster.(machineOptionsCluster); ok {
+		return oc.newMachineWithOptions(userdata, vars, t.MachineOptions)
+	}
 
-	session, err := client.NewSession()
+	if tc, ok := t.Cluster.(templateCluster); ok {
+		return tc.newMachine(userdata, vars)
+	}
+
+	// clusters from outside this package get the userdata rendered
+	// without any platform values.
+	ud, err := RenderUserdata(userdata, vars)
 	if err != nil {
-		return fmt.Errorf("kolet SSH session: %v", err)
+		return nil, err
 	}
+	return t.Cluster.NewMachine(ud)
+}
 
-	defer session.Close()
+// NewMachineWithOptions is like NewMachine, but creates a machine with
+// the shape opts in addition to MachineOptions. It fails on platforms
+// other than QEMU.
+func (t TestCluster) NewMachineWithOptions(userdata string, opts QEMUMachineOptions) (Machine, error) {
+	oc, ok := t.Cluster.(machineOptionsCluster)
+	if !ok {
+		return nil, fmt.Errorf("platform does not support machine options")
+	}
+
+	vars, err := t.userdataVars()
+	if err != nil {
+		return nil, err
+	}
+
+	return oc.newMachineWithOptions(userdata, vars, t.MachineOptions.Merge(opts))
+}
+
+// userdataVars returns the UserdataVars of the next machine.
+func (t TestCluster) userdataVars() (UserdataVars, error) {
+	if t.nextIndex == nil {
+		return UserdataVars{}, fmt.Errorf("TestCluster not created by NewTestCluster")
+	}
+
+	index := int(atomic.AddInt32(t.nextIndex, 1) - 1)
+
+	peers := make([]string, t.ClusterSize)
+	for i := range peers {
+		peers[i] = machineName(i)
+	}
+
+	return UserdataVars{
+		Index:       index,
+		Name:        machineName(index),
+		Discovery:   t.Discovery,
+		ClusterSize: t.ClusterSize,
+		Peers:       peers,
+		Options:     t.Options,
+	}, nil
+}
+
+// Run runs f as a subtest called name, sharing the cluster and native
+// functions of t. An error returned by f fails the subtest. Run reports
+// whether the subtest succeeded.
+func (t TestCluster) Run(name string, f func(c TestCluster) error) bool {
+	return t.T.Run(name, func(h *harness.T) {
+		sub := t
+		sub.T = h
+		if err := f(sub); err != nil {
+			h.Error(err)
+		}
+	})
+}
+
+// CallNative runs a registered NativeFunc on a remote machine and returns
+// its result. The kolet agent on m is started on first use and serves all
+// later calls on the same machine. A non-nil error means the function
+// could not be run at all; the function's own failure is reported in the
+// Result.
+func (t *TestCluster) CallNative(m Machine, funcName string, args ...string) (*native.Result, error) {
+	if t.kolet == nil {
+		return nil, fmt.Errorf("TestCluster not created by NewTestCluster")
+	}
+
+	agent, err := t.kolet.get(m)
+	if err != nil {
+		return nil, err
+	}
 
-	b, err := session.CombinedOutput(fmt.Sprintf("./kolet run %q %q", t.Name, funcName))
+	res, err := agent.call(t.Name, funcName, args)
 	if err != nil {
-		return fmt.Errorf("%s", b) // return function std output, not the exit status
+		t.kolet.drop(m)
+		return nil, err
 	}
+
+	return res, nil
+}
+
+// RunNative runs a registered NativeFunc on a remote machine. The output
+// of the function is logged to the test. If the function reports itself
+// as skipped the test is skipped, so RunNative is usually called from its
+// own subtest. args are passed to the function, see native.Args.
+func (t *TestCluster) RunNative(funcName string, m Machine, args ...string) error {
+	res, err := t.CallNative(m, funcName, args...)
+	if err != nil {
+		return err
+	}
+
+	if res.Output != "" {
+		t.Log(res.Output)
+	}
+	for _, f := range res.Files {
+		t.Logf("attached file %s (%d bytes)", f.Name, len(f.Data))
+	}
+
+	switch res.Status {
+	case native.Skip:
+		t.Skip(res.Message)
+	case native.Fail:
+		return errors.New(res.Message)
+	}
+
 	return nil
 }
 
+// Close stops any kolet agents started by CallNative. It does not destroy
+// the Cluster.
+func (t *TestCluster) Close() error {
+	if t.kolet == nil {
+		return nil
+	}
+	return t.kolet.closeAll()
+}
+
 // ListNativeFunctions returns a slice of function names that can be executed
 // directly on machines in the cluster.
 func (t *TestCluster) ListNativeFunctions() []string {
 	return t.NativeFuncs
 }
 
+// registryClients are the oldest versions of the clients that pull from
+// a RegistryCluster, the first supporting image manifest version 2,
+// schema 2, and the commands printing their versions.
+var registryClients = map[string]struct{ min, cmd string }{
+	"docker": {"1.10.0", "docker --version"},
+	"rkt":    {"1.11.0", "rkt version"},
+}
+
+// versionRe matches the version in the output of a --version command.
+var versionRe = regexp.MustCompile(`\d+\.\d+\.\d+`)
+
+// LocalImage returns the name of image, e.g. "busybox", in the cluster's
+// Docker registry as client, "docker" or "rkt", pulls it on m, with the
+// registry's address and the tag. If the cluster has no registry, the
+// registry lacks the image or client is too old for the registry, it
+// logs why and returns "".
+func (t *TestCluster) LocalImage(m Machine, client, image string) (string, error) {
+	name, why, err := t.localImage(m, client, image)
+	if why != "" {
+		t.Log(why)
+	}
+	return name, err
+}
+
+// RegistryImage is like LocalImage, but skips the test if the image
+// can't be pulled from the cluster's registry.
+func (t *TestCluster) RegistryImage(m Machine, client, image string) (string, error) {
+	name, why, err := t.localImage(m, client, image)
+	if why != "" {
+		t.Skip(why)
+	}
+	return name, err
+}
+
+func (t *TestCluster) localImage(m Machine, client, image string) (name, why string, err error) {
+	rc, ok := t.Cluster.(RegistryCluster)
+	if !ok {
+		return "", "cluster has no Docker registry", nil
+	}
+
+	for _, i := range rc.RegistryImages() {
+		if i == image || strings.HasPrefix(i, image+":") {
+			name = i
+			break
+		}
+	}
+	if name == "" {
+		return "", fmt.Sprintf("no %s image in the Docker registry", image), nil
+	}
+
+	c, ok := registryClients[client]
+	if !ok {
+		return "", "", fmt.Errorf("unknown registry client %q", client)
+	}
+	out, err := m.SSH(c.cmd)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s: %v", c.cmd, out, err)
+	}
+	v, err := semver.NewVersion(versionRe.FindString(string(out)))
+	if err != nil {
+		return "", "", fmt.Errorf("%s: no version in %q", c.cmd, out)
+	}
+	if v.LessThan(*semver.Must(semver.NewVersion(c.min))) {
+		return "", fmt.Sprintf("%s %s can't pull from the Docker registry, it needs %s", client, v, c.min), nil
+	}
+
+	addr, err := rc.RegistryAddr(m)
+	if err != nil {
+		return "", "", err
+	}
+	return addr + "/" + name, "", nil
+}
+
 // DropFile places file from localPath to ~/ on every machine in cluster
 func (t *TestCluster) DropFile(localPath string) error {
 	in, err := os.Open(localPath)
@@ -213,12 +615,37 @@ func NewMachines(c Cluster, userdatas []string) ([]Machine, error) {
 	return machs, nil
 }
 
+// consoleLines is how much of the console consoleTail returns.
+const consoleLines = 50
+
+// consoleTail returns the last lines of the console of m, formatted to be
+// appended to an error message.
+func consoleTail(m Machine) string {
+	out, err := m.ConsoleOutput()
+	if err != nil {
+		plog.Warningf("reading console of %s: %v", m.ID(), err)
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) > consoleLines {
+		lines = lines[len(lines)-consoleLines:]
+	}
+	return "\nconsole:\n" + strings.Join(lines, "\n")
+}
+
 // commonMachineChecks tests a machine for various error conditions such as ssh
 // being available and no systemd units failing at the time ssh is reachable.
 // It also ensures the remote system is running CoreOS.
 //
 // TODO(mischief): better error messages.
 func commonMachineChecks(m Machine) error {
+	return machineChecks(m, sshRetries)
+}
+
+// machineChecks is commonMachineChecks waiting for ssh up to retries
+// times, for machines that are known to boot slowly.
+func machineChecks(m Machine, retries int) error {
 	// ensure ssh works
 	sshChecker := func() error {
 		_, err := m.SSH("true")
@@ -228,8 +655,8 @@ func commonMachineChecks(m Machine) error {
 		return nil
 	}
 
-	if err := util.Retry(sshRetries, sshTimeout, sshChecker); err != nil {
-		return fmt.Errorf("ssh unreachable: %v", err)
+	if err := util.Retry(retries, sshTimeout, sshChecker); err != nil {
+		return fmt.Errorf("ssh unreachable: %v%s", err, consoleTail(m))
 	}
 
 	// ensure we're talking to a CoreOS system
@@ -254,3 +681,61 @@ func commonMachineChecks(m Machine) error {
 
 	return nil
 }
+
+// BootID returns the boot ID of m, which changes on every boot.
+func BootID(m Machine) (string, error) {
+	out, err := m.SSH("cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", fmt.Errorf("reading boot ID of %s: %v", m.ID(), err)
+	}
+	return string(out), nil
+}
+
+// rebootMachine reboots m and waits for it to boot again, waiting for
+// ssh up to retries times per step.
+func rebootMachine(m Machine, retries int) error {
+	bootID, err := BootID(m)
+	if err != nil {
+		return err
+	}
+
+	// the command fails when the connection drops, which is expected.
+	m.SSH("sudo systemctl reboot")
+
+	return waitForBoot(m, bootID, retries)
+}
+
+// waitForBoot waits for m to go down and come back with a boot ID other
+// than bootID, then runs the common machine checks.
+func waitForBoot(m Machine, bootID string, retries int) error {
+	// the machine may already be back by the time the drop could be
+	// observed, so a reachable machine with a new boot ID also counts.
+	downChecker := func() error {
+		id, err := BootID(m)
+		if err != nil || id != bootID {
+			return nil
+		}
+		return fmt.Errorf("machine %s still up", m.ID())
+	}
+
+	if err := util.Retry(retries, sshTimeout, downChecker); err != nil {
+		return fmt.Errorf("waiting for reboot: %v", err)
+	}
+
+	bootChecker := func() error {
+		id, err := BootID(m)
+		if err != nil {
+			return err
+		}
+		if id == bootID {
+			return fmt.Errorf("machine %s did not reboot", m.ID())
+		}
+		return nil
+	}
+
+	if err := util.Retry(rebootRetries*retries/sshRetries, sshTimeout, bootChecker); err != nil {
+		return fmt.Errorf("waiting for boot: %v%s", err, consoleTail(m))
+	}
+
+	return machineChecks(m, retries)
+}
@@ -15,9 +15,16 @@
 package platform
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -32,13 +39,356 @@ import (
 type QEMUOptions struct {
 	// DiskImage is the full path to the disk image to boot in QEMU.
 	DiskImage string
+
+	// Arch is the GOARCH of the image, "amd64" (the default) or
+	// "arm64". It selects the QEMU binary, machine type and firmware,
+	// which can be overridden by Binary, Machine and Firmware.
+	Arch     string
+	Binary   string
+	Machine  string
+	Firmware string
+
+	// EFICode and EFIVars override the UEFI firmware and the template
+	// of its variable store used by machines with EFI set.
+	EFICode string
+	EFIVars string
+
+	// Overlay gives each machine a qcow2 overlay backed by its disk
+	// images instead of a full copy of them.
+	Overlay bool
+
+	// PreserveDir is where overlays are created if set. When the test
+	// fails they are kept there for post-mortem analysis, see
+	// DiskKeeper; otherwise they are removed with the cluster.
+	PreserveDir string
+
+	// PXEKernel and PXEInitrd are the images booted by machines with
+	// PXE set. By default the SDK's coreos_production_pxe.vmlinuz and
+	// coreos_production_pxe_image.cpio.gz next to DiskImage are used.
+	PXEKernel string
+	PXEInitrd string
+
+	// FileServerDir is served by the cluster's file server if set.
+	FileServerDir string
+
+	// RegistryImages are `docker save` tarballs served by the cluster's
+	// Docker registry, see RegistryCluster. Machines' docker trusts
+	// the registry if any are given.
+	RegistryImages []string
+
+	// Accel is "kvm" or "tcg". By default KVM is used if /dev/kvm is
+	// usable and the image is for the host's architecture, otherwise
+	// QEMU falls back to the much slower TCG emulation.
+	Accel string
+
+	// QEMUMachineOptions is the default shape of machines in the
+	// cluster.
+	QEMUMachineOptions
+
+	// Topology describes the networks of the cluster.
+	Topology Topology
+
+	// UplinkRange is the IPv4 network in CIDR notation the host's end
+	// of NAT uplinks is addressed from, see local.Topology.
+	UplinkRange string
+}
+
+// Topology describes which network segments the machines of a QEMU
+// cluster attach to, and how the segments are connected.
+type Topology struct {
+	// Machines lists the bridges each machine attaches to, by the
+	// Index of its UserdataVars. Machines without an entry, or with
+	// Networks set in their QEMUMachineOptions, are not affected.
+	// A machine's first NIC provides its IP and, if it has more than
+	// one, the second its PrivateIP.
+	Machines [][]string
+
+	local.Topology
+}
+
+// qemuArch holds the defaults for emulating an architecture.
+type qemuArch struct {
+	binary   string
+	machine  string
+	cpu      string // CPU model used with TCG; KVM uses the host CPU
+	firmware string
+	console  string // serial console of the kernel
+
+	// UEFI firmware and its variable store template, with and
+	// without Secure Boot keys enrolled.
+	efiCode, efiVars       string
+	secureCode, secureVars string
+}
+
+var qemuArches = map[string]qemuArch{
+	"amd64": {
+		binary:     "qemu-system-x86_64",
+		machine:    "pc",
+		cpu:        "qemu64",
+		console:    "ttyS0",
+		efiCode:    "/usr/share/OVMF/OVMF_CODE.fd",
+		efiVars:    "/usr/share/OVMF/OVMF_VARS.fd",
+		secureCode: "/usr/share/OVMF/OVMF_CODE.secboot.fd",
+		secureVars: "/usr/share/OVMF/OVMF_VARS.secboot.fd",
+	},
+	"arm64": {
+		binary:   "qemu-system-aarch64",
+		machine:  "virt",
+		cpu:      "cortex-a57",
+		console:  "ttyAMA0",
+		firmware: "/usr/share/AAVMF/AAVMF_CODE.fd",
+		efiCode:  "/usr/share/AAVMF/AAVMF_CODE.fd",
+		efiVars:  "/usr/share/AAVMF/AAVMF_VARS.fd",
+	},
+}
+
+// tcgSlowdown is how much longer machines emulated with TCG are given to
+// boot.
+const tcgSlowdown = 10
+
+// kvmAvailable reports whether /dev/kvm can be used.
+func kvmAvailable() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// resolve fills in the defaults for the architecture and accelerator.
+func (o *QEMUOptions) resolve() error {
+	if o.Arch == "" {
+		o.Arch = "amd64"
+	}
+
+	arch, ok := qemuArches[o.Arch]
+	if !ok {
+		return fmt.Errorf("unsupported QEMU architecture %q", o.Arch)
+	}
+	if o.Binary == "" {
+		o.Binary = arch.binary
+	}
+	if o.Machine == "" {
+		o.Machine = arch.machine
+	}
+	if o.Firmware == "" {
+		o.Firmware = arch.firmware
+	}
+	if o.PXEKernel == "" {
+		o.PXEKernel = filepath.Join(filepath.Dir(o.DiskImage), "coreos_production_pxe.vmlinuz")
+	}
+	if o.PXEInitrd == "" {
+		o.PXEInitrd = filepath.Join(filepath.Dir(o.DiskImage), "coreos_production_pxe_image.cpio.gz")
+	}
+
+	switch o.Accel {
+	case "":
+		if o.Arch == runtime.GOARCH && kvmAvailable() {
+			o.Accel = "kvm"
+		} else {
+			plog.Warningf("KVM unavailable for %s, falling back to TCG; machines will be slow", o.Arch)
+			o.Accel = "tcg"
+		}
+	case "kvm", "tcg":
+	default:
+		return fmt.Errorf("invalid QEMU accelerator %q", o.Accel)
+	}
+
+	return nil
+}
+
+// cpuArgs returns the QEMU arguments selecting the machine, CPU and
+// firmware of a machine of shape opts. UEFI firmware is set up by efiArgs.
+func (o *QEMUOptions) cpuArgs(opts QEMUMachineOptions) []string {
+	cpu := "host"
+	if o.Accel == "tcg" {
+		cpu = qemuArches[o.Arch].cpu
+	}
+
+	// OVMF only enforces Secure Boot on q35 with SMM.
+	machine := o.Machine
+	if opts.SecureBoot {
+		machine = "q35,smm=on"
+	}
+
+	args := []string{
+		"-machine", machine + ",accel=" + o.Accel,
+		"-cpu", cpu,
+	}
+	if opts.SecureBoot {
+		args = append(args, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+	if o.Firmware != "" && !opts.EFI {
+		args = append(args, "-bios", o.Firmware)
+	}
+	return args
+}
+
+// efiFirmware returns the UEFI firmware and variable store template for a
+// machine of shape opts.
+func (o *QEMUOptions) efiFirmware(opts QEMUMachineOptions) (code, vars string, err error) {
+	arch := qemuArches[o.Arch]
+	code, vars = arch.efiCode, arch.efiVars
+	if opts.SecureBoot {
+		code, vars = arch.secureCode, arch.secureVars
+	}
+
+	if o.EFICode != "" {
+		code = o.EFICode
+	}
+	if o.EFIVars != "" {
+		vars = o.EFIVars
+	}
+
+	if code == "" || vars == "" {
+		return "", "", fmt.Errorf("no UEFI firmware for %s (Secure Boot: %v)", o.Arch, opts.SecureBoot)
+	}
+	return code, vars, nil
+}
+
+// QEMUMachineOptions describes the virtual hardware of a QEMU machine.
+// Zero values select the defaults.
+type QEMUMachineOptions struct {
+	// CPUs is the number of virtual CPUs, 2 by default.
+	CPUs int
+
+	// Memory is the amount of memory in MiB, 1024 by default.
+	Memory int
+
+	// Disks are attached in addition to the boot disk.
+	Disks []QEMUDisk
+
+	// Networks lists the bridges of the Dnsmasq segments to attach a
+	// NIC to, in order. The first NIC provides the machine's IP. By
+	// default there is a single NIC on br0.
+	Networks []string
+
+	// ExtraArgs are appended to the QEMU command line.
+	ExtraArgs []string
+
+	// EFI boots the machine with UEFI firmware instead of the BIOS,
+	// with its own writable copy of the variable store. SecureBoot
+	// implies EFI and uses a variable store with Secure Boot keys
+	// enrolled.
+	EFI        bool
+	SecureBoot bool
+
+	// PXE boots the machine diskless from the network with iPXE,
+	// rather than from a disk image. The PXE image needs at least
+	// 2048 MiB of memory.
+	PXE bool
+
+	// IPv6Only denies DHCPv4 to the machine's NICs, which then only
+	// get IPv6 addresses. IP and PrivateIP return their SLAAC
+	// addresses, which SSH uses. The etcd discovery URL of the cluster
+	// is not reachable from such machines, use DNS discovery instead.
+	IPv6Only bool
+}
+
+// QEMUDisk is an additional disk of a QEMU machine.
+type QEMUDisk struct {
+	// Image is copied to create a pre-populated disk. If it is empty a
+	// blank disk of Size bytes is created instead.
+	Image string
+	Size  int64
+
+	// Interface is "virtio" (the default), "scsi" or "nvme".
+	Interface string
+}
+
+// ParseQEMUDisk parses a disk given on the command line, either a size
+// such as "5G" for a blank disk or the path of an image, optionally
+// followed by the interface, e.g. "5G,if=nvme".
+func ParseQEMUDisk(spec string) (QEMUDisk, error) {
+	var disk QEMUDisk
+
+	parts := strings.Split(spec, ",")
+	for _, opt := range parts[1:] {
+		if !strings.HasPrefix(opt, "if=") {
+			return disk, fmt.Errorf("invalid disk option %q", opt)
+		}
+		disk.Interface = strings.TrimPrefix(opt, "if=")
+	}
+
+	if size, err := parseSize(parts[0]); err == nil {
+		disk.Size = size
+	} else {
+		disk.Image = parts[0]
+	}
+
+	return disk, disk.validate()
+}
+
+func (d QEMUDisk) validate() error {
+	switch d.Interface {
+	case "", "virtio", "scsi", "nvme":
+	default:
+		return fmt.Errorf("invalid disk interface %q", d.Interface)
+	}
+	if d.Image == "" && d.Size <= 0 {
+		return fmt.Errorf("disk needs an image or a size")
+	}
+	return nil
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T
+// suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			mult = 1 << 10
+		case 'M', 'm':
+			mult = 1 << 20
+		case 'G', 'g':
+			mult = 1 << 30
+		case 'T', 't':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:n-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * mult, nil
+}
+
+// Merge returns o with the requirements of r added: the larger CPU and
+// memory counts win, disks and extra arguments of both are used and the
+// networks of r replace those of o if set.
+func (o QEMUMachineOptions) Merge(r QEMUMachineOptions) QEMUMachineOptions {
+	if r.CPUs > o.CPUs {
+		o.CPUs = r.CPUs
+	}
+	if r.Memory > o.Memory {
+		o.Memory = r.Memory
+	}
+	o.Disks = append(append([]QEMUDisk(nil), o.Disks...), r.Disks...)
+	if len(r.Networks) > 0 {
+		o.Networks = r.Networks
+	}
+	o.ExtraArgs = append(append([]string(nil), o.ExtraArgs...), r.ExtraArgs...)
+	o.EFI = o.EFI || r.EFI
+	o.SecureBoot = o.SecureBoot || r.SecureBoot
+	o.PXE = o.PXE || r.PXE
+	o.IPv6Only = o.IPv6Only || r.IPv6Only
+	return o
 }
 
 type qemuCluster struct {
 	mu sync.Mutex
 	*local.LocalCluster
-	machines map[string]*qemuMachine
-	conf     QEMUOptions
+	machines  map[string]*qemuMachine
+	conf      QEMUOptions
+	overlays  []string // overlays in conf.PreserveDir
+	consoles  []string // console logs of all machines, removed by Destroy
+	keepDisks bool
 }
 
 type qemuMachine struct {
@@ -46,17 +396,71 @@ type qemuMachine struct {
 	id          string
 	qemu        exec.Cmd
 	configDrive *local.ConfigDrive
-	netif       *local.Interface
+	ignition    *local.IgnitionConfig
+	pxe         bool
+	ipv6Only    bool
+	name        string           // UserdataVars Name
+	bridge      string           // bridge of the first NIC
+	domain      string           // DNS domain of the first NIC
+	dnsNames    []string         // names of the machine's DNS records
+	netif       *local.Interface // provides IP
+	privateIf   *local.Interface // provides PrivateIP
+	netifs      []*local.Interface
+	taps        []string
+	console     string
+
+	// qmpDir holds the QMP socket, qmp is connected on first use.
+	qmpDir  string
+	qmpMu   sync.Mutex
+	qmp     *local.QMP
+	devices int // counter for hotplugged device IDs
+
+	// hotplugged holds what Detach releases, by device ID; guarded by
+	// qmpMu.
+	hotplugged map[string]*hotDevice
 }
 
 // NewQemuCluster creates a Cluster instance, suitable for running virtual
 // machines in QEMU.
 func NewQemuCluster(conf QEMUOptions) (Cluster, error) {
+	if err := conf.resolve(); err != nil {
+		return nil, err
+	}
+
+	if conf.PreserveDir != "" {
+		if err := os.MkdirAll(conf.PreserveDir, 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	topology := conf.Topology.Topology
+	if conf.UplinkRange != "" {
+		_, r, err := net.ParseCIDR(conf.UplinkRange)
+		if err != nil {
+			return nil, fmt.Errorf("uplink range: %v", err)
+		}
+		topology.UplinkRange = r
+	}
+
 	lc, err := local.NewLocalCluster()
 	if err != nil {
 		return nil, err
 	}
 
+	if err := lc.SetTopology(topology); err != nil {
+		lc.Destroy()
+		return nil, err
+	}
+
+	lc.FileServer.Dir = conf.FileServerDir
+
+	for _, image := range conf.RegistryImages {
+		if err := lc.Registry.LoadImage(image); err != nil {
+			lc.Destroy()
+			return nil, err
+		}
+	}
+
 	qc := &qemuCluster{
 		LocalCluster: lc,
 		machines:     make(map[string]*qemuMachine),
@@ -81,22 +485,158 @@ func (qc *qemuCluster) Destroy() error {
 	for _, qm := range qc.machines {
 		qm.destroy(true)
 	}
+
+	for _, overlay := range qc.overlays {
+		if qc.keepDisks {
+			plog.Noticef("kept disk %s", overlay)
+		} else {
+			os.Remove(overlay)
+		}
+	}
+
+	for _, console := range qc.consoles {
+		switch {
+		case qc.keepDisks && qc.conf.PreserveDir != "":
+			plog.Noticef("kept console %s", console)
+			continue
+		case qc.keepDisks:
+			logConsoleTail(console)
+		}
+		os.Remove(console)
+	}
+
 	return qc.LocalCluster.Destroy()
 }
 
-func (qc *qemuCluster) NewMachine(cfg string) (Machine, error) {
+// consoleTailLines is how much of the console of each machine is logged
+// when KeepDisks has no PreserveDir to keep the console in.
+const consoleTailLines = 50
+
+// logConsoleTail logs the end of the console log in the file path.
+func logConsoleTail(path string) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		plog.Errorf("reading console: %v", err)
+		return
+	}
+
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) > consoleTailLines {
+		lines = lines[len(lines)-consoleTailLines:]
+	}
+	plog.Noticef("end of console %s:\n%s", filepath.Base(path), strings.Join(lines, "\n"))
+}
+
+// KeepDisks keeps the overlays and console logs of all machines in
+// PreserveDir when the cluster is destroyed; overlays are only kept if
+// Overlay is set too. Without PreserveDir the end of each console log
+// is logged instead.
+func (qc *qemuCluster) KeepDisks() {
+	qc.mu.Lock()
+	qc.keepDisks = true
+	qc.mu.Unlock()
+}
+
+func (qc *qemuCluster) NewMachine(userdata string) (Machine, error) {
+	return qc.newMachine(userdata, standaloneVars())
+}
+
+func (qc *qemuCluster) newMachine(userdata string, vars UserdataVars) (Machine, error) {
+	return qc.newMachineWithOptions(userdata, vars, QEMUMachineOptions{})
+}
+
+func (qc *qemuCluster) newMachineWithOptions(userdata string, vars UserdataVars, opts QEMUMachineOptions) (Machine, error) {
 	id := uuid.NewV4()
 
-	// hacky solution for cloud config ip substitution
-	// NOTE: escaping is not supported
+	if len(opts.Networks) == 0 && vars.Index < len(qc.conf.Topology.Machines) {
+		opts.Networks = qc.conf.Topology.Machines[vars.Index]
+	}
+	opts = qc.conf.QEMUMachineOptions.Merge(opts)
+	if opts.CPUs == 0 {
+		opts.CPUs = 2
+	}
+	if opts.Memory == 0 {
+		opts.Memory = 1024
+	}
+	if len(opts.Networks) == 0 {
+		opts.Networks = []string{"br0"}
+	}
+	if opts.SecureBoot {
+		opts.EFI = true
+	}
+
+	var efiCode, efiVars string
+	if opts.EFI {
+		var err error
+		efiCode, efiVars, err = qc.conf.efiFirmware(opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range opts.Disks {
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.PXE {
+		for _, image := range []string{qc.conf.PXEKernel, qc.conf.PXEInitrd} {
+			if _, err := os.Stat(image); err != nil {
+				return nil, fmt.Errorf("PXE image: %v", err)
+			}
+		}
+		if err := qc.StartPXE(qc.conf.PXEKernel, qc.conf.PXEInitrd); err != nil {
+			return nil, err
+		}
+	}
+
 	qc.mu.Lock()
-	netif := qc.Dnsmasq.GetInterface("br0")
-	ip := strings.Split(netif.DHCPv4[0].String(), "/")[0]
+	netifs, err := qc.getInterfaces(opts.Networks)
+	if err != nil {
+		qc.mu.Unlock()
+		return nil, err
+	}
+	// the interfaces go back if the machine fails to come up.
+	created := false
+	defer func() {
+		if !created {
+			qc.mu.Lock()
+			qc.putInterfaces(netifs)
+			qc.mu.Unlock()
+		}
+	}()
+	// a machine's second NIC, if any, is its private one.
+	netif, privateIf := netifs[0], netifs[0]
+	if len(netifs) > 1 {
+		privateIf = netifs[1]
+	}
+
+	if opts.IPv6Only {
+		for _, n := range netifs {
+			if err := qc.DisableDHCPv4(n); err != nil {
+				qc.mu.Unlock()
+				return nil, err
+			}
+		}
+	} else {
+		vars.PublicIPv4 = netif.DHCPv4[0].IP.String()
+		vars.PrivateIPv4 = privateIf.DHCPv4[0].IP.String()
+	}
 
-	cfg = strings.Replace(cfg, "$public_ipv4", ip, -1)
-	cfg = strings.Replace(cfg, "$private_ipv4", ip, -1)
+	vars.Platform = "qemu"
+	vars.PublicIPv6 = netif.SLAAC.IP.String()
+	vars.PrivateIPv6 = privateIf.SLAAC.IP.String()
+	vars.FileServer, vars.FileServerTLS = qc.fileServerURLs(opts.Networks[0], opts.IPv6Only)
+	vars.FileServerCA = qc.FileServer.CACert
+	vars.Registry = qc.registryAddr(opts.Networks[0], opts.IPv6Only)
 
-	conf, err := NewConf(cfg)
+	cfg, err := RenderUserdata(userdata, vars)
+	if err != nil {
+		qc.mu.Unlock()
+		return nil, err
+	}
+
+	// QEMU passes Ignition configs with fw_cfg, so default to Ignition.
+	conf, err := newConf(cfg, true)
 	if err != nil {
 		qc.mu.Unlock()
 		return nil, err
@@ -110,64 +650,215 @@ func (qc *qemuCluster) NewMachine(cfg string) (Machine, error) {
 
 	conf.CopyKeys(keys)
 
+	if len(qc.conf.RegistryImages) > 0 {
+		conf.AddSystemdUnitDropin("docker.service", "10-kola-registry.conf",
+			"[Service]\nEnvironment=\"DOCKER_OPTS=--insecure-registry="+vars.Registry+"\"\n")
+	}
+
 	qc.mu.Unlock()
 
-	configDrive, err := local.NewConfigDrive(conf.String())
-	if err != nil {
-		return nil, err
+	qm := &qemuMachine{
+		qc:        qc,
+		id:        id.String(),
+		netif:     netif,
+		privateIf: privateIf,
+		netifs:    netifs,
+		ipv6Only:  opts.IPv6Only,
 	}
 
-	qm := &qemuMachine{
-		qc:          qc,
-		id:          id.String(),
-		configDrive: configDrive,
-		netif:       netif,
+	// Ignition reads its config from fw_cfg, coreos-cloudinit from a
+	// config drive. Machines booting with PXE fetch it from the
+	// PXEServer instead.
+	var configArgs []string
+	switch {
+	case opts.PXE:
+		cmdline := "console=" + qemuArches[qc.conf.Arch].console
+		qc.PXE.AddMachine(netif.HardwareAddr, cmdline, conf.String(), conf.IsIgnition())
+		qm.pxe = true
+	case conf.IsIgnition():
+		qm.ignition, err = local.NewIgnitionConfig(conf.String())
+		if err != nil {
+			return nil, err
+		}
+		configArgs = qm.ignition.FwCfgArgs()
+	default:
+		qm.configDrive, err = local.NewConfigDrive(conf.String())
+		if err != nil {
+			return nil, err
+		}
+		configArgs = []string{
+			"-fsdev", "local,id=cfg,security_model=none,readonly,path=" + qm.configDrive.Directory,
+			"-device", "virtio-9p-pci,fsdev=cfg,mount_tag=config-2",
+		}
 	}
 
-	disk, err := setupDisk(qc.conf.DiskImage)
-	if err != nil {
+	if err := qm.addDNSRecords(vars.Name, opts.Networks); err != nil {
+		qm.destroyConfig()
 		return nil, err
 	}
-	defer disk.Close()
+
+	// files passed to QEMU, starting at fd 3: the disks and EFI
+	// variables, then a tap for each NIC. Each disk is also added to
+	// its own fdset, numbered from 1.
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	qmArgs := append(qc.conf.cpuArgs(opts),
+		"-smp", strconv.Itoa(opts.CPUs),
+		"-m", strconv.Itoa(opts.Memory),
+		"-uuid", qm.id,
+		"-display", "none",
+	)
+
+	if opts.PXE {
+		qmArgs = append(qmArgs, "-boot", "order=n")
+	} else {
+		disk, format, err := qc.setupImage(qc.conf.DiskImage, qm.id)
+		if err != nil {
+			qm.destroyConfig()
+			return nil, err
+		}
+		files = append(files, disk)
+
+		qmArgs = append(qmArgs,
+			"-add-fd", "fd=3,set=1",
+			"-drive", "file=/dev/fdset/1,media=disk,if=virtio,format="+format)
+	}
+
+	if opts.EFI {
+		// the variable store is written to, so each machine gets
+		// its own copy.
+		vars, err := setupDisk(efiVars)
+		if err != nil {
+			qm.destroyConfig()
+			return nil, err
+		}
+		files = append(files, vars)
+
+		fd, set := len(files)+2, len(files)
+		qmArgs = append(qmArgs,
+			"-drive", "if=pflash,format=raw,unit=0,readonly=on,file="+efiCode,
+			"-add-fd", fmt.Sprintf("fd=%d,set=%d", fd, set),
+			"-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=/dev/fdset/%d", set))
+	}
+
+	scsi := false
+	for i, d := range opts.Disks {
+		var f *os.File
+		format := "raw"
+		if d.Image != "" {
+			f, format, err = qc.setupImage(d.Image, fmt.Sprintf("%s-disk%d", qm.id, i+1))
+		} else {
+			f, err = setupBlankDisk(d.Size)
+		}
+		if err != nil {
+			qm.destroyConfig()
+			return nil, err
+		}
+		files = append(files, f)
+
+		fd, set, id := len(files)+2, len(files), fmt.Sprintf("disk%d", i+1)
+		qmArgs = append(qmArgs,
+			"-add-fd", fmt.Sprintf("fd=%d,set=%d", fd, set),
+			"-drive", fmt.Sprintf("file=/dev/fdset/%d,if=none,id=%s,format=%s", set, id, format))
+
+		switch d.Interface {
+		case "", "virtio":
+			qmArgs = append(qmArgs, "-device", "virtio-blk-pci,drive="+id)
+		case "scsi":
+			if !scsi {
+				qmArgs = append(qmArgs, "-device", "virtio-scsi-pci,id=scsi")
+				scsi = true
+			}
+			qmArgs = append(qmArgs, "-device", "scsi-hd,bus=scsi.0,drive="+id)
+		case "nvme":
+			qmArgs = append(qmArgs, "-device", "nvme,serial="+id+",drive="+id)
+		}
+	}
 
 	qc.mu.Lock()
 
-	tap, err := qc.NewTap("br0")
+	for i, bridge := range opts.Networks {
+		tap, err := qc.NewTap(bridge)
+		if err != nil {
+			qc.mu.Unlock()
+			qm.destroyConfig()
+			return nil, err
+		}
+		files = append(files, tap.File)
+		qm.taps = append(qm.taps, tap.Attrs().Name)
+
+		mac := netifs[i].HardwareAddr.String()
+		qmArgs = append(qmArgs,
+			"-netdev", fmt.Sprintf("tap,id=tap%d,fd=%d", i, len(files)+2),
+			"-device", fmt.Sprintf("virtio-net,netdev=tap%d,mac=%s,id=nic%d", i, mac, i))
+	}
+
+	qm.qmpDir, err = ioutil.TempDir("", "mantle-qemu-qmp")
 	if err != nil {
 		qc.mu.Unlock()
+		qm.destroyConfig()
 		return nil, err
 	}
-	defer tap.Close()
+	qmArgs = append(qmArgs, "-qmp", "unix:"+qm.qmpSocket()+",server,nowait")
 
-	qmMac := qm.netif.HardwareAddr.String()
-	qmCfg := qm.configDrive.Directory
-	qm.qemu = qm.qc.NewCommand(
-		"qemu-system-x86_64",
-		"-machine", "accel=kvm",
-		"-cpu", "host",
-		"-smp", "2",
-		"-m", "1024",
-		"-uuid", qm.id,
-		"-display", "none",
-		"-add-fd", "fd=3,set=1",
-		"-drive", "file=/dev/fdset/1,media=disk,if=virtio,format=raw",
-		"-netdev", "tap,id=tap,fd=4",
-		"-device", "virtio-net,netdev=tap,mac="+qmMac,
-		"-fsdev", "local,id=cfg,security_model=none,readonly,path="+qmCfg,
-		"-device", "virtio-9p-pci,fsdev=cfg,mount_tag=config-2")
+	// the serial console is written to stdout and from there to
+	// the file returned by ConsoleOutput.
+	qmArgs = append(qmArgs,
+		"-chardev", "stdio,id=console,signal=off",
+		"-serial", "chardev:console")
+
+	qmArgs = append(qmArgs, configArgs...)
+	qmArgs = append(qmArgs, opts.ExtraArgs...)
+	qm.qemu = qm.qc.NewCommand(qc.conf.Binary, qmArgs...)
 
 	qc.mu.Unlock()
 
 	cmd := qm.qemu.(*local.NsCmd)
 	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = append(cmd.ExtraFiles, disk)     // fd=3
-	cmd.ExtraFiles = append(cmd.ExtraFiles, tap.File) // fd=4
+	cmd.ExtraFiles = append(cmd.ExtraFiles, files...)
+
+	// the console outlives the machine until the cluster is destroyed,
+	// to be kept with its disks if the test fails.
+	var console *os.File
+	if qc.conf.PreserveDir != "" {
+		console, err = os.Create(filepath.Join(qc.conf.PreserveDir, qm.id+"-console.log"))
+	} else {
+		console, err = ioutil.TempFile("", "mantle-qemu-console")
+	}
+	if err != nil {
+		os.RemoveAll(qm.qmpDir)
+		qm.destroyConfig()
+		return nil, err
+	}
+	qm.console = console.Name()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		console.Close()
+		os.Remove(qm.console)
+		os.RemoveAll(qm.qmpDir)
+		qm.destroyConfig()
+		return nil, err
+	}
+	go qm.copyConsole(stdout, console)
 
 	if err = qm.qemu.Start(); err != nil {
+		os.Remove(qm.console)
+		os.RemoveAll(qm.qmpDir)
+		qm.destroyConfig()
 		return nil, err
 	}
 
-	if err := commonMachineChecks(qm); err != nil {
+	qc.mu.Lock()
+	qc.consoles = append(qc.consoles, qm.console)
+	qc.mu.Unlock()
+
+	if err := machineChecks(qm, qm.retries()); err != nil {
 		qm.Destroy()
 		return nil, err
 	}
@@ -176,9 +867,311 @@ func (qc *qemuCluster) NewMachine(cfg string) (Machine, error) {
 	qc.machines[qm.ID()] = qm
 	qc.mu.Unlock()
 
+	created = true
+
 	return Machine(qm), nil
 }
 
+// addDNSRecords registers m in DNS as name, and as name.<bridge>.local
+// for each of the bridges of its NICs.
+func (m *qemuMachine) addDNSRecords(name string, bridges []string) error {
+	m.name = name
+	m.bridge = bridges[0]
+	m.domain = bridges[0] + ".local"
+
+	var records local.DNSRecords
+	all := local.HostRecord{Name: name}
+	for i, netif := range m.netifs {
+		ips := m.netifIPs(netif)
+		all.IPs = append(all.IPs, ips...)
+		records.Hosts = append(records.Hosts, local.HostRecord{
+			Name: name + "." + bridges[i] + ".local",
+			IPs:  ips,
+		})
+	}
+	records.Hosts = append(records.Hosts, all)
+
+	if err := m.qc.AddDNSRecords(records); err != nil {
+		return err
+	}
+
+	for _, h := range records.Hosts {
+		m.dnsNames = append(m.dnsNames, h.Name)
+	}
+	return nil
+}
+
+// netifIPs returns the addresses of netif, without IPv4 if m is IPv6
+// only.
+func (m *qemuMachine) netifIPs(netif *local.Interface) []net.IP {
+	var ips []net.IP
+	if !m.ipv6Only {
+		ips = append(ips, netif.DHCPv4[0].IP)
+	}
+	return append(ips, netif.SLAAC.IP)
+}
+
+// AddEtcdSRVRecords publishes machines as the members of an etcd
+// cluster for etcd's DNS discovery (discovery-srv) in the domain of their
+// first NIC, "<bridge>.local", which is returned.
+func (qc *qemuCluster) AddEtcdSRVRecords(machines []Machine) (string, error) {
+	var domain string
+	var records local.DNSRecords
+	for _, m := range machines {
+		qm, ok := m.(*qemuMachine)
+		if !ok || qm.qc != qc {
+			return "", fmt.Errorf("machine %s is not part of the cluster", m.ID())
+		}
+		if domain == "" {
+			domain = qm.domain
+		} else if qm.domain != domain {
+			return "", fmt.Errorf("machines are in different domains %s and %s", domain, qm.domain)
+		}
+
+		target := qm.name + "." + domain
+		records.SRVs = append(records.SRVs,
+			local.SRVRecord{Service: "_etcd-server._tcp." + domain, Target: target, Port: 2380},
+			local.SRVRecord{Service: "_etcd-client._tcp." + domain, Target: target, Port: 2379})
+	}
+
+	return domain, qc.AddDNSRecords(records)
+}
+
+// bridgeAddr returns the host and port of a server on the bridge, on
+// its IPv6 address if ipv6 is set.
+func (qc *qemuCluster) bridgeAddr(bridge string, port int, ipv6 bool) string {
+	var ip net.IP
+	for _, seg := range qc.Dnsmasq.Segments {
+		if seg.BridgeName == bridge {
+			ip = seg.BridgeIf.DHCPv4[0].IP
+			if ipv6 {
+				ip = seg.BridgeIf.DHCPv6[0].IP
+			}
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// fileServerURLs returns the HTTP and HTTPS URLs of the file server on
+// the bridge.
+func (qc *qemuCluster) fileServerURLs(bridge string, ipv6 bool) (string, string) {
+	return "http://" + qc.bridgeAddr(bridge, local.FileServerPort, ipv6),
+		"https://" + qc.bridgeAddr(bridge, local.FileServerTLSPort, ipv6)
+}
+
+func (qc *qemuCluster) AddFile(path string, contents []byte) {
+	qc.FileServer.AddFile(path, contents)
+}
+
+func (qc *qemuCluster) RemoveFile(path string) {
+	qc.FileServer.RemoveFile(path)
+}
+
+func (qc *qemuCluster) FileURL(m Machine, path string, tls bool) (string, error) {
+	qm, ok := m.(*qemuMachine)
+	if !ok || qm.qc != qc {
+		return "", fmt.Errorf("machine %s is not part of the cluster", m.ID())
+	}
+
+	url, tlsURL := qc.fileServerURLs(qm.bridge, qm.ipv6Only)
+	if tls {
+		url = tlsURL
+	}
+	return url + path, nil
+}
+
+// registryAddr returns the host and port of the Docker registry on the
+// bridge.
+func (qc *qemuCluster) registryAddr(bridge string, ipv6 bool) string {
+	return qc.bridgeAddr(bridge, local.RegistryPort, ipv6)
+}
+
+func (qc *qemuCluster) RegistryImages() []string {
+	return qc.Registry.Images()
+}
+
+func (qc *qemuCluster) RegistryAddr(m Machine) (string, error) {
+	qm, ok := m.(*qemuMachine)
+	if !ok || qm.qc != qc {
+		return "", fmt.Errorf("machine %s is not part of the cluster", m.ID())
+	}
+	return qc.registryAddr(qm.bridge, qm.ipv6Only), nil
+}
+
+// machineTaps returns the taps of the machines, which must belong to qc.
+func (qc *qemuCluster) machineTaps(machines []Machine) ([]string, error) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	var taps []string
+	for _, m := range machines {
+		qm, ok := m.(*qemuMachine)
+		if !ok || qm.qc != qc {
+			return nil, fmt.Errorf("machine %s is not part of the cluster", m.ID())
+		}
+		taps = append(taps, qm.taps...)
+	}
+	return taps, nil
+}
+
+func (qc *qemuCluster) Partition(groups ...[]Machine) error {
+	var tapGroups [][]string
+	for _, g := range groups {
+		taps, err := qc.machineTaps(g)
+		if err != nil {
+			return err
+		}
+		tapGroups = append(tapGroups, taps)
+	}
+	return qc.LocalCluster.Partition(tapGroups...)
+}
+
+func (qc *qemuCluster) SetNetem(m Machine, n local.Netem) error {
+	taps, err := qc.machineTaps([]Machine{m})
+	if err != nil {
+		return err
+	}
+	for _, tap := range taps {
+		if err := qc.LocalCluster.SetNetem(tap, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getInterfaces reserves an interface on each of the bridges.
+func (qc *qemuCluster) getInterfaces(bridges []string) ([]*local.Interface, error) {
+	var netifs []*local.Interface
+	for _, bridge := range bridges {
+		var seg *local.Segment
+		for _, s := range qc.Dnsmasq.Segments {
+			if s.BridgeName == bridge {
+				seg = s
+			}
+		}
+		if seg == nil {
+			qc.putInterfaces(netifs)
+			return nil, fmt.Errorf("no network segment %q", bridge)
+		}
+		netifs = append(netifs, qc.Dnsmasq.GetInterface(bridge))
+	}
+	return netifs, nil
+}
+
+// putInterfaces gives back netifs, unused, last taken first so each is
+// the last one taken on its segment, see Dnsmasq.PutInterface. The
+// caller must hold qc.mu.
+func (qc *qemuCluster) putInterfaces(netifs []*local.Interface) {
+	for i := len(netifs) - 1; i >= 0; i-- {
+		netifs[i].IPv6Only = false
+		qc.Dnsmasq.PutInterface(netifs[i])
+	}
+}
+
+// Create a blank sparse disk of size bytes as a nameless temporary file.
+func setupBlankDisk(size int64) (*os.File, error) {
+	f, err := ioutil.TempFile("", "mantle-qemu")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// setupImage creates a disk from image for the machine disk name, either
+// as a copy or as an overlay, and returns it along with its format.
+func (qc *qemuCluster) setupImage(image, name string) (*os.File, string, error) {
+	format, err := imageFormat(image)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !qc.conf.Overlay {
+		f, err := setupDisk(image)
+		return f, format, err
+	}
+
+	f, path, err := setupOverlay(image, format, qc.conf.PreserveDir, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if path != "" {
+		qc.mu.Lock()
+		qc.overlays = append(qc.overlays, path)
+		qc.mu.Unlock()
+	}
+
+	return f, "qcow2", nil
+}
+
+// imageFormat detects whether image is a qcow2 or raw image.
+func imageFormat(image string) (string, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("reading %s: %v", image, err)
+	}
+
+	if bytes.Equal(magic, []byte("QFI\xfb")) {
+		return "qcow2", nil
+	}
+	return "raw", nil
+}
+
+// Create a qcow2 overlay backed by image. If dir is empty the overlay is
+// a nameless temporary file, otherwise it is dir/name.qcow2 and its path
+// is returned.
+func setupOverlay(image, format, dir, name string) (*os.File, string, error) {
+	backing, err := filepath.Abs(image)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var path string
+	if dir != "" {
+		path = filepath.Join(dir, name+".qcow2")
+	} else {
+		tmp, err := ioutil.TempFile("", "mantle-qemu")
+		if err != nil {
+			return nil, "", err
+		}
+		path = tmp.Name()
+		tmp.Close()
+		defer os.Remove(path)
+	}
+
+	qemuImg := exec.Command("qemu-img", "create", "-q",
+		"-f", "qcow2", "-b", backing, "-F", format, path)
+	qemuImg.Stdout = os.Stdout
+	qemuImg.Stderr = os.Stderr
+
+	if err := qemuImg.Run(); err != nil {
+		return nil, "", fmt.Errorf("creating overlay of %s: %v", image, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if dir == "" {
+		path = ""
+	}
+	return f, path, nil
+}
+
 // Copy the base image to a new nameless temporary file.
 // cp is used since it supports sparse and reflink.
 func setupDisk(imageFile string) (*os.File, error) {
@@ -208,11 +1201,31 @@ func (m *qemuMachine) ID() string {
 }
 
 func (m *qemuMachine) IP() string {
+	if m.ipv6Only {
+		return m.netif.SLAAC.IP.String()
+	}
 	return m.netif.DHCPv4[0].IP.String()
 }
 
 func (m *qemuMachine) PrivateIP() string {
-	return m.netif.DHCPv4[0].IP.String()
+	if m.ipv6Only {
+		return m.privateIf.SLAAC.IP.String()
+	}
+	return m.privateIf.DHCPv4[0].IP.String()
+}
+
+func (m *qemuMachine) IPs() []string {
+	m.qc.mu.Lock()
+	defer m.qc.mu.Unlock()
+
+	var ips []string
+	for _, netif := range m.netifs {
+		if !m.ipv6Only {
+			ips = append(ips, netif.DHCPv4[0].IP.String())
+		}
+		ips = append(ips, netif.SLAAC.IP.String())
+	}
+	return ips
 }
 
 func (m *qemuMachine) SSHClient() (*ssh.Client, error) {
@@ -245,12 +1258,75 @@ func (m *qemuMachine) SSH(cmd string) ([]byte, error) {
 	return out, err
 }
 
+// copyConsole writes the console output in r to w and to the debug log.
+func (m *qemuMachine) copyConsole(r io.Reader, w io.WriteCloser) {
+	defer w.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		plog.Debugf("%s console: %s", m.id, line)
+		fmt.Fprintln(w, line)
+	}
+}
+
+// retries returns how often to retry ssh while m boots.
+func (m *qemuMachine) retries() int {
+	if m.qc.conf.Accel == "tcg" {
+		return sshRetries * tcgSlowdown
+	}
+	return sshRetries
+}
+
+func (m *qemuMachine) Reboot() error {
+	return rebootMachine(m, m.retries())
+}
+
+func (m *qemuMachine) WaitForBoot(bootID string) error {
+	return waitForBoot(m, bootID, m.retries())
+}
+
+func (m *qemuMachine) ConsoleOutput() (string, error) {
+	out, err := ioutil.ReadFile(m.console)
+	return string(out), err
+}
+
+// destroyConfig removes what was set up for m to boot: its config
+// drive, Ignition config or PXE boot config, and its DNS records.
+func (m *qemuMachine) destroyConfig() error {
+	if m.pxe {
+		m.qc.PXE.RemoveMachine(m.netif.HardwareAddr)
+	}
+	if len(m.dnsNames) > 0 {
+		if err := m.qc.RemoveDNSRecords(m.dnsNames...); err != nil {
+			plog.Errorf("removing DNS records of %s: %v", m.id, err)
+		}
+	}
+	if m.configDrive != nil {
+		return m.configDrive.Destroy()
+	}
+	if m.ignition != nil {
+		return m.ignition.Destroy()
+	}
+	return nil
+}
+
 func (m *qemuMachine) destroy(locked bool) error {
 	err := m.qemu.Kill()
 
-	if m.configDrive != nil {
-		err2 := m.configDrive.Destroy()
-		if err == nil && err2 != nil {
+	if err2 := m.destroyConfig(); err == nil && err2 != nil {
+		err = err2
+	}
+
+	m.qmpMu.Lock()
+	if m.qmp != nil {
+		m.qmp.Close()
+		m.qmp = nil
+	}
+	m.qmpMu.Unlock()
+
+	if m.qmpDir != "" {
+		if err2 := os.RemoveAll(m.qmpDir); err == nil && err2 != nil {
 			err = err2
 		}
 	}
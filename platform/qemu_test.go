@@ -0,0 +1,281 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/mantle/platform/local"
+)
+
+func TestParseQEMUDisk(t *testing.T) {
+	tests := []struct {
+		spec string
+		disk QEMUDisk
+		err  bool
+	}{
+		{"512", QEMUDisk{Size: 512}, false},
+		{"5G", QEMUDisk{Size: 5 << 30}, false},
+		{"100M,if=nvme", QEMUDisk{Size: 100 << 20, Interface: "nvme"}, false},
+		{"/tmp/disk.img,if=scsi", QEMUDisk{Image: "/tmp/disk.img", Interface: "scsi"}, false},
+		{"5G,if=ide", QEMUDisk{}, true},
+		{"5G,cache=none", QEMUDisk{}, true},
+		{"0", QEMUDisk{}, true},
+	}
+
+	for _, tt := range tests {
+		disk, err := ParseQEMUDisk(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if disk != tt.disk {
+			t.Errorf("%q: got %+v, want %+v", tt.spec, disk, tt.disk)
+		}
+	}
+}
+
+func TestQEMUMachineOptionsMerge(t *testing.T) {
+	defaults := QEMUMachineOptions{
+		CPUs:      2,
+		Memory:    2048,
+		Disks:     []QEMUDisk{{Size: 1}},
+		Networks:  []string{"br0"},
+		ExtraArgs: []string{"-a"},
+	}
+	req := QEMUMachineOptions{
+		CPUs:      4,
+		Memory:    1024,
+		Disks:     []QEMUDisk{{Size: 2}},
+		Networks:  []string{"br0", "br1"},
+		ExtraArgs: []string{"-b"},
+	}
+	want := QEMUMachineOptions{
+		CPUs:      4,
+		Memory:    2048,
+		Disks:     []QEMUDisk{{Size: 1}, {Size: 2}},
+		Networks:  []string{"br0", "br1"},
+		ExtraArgs: []string{"-a", "-b"},
+	}
+
+	if got := defaults.Merge(req); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if len(defaults.Disks) != 1 || len(defaults.ExtraArgs) != 1 {
+		t.Errorf("Merge modified its receiver: %+v", defaults)
+	}
+}
+
+func TestQEMUOptionsResolve(t *testing.T) {
+	o := QEMUOptions{Arch: "arm64", Accel: "tcg"}
+	if err := o.resolve(); err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	if o.Binary != "qemu-system-aarch64" || o.Machine != "virt" {
+		t.Errorf("unexpected defaults: %+v", o)
+	}
+
+	want := []string{"-machine", "virt,accel=tcg", "-cpu", "cortex-a57", "-bios", "/usr/share/AAVMF/AAVMF_CODE.fd"}
+	if args := o.cpuArgs(QEMUMachineOptions{}); !reflect.DeepEqual(args, want) {
+		t.Errorf("got args %q, want %q", args, want)
+	}
+
+	o = QEMUOptions{Arch: "amd64", Accel: "kvm", Binary: "/opt/qemu"}
+	if err := o.resolve(); err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	want = []string{"-machine", "pc,accel=kvm", "-cpu", "host"}
+	if args := o.cpuArgs(QEMUMachineOptions{}); o.Binary != "/opt/qemu" || !reflect.DeepEqual(args, want) {
+		t.Errorf("got binary %q args %q, want %q", o.Binary, args, want)
+	}
+
+	secure := QEMUMachineOptions{EFI: true, SecureBoot: true}
+	want = []string{"-machine", "q35,smm=on,accel=kvm", "-cpu", "host", "-global", "driver=cfi.pflash01,property=secure,value=on"}
+	if args := o.cpuArgs(secure); !reflect.DeepEqual(args, want) {
+		t.Errorf("got Secure Boot args %q, want %q", args, want)
+	}
+	if code, vars, err := o.efiFirmware(secure); err != nil || code != "/usr/share/OVMF/OVMF_CODE.secboot.fd" || vars != "/usr/share/OVMF/OVMF_VARS.secboot.fd" {
+		t.Errorf("unexpected Secure Boot firmware %q %q: %v", code, vars, err)
+	}
+
+	arm := QEMUOptions{Arch: "arm64", Accel: "tcg"}
+	arm.resolve()
+	if _, _, err := arm.efiFirmware(secure); err == nil {
+		t.Errorf("expected error for Secure Boot on arm64")
+	}
+
+	for _, bad := range []QEMUOptions{{Arch: "mips"}, {Accel: "hvf"}} {
+		if err := bad.resolve(); err == nil {
+			t.Errorf("%+v: expected error", bad)
+		}
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mantle-qemu-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		data   string
+		format string
+	}{
+		{"QFI\xfb\x00\x00\x00\x03", "qcow2"},
+		{"\xeb\x63\x90\x00", "raw"},
+		{"QF", "raw"},
+	}
+
+	for i, tt := range tests {
+		path := filepath.Join(dir, "image")
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		format, err := imageFormat(path)
+		if err != nil {
+			t.Errorf("image %d: %v", i, err)
+		} else if format != tt.format {
+			t.Errorf("image %d: got format %q, want %q", i, format, tt.format)
+		}
+	}
+}
+
+func TestQEMUDetachDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qemu-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &qemuMachine{id: "m", qmpDir: dir}
+	l, err := net.Listen("unix", m.qmpSocket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// a fake QMP answering every command, recording them with the
+	// arguments that matter here.
+	commands := make(chan string, 10)
+	go func() {
+		defer close(commands)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\r\n"))
+		dec := json.NewDecoder(bufio.NewReader(conn))
+		for {
+			var cmd struct {
+				Execute   string
+				Arguments map[string]interface{}
+			}
+			if err := dec.Decode(&cmd); err != nil {
+				return
+			}
+			c := cmd.Execute
+			for _, arg := range []string{"id", "command-line", "fdset-id"} {
+				if v, ok := cmd.Arguments[arg]; ok {
+					b, _ := json.Marshal(v)
+					c += " " + string(b)
+				}
+			}
+			commands <- c
+
+			resp := `{"return": {}}`
+			if cmd.Execute == "human-monitor-command" {
+				resp = `{"return": ""}`
+			}
+			conn.Write([]byte(resp + "\r\n"))
+		}
+	}()
+
+	m.addHotplugged("hotdisk0", &hotDevice{fdset: 3})
+	if err := m.Detach("hotdisk0"); err != nil {
+		t.Fatal(err)
+	}
+	// not hotplugged anymore, and neither is a disk of the command line.
+	if err := m.Detach("hotdisk0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Detach("disk1"); err != nil {
+		t.Fatal(err)
+	}
+	m.qmp.Close()
+
+	var got []string
+	for c := range commands {
+		got = append(got, c)
+	}
+	want := []string{
+		"qmp_capabilities",
+		`device_del "hotdisk0"`,
+		`human-monitor-command "drive_del hotdisk0"`,
+		"remove-fd 3",
+		`device_del "hotdisk0"`,
+		`device_del "disk1"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got commands %q, want %q", got, want)
+	}
+}
+
+func TestQEMUGetInterfaces(t *testing.T) {
+	ifs := []*local.Interface{{}, {}, {}}
+	qc := &qemuCluster{LocalCluster: &local.LocalCluster{
+		Dnsmasq: &local.Dnsmasq{Segments: []*local.Segment{
+			{BridgeName: "br0", Interfaces: ifs},
+		}},
+	}}
+
+	// a missing segment gives back what was taken before it.
+	if _, err := qc.getInterfaces([]string{"br0", "br0", "br9"}); err == nil {
+		t.Fatal("got interfaces on a missing segment")
+	}
+
+	netifs, err := qc.getInterfaces([]string{"br0", "br0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if netifs[0] != ifs[0] || netifs[1] != ifs[1] {
+		t.Fatalf("interfaces not given back")
+	}
+
+	netifs[1].IPv6Only = true
+	qc.putInterfaces(netifs)
+	if netifs, _ := qc.getInterfaces([]string{"br0"}); netifs[0] != ifs[0] {
+		t.Errorf("got %p after putting back, want the first interface %p", netifs[0], ifs[0])
+	}
+	if ifs[1].IPv6Only {
+		t.Errorf("interface given back still IPv6 only")
+	}
+}
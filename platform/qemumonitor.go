@@ -0,0 +1,377 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/mantle/platform/local"
+)
+
+// qmpSocket returns the path of the QMP socket of m.
+func (m *qemuMachine) qmpSocket() string {
+	return filepath.Join(m.qmpDir, "qmp.sock")
+}
+
+// monitor returns the QMP connection of m, connecting on first use.
+// The caller must hold m.qmpMu.
+func (m *qemuMachine) monitor() (*local.QMP, error) {
+	if m.qmp == nil {
+		qmp, err := local.NewQMP(m.qmpSocket())
+		if err != nil {
+			return nil, fmt.Errorf("connecting to QMP of %s: %v", m.id, err)
+		}
+		m.qmp = qmp
+	}
+	return m.qmp, nil
+}
+
+// execute runs a QMP command on m.
+func (m *qemuMachine) execute(command string, args interface{}) error {
+	m.qmpMu.Lock()
+	defer m.qmpMu.Unlock()
+
+	qmp, err := m.monitor()
+	if err != nil {
+		return err
+	}
+
+	_, err = qmp.Execute(command, args)
+	return err
+}
+
+// hmp runs a human monitor command on m, which reports errors only as
+// its output. ok is the output expected on success.
+func (m *qemuMachine) hmp(cmd, ok string) error {
+	m.qmpMu.Lock()
+	defer m.qmpMu.Unlock()
+
+	qmp, err := m.monitor()
+	if err != nil {
+		return err
+	}
+
+	out, err := qmp.HumanMonitorCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != ok {
+		return fmt.Errorf("%s: %s", cmd, out)
+	}
+	return nil
+}
+
+func (m *qemuMachine) Pause() error {
+	return m.execute("stop", nil)
+}
+
+func (m *qemuMachine) Resume() error {
+	return m.execute("cont", nil)
+}
+
+func (m *qemuMachine) Powerdown() error {
+	return m.execute("system_powerdown", nil)
+}
+
+func (m *qemuMachine) Reset() error {
+	return m.execute("system_reset", nil)
+}
+
+// Hotplugged devices get IDs of their own, hotdisk0, hotnic0, ..., to
+// never clash with the disk1... and nic0... of the command line.
+
+// hotDevice is what a hotplugged device uses besides itself: the fdset
+// of a disk, or the netdev, interface, tap and DNS records of a NIC.
+type hotDevice struct {
+	fdset    int
+	netdev   string
+	netif    *local.Interface
+	tap      string
+	dnsNames []string
+}
+
+// addHotplugged records what device id uses. The caller must hold
+// m.qmpMu.
+func (m *qemuMachine) addHotplugged(id string, dev *hotDevice) {
+	if m.hotplugged == nil {
+		m.hotplugged = make(map[string]*hotDevice)
+	}
+	m.hotplugged[id] = dev
+}
+
+func (m *qemuMachine) AttachDisk(size int64) (string, error) {
+	f, err := setupBlankDisk(size)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	m.qmpMu.Lock()
+	defer m.qmpMu.Unlock()
+
+	qmp, err := m.monitor()
+	if err != nil {
+		return "", err
+	}
+
+	id := fmt.Sprintf("hotdisk%d", m.devices)
+	m.devices++
+
+	// the disk is passed in an fdset, like the disks of the command line.
+	ret, err := qmp.ExecuteWithFile("add-fd", nil, f)
+	if err != nil {
+		return "", err
+	}
+	var fdset struct {
+		ID int `json:"fdset-id"`
+	}
+	if err := json.Unmarshal(ret, &fdset); err != nil {
+		return "", err
+	}
+	removeFd := func() {
+		qmp.Execute("remove-fd", map[string]int{"fdset-id": fdset.ID})
+	}
+
+	drive := fmt.Sprintf("drive_add 0 file=/dev/fdset/%d,if=none,id=%s,format=raw", fdset.ID, id)
+	out, err := qmp.HumanMonitorCommand(drive)
+	if err == nil && strings.TrimSpace(out) != "OK" {
+		err = fmt.Errorf("%s: %s", drive, strings.TrimSpace(out))
+	}
+	if err != nil {
+		removeFd()
+		return "", err
+	}
+
+	args := map[string]string{
+		"driver": "virtio-blk-pci",
+		"drive":  id,
+		"id":     id,
+	}
+	if _, err := qmp.Execute("device_add", args); err != nil {
+		qmp.HumanMonitorCommand("drive_del " + id)
+		removeFd()
+		return "", err
+	}
+
+	m.addHotplugged(id, &hotDevice{fdset: fdset.ID})
+	return id, nil
+}
+
+func (m *qemuMachine) AttachNIC(bridge string) (string, error) {
+	qc := m.qc
+
+	qc.mu.Lock()
+	netifs, err := qc.getInterfaces([]string{bridge})
+	if err != nil {
+		qc.mu.Unlock()
+		return "", err
+	}
+	tap, err := qc.NewTap(bridge)
+	if err != nil {
+		qc.Dnsmasq.PutInterface(netifs[0])
+		qc.mu.Unlock()
+		return "", err
+	}
+	qc.mu.Unlock()
+	defer tap.Close()
+
+	putInterface := func() {
+		qc.mu.Lock()
+		qc.Dnsmasq.PutInterface(netifs[0])
+		qc.mu.Unlock()
+	}
+
+	m.qmpMu.Lock()
+	defer m.qmpMu.Unlock()
+
+	qmp, err := m.monitor()
+	if err != nil {
+		putInterface()
+		return "", err
+	}
+
+	n := m.devices
+	m.devices++
+	id, netdev := fmt.Sprintf("hotnic%d", n), fmt.Sprintf("hottap%d", n)
+
+	if _, err := qmp.ExecuteWithFile("getfd", map[string]string{"fdname": netdev}, tap.File); err != nil {
+		putInterface()
+		return "", err
+	}
+
+	args := map[string]string{
+		"type": "tap",
+		"id":   netdev,
+		"fd":   netdev,
+	}
+	if _, err := qmp.Execute("netdev_add", args); err != nil {
+		qmp.Execute("closefd", map[string]string{"fdname": netdev})
+		putInterface()
+		return "", err
+	}
+
+	args = map[string]string{
+		"driver": "virtio-net-pci",
+		"netdev": netdev,
+		"mac":    netifs[0].HardwareAddr.String(),
+		"id":     id,
+	}
+	if _, err := qmp.Execute("device_add", args); err != nil {
+		// netdev_add took the fd, removing the netdev closes it.
+		qmp.Execute("netdev_del", map[string]string{"id": netdev})
+		putInterface()
+		return "", err
+	}
+
+	dev := &hotDevice{netdev: netdev, netif: netifs[0], tap: tap.Attrs().Name}
+	if err := m.addNICRecords(id, bridge, dev); err != nil {
+		qmp.Execute("device_del", map[string]string{"id": id})
+		qmp.Execute("netdev_del", map[string]string{"id": netdev})
+		putInterface()
+		return "", err
+	}
+
+	qc.mu.Lock()
+	m.netifs = append(m.netifs, dev.netif)
+	m.taps = append(m.taps, dev.tap)
+	qc.mu.Unlock()
+
+	m.addHotplugged(id, dev)
+	return id, nil
+}
+
+// addNICRecords registers the hotplugged NIC id in DNS as
+// name.<bridge>.local, or id.name.<bridge>.local if the machine has a
+// NIC on bridge already.
+func (m *qemuMachine) addNICRecords(id, bridge string, dev *hotDevice) error {
+	if m.name == "" {
+		return nil
+	}
+
+	name := m.name + "." + bridge + ".local"
+	for _, n := range m.dnsNames {
+		if n == name {
+			name = id + "." + name
+			break
+		}
+	}
+
+	records := local.DNSRecords{
+		Hosts: []local.HostRecord{{Name: name, IPs: m.netifIPs(dev.netif)}},
+	}
+	if err := m.qc.AddDNSRecords(records); err != nil {
+		return err
+	}
+
+	dev.dnsNames = []string{name}
+	m.dnsNames = append(m.dnsNames, name)
+	return nil
+}
+
+// Detach removes the device id. For hotplugged devices it also removes
+// the disk's drive and fdset, or the NIC's netdev, which closes its tap,
+// and gives back its interface and DNS records.
+func (m *qemuMachine) Detach(id string) error {
+	m.qmpMu.Lock()
+	defer m.qmpMu.Unlock()
+
+	qmp, err := m.monitor()
+	if err != nil {
+		return err
+	}
+
+	if _, err := qmp.Execute("device_del", map[string]string{"id": id}); err != nil {
+		return err
+	}
+
+	dev, ok := m.hotplugged[id]
+	if !ok {
+		return nil
+	}
+	delete(m.hotplugged, id)
+
+	firstErr := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if dev.netif == nil {
+		// QEMU may have removed the drive with the device already.
+		out, e := qmp.HumanMonitorCommand("drive_del " + id)
+		if out = strings.TrimSpace(out); e == nil && out != "" && !strings.Contains(out, "not found") {
+			e = fmt.Errorf("drive_del %s: %s", id, out)
+		}
+		firstErr(e)
+		_, e = qmp.Execute("remove-fd", map[string]int{"fdset-id": dev.fdset})
+		firstErr(e)
+		return err
+	}
+
+	_, e := qmp.Execute("netdev_del", map[string]string{"id": dev.netdev})
+	firstErr(e)
+
+	qc := m.qc
+	qc.mu.Lock()
+	for i, netif := range m.netifs {
+		if netif == dev.netif {
+			m.netifs = append(m.netifs[:i], m.netifs[i+1:]...)
+			break
+		}
+	}
+	for i, tap := range m.taps {
+		if tap == dev.tap {
+			m.taps = append(m.taps[:i], m.taps[i+1:]...)
+			break
+		}
+	}
+	qc.Dnsmasq.PutInterface(dev.netif)
+	qc.mu.Unlock()
+
+	if len(dev.dnsNames) > 0 {
+		firstErr(qc.RemoveDNSRecords(dev.dnsNames...))
+		var names []string
+		for _, n := range m.dnsNames {
+			if n != dev.dnsNames[0] {
+				names = append(names, n)
+			}
+		}
+		m.dnsNames = names
+	}
+
+	return err
+}
+
+func (m *qemuMachine) SetLink(nic string, up bool) error {
+	args := map[string]interface{}{
+		"name": nic,
+		"up":   up,
+	}
+	return m.execute("set_link", args)
+}
+
+// savevm and loadvm have no QMP equivalent in the QEMU versions we
+// support, so they use the human monitor.
+
+func (m *qemuMachine) SaveSnapshot(name string) error {
+	return m.hmp("savevm "+name, "")
+}
+
+func (m *qemuMachine) LoadSnapshot(name string) error {
+	return m.hmp("loadvm "+name, "")
+}
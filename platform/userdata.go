@@ -0,0 +1,134 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// UserdataVars holds the values available to userdata templates.
+//
+// Userdata passed to NewMachine is a text/template, executed with a
+// UserdataVars as its data, e.g. "name: {{.Name}}". Referring to a field
+// or option that does not exist is an error. A literal "{{" is written as
+// {{"{{"}}, and the json function quotes a value for use inside an
+// Ignition config, e.g. "contents": {{json .Discovery}}.
+type UserdataVars struct {
+	// Index is the position of the machine within the test cluster,
+	// counting from 0 in the order machines are created.
+	Index int
+
+	// Name is a unique name for the machine, "instance<Index>".
+	Name string
+
+	// Discovery is the etcd discovery URL of the test cluster.
+	Discovery string
+
+	// ClusterSize is the number of machines the test cluster was
+	// started with.
+	ClusterSize int
+
+	// Peers holds the Name of each of the ClusterSize machines.
+	Peers []string
+
+	// Options holds the test options registered with kola.
+	Options map[string]string
+
+	// The remaining fields are filled in by the platform.
+
+	// Platform is the name of the platform, e.g. "qemu".
+	Platform string
+
+	// PublicIPv4 and PrivateIPv4 are the addresses of the machine.
+	// Platforms that assign addresses at boot (GCE and AWS) set them to
+	// "$public_ipv4" and "$private_ipv4", which coreos-cloudinit
+	// replaces using the metadata service. Ignition does no such
+	// replacement, so Ignition configs can only use them on QEMU.
+	PublicIPv4  string
+	PrivateIPv4 string
+
+	// PublicIPv6 and PrivateIPv6 are the SLAAC addresses of the machine
+	// on QEMU, where machines with IPv6Only set have no IPv4 addresses.
+	PublicIPv6  string
+	PrivateIPv6 string
+
+	// FileServer and FileServerTLS are the HTTP and HTTPS URLs of the
+	// cluster's file server, see FileServerCluster, and FileServerCA
+	// is the PEM certificate to trust for HTTPS. They are only set on
+	// QEMU.
+	FileServer    string
+	FileServerTLS string
+	FileServerCA  string
+
+	// Registry is the host and port of the cluster's Docker registry,
+	// see RegistryCluster, e.g. for "{{.Registry}}/busybox". It is only
+	// set on QEMU.
+	Registry string
+}
+
+var userdataFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+}
+
+// RenderUserdata executes the userdata template tmpl with vars.
+func RenderUserdata(tmpl string, vars UserdataVars) (string, error) {
+	t, err := template.New("userdata").Funcs(userdataFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("parsing userdata template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("rendering userdata template: %v", err)
+	}
+
+	return buf.String(), nil
+}
+
+// templateCluster is implemented by the clusters of this package. It
+// creates a machine from a userdata template, filling in the platform
+// specific fields of vars.
+type templateCluster interface {
+	newMachine(userdata string, vars UserdataVars) (Machine, error)
+}
+
+// machineOptionsCluster is implemented by clusters that can create
+// machines of a given shape.
+type machineOptionsCluster interface {
+	newMachineWithOptions(userdata string, vars UserdataVars, opts QEMUMachineOptions) (Machine, error)
+}
+
+// machineName returns the UserdataVars Name of the machine at index.
+func machineName(index int) string {
+	return fmt.Sprintf("instance%d", index)
+}
+
+// standaloneVars returns the UserdataVars of a machine created directly
+// through Cluster.NewMachine rather than as part of a test.
+func standaloneVars() UserdataVars {
+	return UserdataVars{
+		Name:        machineName(0),
+		ClusterSize: 1,
+		Peers:       []string{machineName(0)},
+	}
+}
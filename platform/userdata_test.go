@@ -0,0 +1,66 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"testing"
+)
+
+func TestRenderUserdata(t *testing.T) {
+	vars := UserdataVars{
+		Index:       1,
+		Name:        "instance1",
+		Discovery:   "https://discovery.etcd.io/abc",
+		ClusterSize: 2,
+		Peers:       []string{"instance0", "instance1"},
+		Options:     map[string]string{"Version": "2.2.0"},
+		Platform:    "qemu",
+		PrivateIPv4: "10.0.0.2",
+	}
+
+	tests := []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{"", "", false},
+		{"name: {{.Name}}", "name: instance1", false},
+		{"http://{{.PrivateIPv4}}:2379 {{.Discovery}}", "http://10.0.0.2:2379 https://discovery.etcd.io/abc", false},
+		{`{{join .Peers ","}} {{.Index}}/{{.ClusterSize}}`, "instance0,instance1 1/2", false},
+		{"{{.Options.Version}}", "2.2.0", false},
+		{`{"contents": {{json .Discovery}}}`, `{"contents": "https://discovery.etcd.io/abc"}`, false},
+		{`echo {{"{{"}}.Name}} $name`, "echo {{.Name}} $name", false},
+		{"{{.Options.Missing}}", "", true},
+		{"{{.Missing}}", "", true},
+		{"{{.Name", "", true},
+	}
+
+	for _, tt := range tests {
+		out, err := RenderUserdata(tt.in, vars)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q", tt.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if out != tt.out {
+			t.Errorf("%q: got %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
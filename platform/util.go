@@ -27,14 +27,10 @@ import (
 // If os.Stdin does not refer to a TTY, Manhole returns immediately with a nil
 // error.
 func Manhole(m Machine) error {
-	fd := int(os.Stdin.Fd())
-	if !terminal.IsTerminal(fd) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
 		return nil
 	}
 
-	tstate, _ := terminal.MakeRaw(fd)
-	defer terminal.Restore(fd, tstate)
-
 	client, err := m.SSHClient()
 	if err != nil {
 		return fmt.Errorf("SSH client failed: %v", err)
@@ -42,6 +38,19 @@ func Manhole(m Machine) error {
 
 	defer client.Close()
 
+	return Shell(client)
+}
+
+// Shell is like Manhole, for a machine connected to with client.
+func Shell(client *ssh.Client) error {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil
+	}
+
+	tstate, _ := terminal.MakeRaw(fd)
+	defer terminal.Restore(fd, tstate)
+
 	session, err := client.NewSession()
 	if err != nil {
 		return fmt.Errorf("SSH session failed: %v", err)